@@ -3,8 +3,10 @@ package api
 import (
 	"errors"
 	"fmt"
+	"github.com/msayson/kvservice/kvstore"
 	"github.com/msayson/kvservice/util/rpc_util"
 	"net/rpc"
+	"time"
 )
 
 // Struct for Get() RPC call arguments
@@ -18,6 +20,23 @@ type SetArgs struct {
 	Val string
 }
 
+// Struct for MultiGet() RPC call arguments
+type MultiGetArgs struct {
+	Keys []string // Will look up values associated with each key
+}
+
+// Struct for MultiSet() RPC call arguments
+type MultiSetArgs struct {
+	Entries []kvstore.KeyValue // Will set value for each key, ignoring versions
+}
+
+// Struct for SetTTL() RPC call arguments
+type SetTTLArgs struct {
+	Key string // Will set value for Key
+	Val string
+	TTL time.Duration // Key is removed once TTL has elapsed
+}
+
 // Struct for TestSet() RPC call arguments
 // Semantics: if val(Key) == TestVal, will set val(Key) = NewVal
 type TestSetArgs struct {
@@ -26,20 +45,202 @@ type TestSetArgs struct {
 	NewVal  string
 }
 
+// Struct for CompareAndSwap() RPC call arguments
+// Semantics: if version(Key) == ExpectedVersion, will set val(Key) = NewVal
+type CompareAndSwapArgs struct {
+	Key             string // Key to compare/swap value for
+	ExpectedVersion uint64 // 0 if Key is expected to be absent
+	NewVal          string
+}
+
+// Struct for Delete() RPC call arguments
+type DeleteArgs struct {
+	Key string // Will remove Key and its value
+}
+
+// Struct for Scan() RPC call arguments
+// Semantics: returns up to Limit key-values with keys in [StartKey, EndKey)
+type ScanArgs struct {
+	StartKey string // first key to return, or cursor from a previous reply
+	EndKey   string // "" to scan to the last key
+	Limit    int    // <= 0 to return all keys in range
+}
+
+// Struct for Watch() RPC call arguments
+// Semantics: waits up to Timeout for changes to Key after SinceVersion
+type WatchArgs struct {
+	Key          string // Key to watch, or key prefix if IsPrefix
+	IsPrefix     bool
+	SinceVersion uint64 // 0 to wait for changes from now on
+	Timeout      time.Duration
+}
+
+// Struct for Txn() RPC call arguments
+// Semantics: if every Compare holds, executes Success, otherwise Failure
+type TxnArgs struct {
+	Compares []kvstore.Compare // guard conditions, checked before any operation
+	Success  []kvstore.Op
+	Failure  []kvstore.Op
+}
+
 // Struct for Join() RPC call arguments
 type JoinArgs struct {
 	IpPort string // ip:port of node requesting to join network
+	Shard  string // sharded front-ends only: name of the shard whose chain to join
+	After  string // rejoining node only: member to rejoin after, if still in the chain
+}
+
+// Struct for AddShard() and RemoveShard() RPC call arguments
+type ShardArgs struct {
+	Name string // name of the shard, as given by its nodes when joining
+}
+
+// Struct for Leave() RPC call arguments
+type LeaveArgs struct {
+	IpPort string // ip:port of node leaving or removed from the network
+}
+
+// Struct for Replicate() RPC call arguments: the changes made by writes at
+// the head of the chain, and the sender's membership epoch
+// Changes are passed on rather than the writes themselves, so that a
+// conditional write cannot take a different branch on a node whose key-values
+// differ.  Changes are numbered by the head, and applied by each node in order.
+type ReplicateArgs struct {
+	Epoch     uint64
+	Mutations []kvstore.Mutation // in sequence order, applied atomically
 }
 
 // Struct for RPC call replies
 type ValReply struct {
-	Val string
+	Val     string
+	Found   bool   // Get/Delete only: whether the key was present
+	Version uint64 // Get only: version of Val, or 0 if the key was absent
+}
+
+// Struct for CompareAndSwap() RPC call replies
+type CompareAndSwapReply struct {
+	Version uint64 // new version if Swapped, otherwise the key's current version
+	Swapped bool
 }
 
-// Struct for GetNextNodes() RPC call replies
-type GetNextNodesReply struct {
-	HeadIpPort string
-	NextIpPort string
+// Struct for MultiGet() and MultiSet() RPC call replies
+type MultiReply struct {
+	Entries []kvstore.KeyValue // one per requested key, with its value and version
+}
+
+// Struct for Scan() RPC call replies
+type ScanReply struct {
+	Entries []kvstore.KeyValue
+	NextKey string // StartKey for the next page, or "" if the scan is complete
+}
+
+// Struct for Watch() RPC call replies
+type WatchReply struct {
+	Events      []kvstore.Mutation // empty if the timeout elapsed
+	NextVersion uint64             // SinceVersion for the next Watch() call
+	Compacted   bool               // whether changes after SinceVersion are no longer available
+}
+
+// Struct for Txn() RPC call replies
+type TxnReply struct {
+	Succeeded bool               // whether every Compare held
+	Results   []kvstore.OpResult // one per executed operation
+}
+
+// Struct for GetSnapshot() RPC call replies
+type SnapshotReply struct {
+	Entries []kvstore.Mutation // every key-value, with its version as Seq
+	Seq     uint64             // sequence number of the last mutation included
+}
+
+// Struct for CatchUp() RPC call arguments: the last change applied by a node
+// which missed later changes
+type CatchUpArgs struct {
+	Seq  uint64           // sequence number of the last change applied
+	Last kvstore.Mutation // the last change applied, to check that it matches the sender's
+}
+
+// Struct for CatchUp() RPC call replies
+type CatchUpReply struct {
+	Found     bool               // whether the receiver still holds every change after Seq, and Last matches
+	Mutations []kvstore.Mutation // Found only: every change after Seq, in sequence order
+}
+
+// Struct for ApplyVersioned() RPC call arguments: writes versioned by a
+// quorum front-end, each with its version as Seq
+type VersionedArgs struct {
+	Mutations []kvstore.Mutation
+}
+
+// Struct for GetVersioned(), ApplyVersioned() and DiscardVersioned() RPC call replies
+type VersionedReply struct {
+	Mutations []kvstore.Mutation // GetVersioned only: latest change to each key, including removals
+	Applied   int                // ApplyVersioned: number of writes newer than the node's versions; DiscardVersioned: number of keys removed
+}
+
+// Struct for CompareTree() RPC call arguments: the hashes of some nodes at one
+// level of the sender's hash tree, taken at sequence number Seq
+type CompareTreeArgs struct {
+	Seq     uint64
+	Level   int      // level of the nodes, 0 for the root
+	Indices []int    // position of each node within the level
+	Hashes  []uint64 // hash of each node
+}
+
+// Struct for CompareTree() RPC call replies
+type CompareTreeReply struct {
+	Stale  bool  // whether the receiver's key-values are at a different sequence number
+	Differ []int // positions of the nodes whose hashes differ from the receiver's
+}
+
+// Struct for Repair() RPC call arguments: every key-value the sender holds
+// in some leaves of its hash tree, taken at sequence number Seq
+type RepairArgs struct {
+	Seq     uint64
+	Buckets []int              // leaves of the hash tree to replace
+	Entries []kvstore.Mutation // every key-value in Buckets, with its version as Seq
+}
+
+// Struct for Repair() RPC call replies
+type RepairReply struct {
+	Stale    bool // whether the receiver's key-values are at a different sequence number
+	Repaired int  // number of key-values written or removed
+}
+
+// Struct for Replicate() RPC call replies
+type ReplicateReply struct {
+	Rejected   bool       // whether the sender's epoch was older than the receiver's
+	Membership Membership // Rejected only: the receiver's membership
+	Gap        bool       // whether the receiver is missing changes before the ones sent
+	Seq        uint64     // Gap only: sequence number of the last change the receiver applied
+}
+
+// Struct for Join() and GetMembership() RPC call replies, and
+// UpdateMembership() RPC call arguments
+// GetMembership() RPC calls take the caller's ip:port as their argument.
+type Membership struct {
+	Epoch   uint64   // incremented by the leading front-end on every change
+	Members []string // ip:port of each back-end node, from head to tail
+	Joining []string // members which are still copying key-values and not yet serving reads
+}
+
+// Time that each Watch() RPC call waits for changes before replying
+const watchPollTimeout = 30 * time.Second
+
+// Connect to the first reachable server in ipPorts, trying each in turn
+// starting from index start and wrapping around
+// Returns the connection and the index of its server.
+func ConnectToAny(ipPorts []string, start int) (*rpc.Client, int, error) {
+	err := errors.New("api.ConnectToAny: expected at least one ip:port, received none")
+	for i := range ipPorts {
+		index := (start + i) % len(ipPorts)
+		var rpcClient *rpc.Client
+		rpcClient, err = rpc_util.DialTimeout(ipPorts[index], 0)
+		if err == nil {
+			return rpcClient, index, nil
+		}
+	}
+	return nil, 0, err
 }
 
 // Initiate a Get() RPC call
@@ -62,6 +263,38 @@ func Set(kvserver *rpc.Client, key, value string) (string, error) {
 	return reply.Val, err
 }
 
+// Initiate a MultiGet() RPC call
+// Missing keys are returned with an empty value and version 0.
+func MultiGet(kvserver *rpc.Client, keys []string) ([]kvstore.KeyValue, error) {
+	reply := MultiReply{}
+	err := kvserver.Call("KeyValService.MultiGet", MultiGetArgs{keys}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.MultiGet RPC call failed: %s", err.Error()))
+	}
+	return reply.Entries, err
+}
+
+// Initiate a MultiSet() RPC call
+// Returns the entries with their new versions.
+func MultiSet(kvserver *rpc.Client, entries []kvstore.KeyValue) ([]kvstore.KeyValue, error) {
+	reply := MultiReply{}
+	err := kvserver.Call("KeyValService.MultiSet", MultiSetArgs{entries}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.MultiSet RPC call failed: %s", err.Error()))
+	}
+	return reply.Entries, err
+}
+
+// Initiate a SetTTL() RPC call
+func SetTTL(kvserver *rpc.Client, key, value string, ttl time.Duration) (string, error) {
+	reply := ValReply{}
+	err := kvserver.Call("KeyValService.SetTTL", SetTTLArgs{key, value, ttl}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.SetTTL RPC call failed: %s", err.Error()))
+	}
+	return reply.Val, err
+}
+
 // Initiate a TestSet() RPC call
 func TestSet(kvserver *rpc.Client, key, testValue, newValue string) (string, error) {
 	reply := ValReply{}
@@ -72,25 +305,235 @@ func TestSet(kvserver *rpc.Client, key, testValue, newValue string) (string, err
 	return reply.Val, err
 }
 
-// Initiate a Join() RPC call
-func JoinNetwork(kvserver *rpc.Client, ipPort string) (string, error) {
+// Initiate a Get() RPC call, also reporting whether the key was present
+func Lookup(kvserver *rpc.Client, key string) (string, bool, error) {
+	reply := ValReply{}
+	err := kvserver.Call("KeyValService.Get", GetArgs{key}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.Get RPC call failed: %s", err.Error()))
+	}
+	return reply.Val, reply.Found, err
+}
+
+// Initiate a Get() RPC call, also returning the value's version
+func GetVersion(kvserver *rpc.Client, key string) (string, uint64, error) {
+	reply := ValReply{}
+	err := kvserver.Call("KeyValService.Get", GetArgs{key}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.Get RPC call failed: %s", err.Error()))
+	}
+	return reply.Val, reply.Version, err
+}
+
+// Initiate a CompareAndSwap() RPC call
+// Returns the new version, or a *kvstore.VersionConflictError if the key's
+// version did not match expectedVersion
+func CompareAndSwap(kvserver *rpc.Client, key string, expectedVersion uint64, newValue string) (uint64, error) {
+	reply := CompareAndSwapReply{}
+	err := kvserver.Call("KeyValService.CompareAndSwap", CompareAndSwapArgs{key, expectedVersion, newValue}, &reply)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("KeyValService.CompareAndSwap RPC call failed: %s", err.Error()))
+	}
+	if !reply.Swapped {
+		return reply.Version, &kvstore.VersionConflictError{Key: key, ExpectedVersion: expectedVersion, ActualVersion: reply.Version}
+	}
+	return reply.Version, nil
+}
+
+// Initiate a Scan() RPC call
+// Returns the key-values found and a cursor to pass as startKey for the
+// next page, or "" if there are no more pages
+func Scan(kvserver *rpc.Client, startKey, endKey string, limit int) ([]kvstore.KeyValue, string, error) {
+	reply := ScanReply{}
+	err := kvserver.Call("KeyValService.Scan", ScanArgs{startKey, endKey, limit}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.Scan RPC call failed: %s", err.Error()))
+	}
+	return reply.Entries, reply.NextKey, err
+}
+
+// Initiate a Scan() RPC call for keys beginning with prefix
+// Resume from the returned cursor with Scan(cursor, kvstore.PrefixEnd(prefix), limit).
+func ScanPrefix(kvserver *rpc.Client, prefix string, limit int) ([]kvstore.KeyValue, string, error) {
+	return Scan(kvserver, prefix, kvstore.PrefixEnd(prefix), limit)
+}
+
+// Initiate Watch() RPC calls in a loop, sending changes to key (or to keys
+// beginning with key, if isPrefix) after sinceVersion to events, until stop
+// is closed or a call fails.  A sinceVersion of 0 watches for changes from now on.
+// Returns nil once stopped, or kvstore.ErrHistoryCompacted if the server
+// no longer has the changes after sinceVersion.
+func Watch(kvserver *rpc.Client, key string, isPrefix bool, sinceVersion uint64, events chan<- kvstore.Mutation, stop <-chan bool) error {
+	for {
+		reply := WatchReply{}
+		args := WatchArgs{key, isPrefix, sinceVersion, watchPollTimeout}
+		call := kvserver.Go("KeyValService.Watch", args, &reply, nil)
+		select {
+		case <-stop:
+			return nil
+		case <-call.Done:
+		}
+		if call.Error != nil {
+			return errors.New(fmt.Sprintf("KeyValService.Watch RPC call failed: %s", call.Error.Error()))
+		}
+		if reply.Compacted {
+			return kvstore.ErrHistoryCompacted
+		}
+		for _, event := range reply.Events {
+			select {
+			case <-stop:
+				return nil
+			case events <- event:
+			}
+		}
+		sinceVersion = reply.NextVersion
+	}
+}
+
+// Initiate a Txn() RPC call
+func Txn(kvserver *rpc.Client, args TxnArgs) (TxnReply, error) {
+	reply := TxnReply{}
+	err := kvserver.Call("KeyValService.Txn", args, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.Txn RPC call failed: %s", err.Error()))
+	}
+	return reply, err
+}
+
+// Initiate a Delete() RPC call
+// Returns whether the key was present before the delete
+func Delete(kvserver *rpc.Client, key string) (bool, error) {
 	reply := ValReply{}
-	joinArgs := JoinArgs{ipPort}
+	err := kvserver.Call("KeyValService.Delete", DeleteArgs{key}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.Delete RPC call failed: %s", err.Error()))
+	}
+	return reply.Found, err
+}
+
+// Initiate a Join() RPC call, joining the chain of the given shard if the
+// front-end is sharded
+// Returns the chain's membership, ending with the joining node
+func JoinNetwork(kvserver *rpc.Client, ipPort string, shard string) (Membership, error) {
+	reply := Membership{}
+	joinArgs := JoinArgs{IpPort: ipPort, Shard: shard}
 	err := kvserver.Call("KeyValService.Join", joinArgs, &reply)
 	if err != nil {
-		reply.Val = ""
-		fmt.Sprintf("KeyValService.Join RPC call failed: %v", err)
+		err = errors.New(fmt.Sprintf("KeyValService.Join RPC call failed: %s", err.Error()))
+	}
+	return reply, err
+}
+
+// Initiate a Leave() RPC call, telling the network to link around the node at ipPort
+func LeaveNetwork(kvserver *rpc.Client, ipPort string) (string, error) {
+	reply := ValReply{}
+	err := kvserver.Call("KeyValService.Leave", LeaveArgs{ipPort}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.Leave RPC call failed: %s", err.Error()))
 	}
 	return reply.Val, err
 }
 
-// Initialiate a Join() RPC call using a known node's ip:port
-func JoinNetworkByIpPort(targetIpPort, ipPort string) (string, error) {
+// Initiate a Leave() RPC call using a known node's ip:port
+func LeaveNetworkByIpPort(targetIpPort, ipPort string) (string, error) {
 	rpcClient, err := rpc_util.Connect(targetIpPort)
 	if err != nil {
 		return "", err
 	}
 	defer rpcClient.Close()
-	replyVal, err := JoinNetwork(rpcClient, ipPort)
-	return replyVal, err
+	return LeaveNetwork(rpcClient, ipPort)
+}
+
+// Initiate an Activate() RPC call, telling the front-end that the node at
+// ipPort has joined the end of the chain and can serve reads
+func ActivateByIpPort(frontendIpPort, ipPort string) (string, error) {
+	rpcClient, err := rpc_util.Connect(frontendIpPort)
+	if err != nil {
+		return "", err
+	}
+	defer rpcClient.Close()
+	reply := ValReply{}
+	err = rpcClient.Call("KeyValService.Activate", JoinArgs{IpPort: ipPort}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.Activate RPC call failed: %s", err.Error()))
+	}
+	return reply.Val, err
+}
+
+// Initiate a GetSnapshot() RPC call on the node at ipPort
+func GetSnapshotByIpPort(ipPort string) ([]kvstore.Mutation, uint64, error) {
+	rpcClient, err := rpc_util.Connect(ipPort)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rpcClient.Close()
+	reply := SnapshotReply{}
+	err = rpcClient.Call("KeyValService.GetSnapshot", 0, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.GetSnapshot RPC call failed: %s", err.Error()))
+	}
+	return reply.Entries, reply.Seq, err
+}
+
+// Initialiate a Join() RPC call using a known node's ip:port
+func JoinNetworkByIpPort(targetIpPort, ipPort string, shard string) (Membership, error) {
+	rpcClient, err := rpc_util.Connect(targetIpPort)
+	if err != nil {
+		return Membership{}, err
+	}
+	defer rpcClient.Close()
+	return JoinNetwork(rpcClient, ipPort, shard)
+}
+
+// Initiate a Join() RPC call using a known node's ip:port, for a node which
+// was removed from the chain and is rejoining after the member at afterIpPort
+func RejoinNetworkByIpPort(targetIpPort, ipPort string, shard string, afterIpPort string) (Membership, error) {
+	rpcClient, err := rpc_util.Connect(targetIpPort)
+	if err != nil {
+		return Membership{}, err
+	}
+	defer rpcClient.Close()
+	reply := Membership{}
+	err = rpcClient.Call("KeyValService.Join", JoinArgs{IpPort: ipPort, Shard: shard, After: afterIpPort}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.Join RPC call failed: %s", err.Error()))
+	}
+	return reply, err
+}
+
+// Initiate a CatchUp() RPC call on the node at ipPort, fetching the changes
+// after last, which was the change with sequence number seq
+// Returns whether the node still holds every such change.
+func CatchUpByIpPort(ipPort string, seq uint64, last kvstore.Mutation) ([]kvstore.Mutation, bool, error) {
+	rpcClient, err := rpc_util.Connect(ipPort)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rpcClient.Close()
+	reply := CatchUpReply{}
+	err = rpcClient.Call("KeyValService.CatchUp", CatchUpArgs{seq, last}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.CatchUp RPC call failed: %s", err.Error()))
+	}
+	return reply.Mutations, reply.Found, err
+}
+
+// Initiate an AddShard() RPC call, moving keys onto the shard's chain
+func AddShard(kvserver *rpc.Client, name string) (string, error) {
+	reply := ValReply{}
+	err := kvserver.Call("KeyValService.AddShard", ShardArgs{name}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.AddShard RPC call failed: %s", err.Error()))
+	}
+	return reply.Val, err
+}
+
+// Initiate a RemoveShard() RPC call, moving keys off the shard's chain
+func RemoveShard(kvserver *rpc.Client, name string) (string, error) {
+	reply := ValReply{}
+	err := kvserver.Call("KeyValService.RemoveShard", ShardArgs{name}, &reply)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("KeyValService.RemoveShard RPC call failed: %s", err.Error()))
+	}
+	return reply.Val, err
 }
@@ -1,8 +1,9 @@
 // A command-line client for the key-value service
 //
-// Usage: go run client.go [server ip:port]
+// Usage: go run client.go [server ip:port] [server ip:port...]
 //
-// - [server ip:port] : the IP address and TCP port of the server to connect to
+// - [server ip:port] : the IP address and TCP port of a server to connect to.
+//   If several are given, the client fails over to the next when one stops responding.
 
 package main
 
@@ -10,37 +11,58 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/msayson/kvservice/api"
-	"github.com/msayson/kvservice/util/rpc_util"
+	"github.com/msayson/kvservice/kvstore"
 	"github.com/msayson/kvservice/util/userinput"
 	"net/rpc"
 	"os"
+	"strconv"
+	"time"
 )
 
 // The RPC object for the key-value server
 var kvserver *rpc.Client
 
+// ip:port of each server to connect to, and the index of the current one
+var servers []string
+var serverIndex int
+
+// Number of key-values to fetch per Scan() RPC call
+const scanPageSize = 100
+
+// Number of times to try every server before giving up on reconnecting
+const maxReconnectTries = 10
+
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: go run client.go [server ip:port]")
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: go run client.go [server ip:port] [server ip:port...]")
 		os.Exit(1)
 	}
 
 	// Establish connection with key-value server
 	var err error
-	kvserver, err = rpc.Dial("tcp", os.Args[1])
+	servers = os.Args[1:]
+	kvserver, serverIndex, err = api.ConnectToAny(servers, 0)
 	checkError(err)
 
 	fmt.Printf("Enter commands below.\nSupported commands:\n")
-	fmt.Println("   get(id)                    - returns value for id")
+	fmt.Println("   get(id)                    - returns value and version for id")
 	fmt.Println("   set(id,val)                - sets value for id")
+	fmt.Println("   mget(id1,id2,...)          - returns values for a batch of ids")
+	fmt.Println("   mset(id1,val1,id2,val2...) - sets values for a batch of ids")
+	fmt.Println("   setttl(id,val,seconds)     - sets value for id, expiring after seconds")
 	fmt.Println("   testset(id,testVal,newVal) - if id has testVal as its value, set to newVal")
+	fmt.Println("   cas(id,version,newVal)     - if id's value has the given version, set to newVal")
+	fmt.Println("   delete(id)                 - removes id and its value")
+	fmt.Println("   scan(prefix)               - lists ids beginning with prefix, and their values")
+	fmt.Println("   move(id,newId)             - atomically moves id's value to newId, if newId is unused")
+	fmt.Println("   watch(id)                  - prints changes to id until enter is pressed")
+	fmt.Println("   addshard(name)             - moves keys onto a shard's chain (sharded front-ends only)")
+	fmt.Println("   removeshard(name)          - moves keys off a shard's chain (sharded front-ends only)")
 	fmt.Println("   exit                       - shuts down client")
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		processUserCommand(reader)
 	}
-
-	os.Exit(0)
 }
 
 // Convert next user input to a key-value request,
@@ -62,20 +84,157 @@ func processUserCommand(reader *bufio.Reader) {
 		kvserver.Close()
 		os.Exit(0)
 	}
+	if fullCmd.Command == userinput.WATCH {
+		watchKey(fullCmd.Args[0], reader)
+		return
+	}
 	runUserCommand(fullCmd)
 }
 
 // Send key-value request and print result to console
 func runUserCommand(cmd userinput.LegalCommand) {
 	if cmd.Command == userinput.GET {
-		val, err := api.Get(kvserver, cmd.Args[0])
-		processKVResult("get(%s) -> %s\n", err, cmd.Args[0], val)
+		val, version, err := api.GetVersion(kvserver, cmd.Args[0])
+		processKVResult("get(%s) -> %s (version %d)\n", err, cmd.Args[0], val, version)
 	} else if cmd.Command == userinput.SET {
 		val, err := api.Set(kvserver, cmd.Args[0], cmd.Args[1])
 		processKVResult("set(%s,%s) -> %s\n", err, cmd.Args[0], cmd.Args[1], val)
+	} else if cmd.Command == userinput.MGET {
+		entries, err := api.MultiGet(kvserver, cmd.Args)
+		printEntries("mget", entries, err)
+	} else if cmd.Command == userinput.MSET {
+		entries := []kvstore.KeyValue{}
+		for i := 0; i+1 < len(cmd.Args); i += 2 {
+			entries = append(entries, kvstore.KeyValue{Key: cmd.Args[i], Value: cmd.Args[i+1]})
+		}
+		entries, err := api.MultiSet(kvserver, entries)
+		printEntries("mset", entries, err)
+	} else if cmd.Command == userinput.SETTTL {
+		seconds, err := strconv.Atoi(cmd.Args[2])
+		if err != nil {
+			fmt.Printf("Invalid number of seconds: %s\n", cmd.Args[2])
+			return
+		}
+		val, err := api.SetTTL(kvserver, cmd.Args[0], cmd.Args[1], time.Duration(seconds)*time.Second)
+		processKVResult("setttl(%s,%s,%s) -> %s\n", err, cmd.Args[0], cmd.Args[1], cmd.Args[2], val)
 	} else if cmd.Command == userinput.TESTSET {
 		val, err := api.TestSet(kvserver, cmd.Args[0], cmd.Args[1], cmd.Args[2])
 		processKVResult("testset(%s,%s,%s) -> %s\n", err, cmd.Args[0], cmd.Args[1], cmd.Args[2], val)
+	} else if cmd.Command == userinput.CAS {
+		expectedVersion, err := strconv.ParseUint(cmd.Args[1], 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid version: %s\n", cmd.Args[1])
+			return
+		}
+		version, err := api.CompareAndSwap(kvserver, cmd.Args[0], expectedVersion, cmd.Args[2])
+		if _, isConflict := err.(*kvstore.VersionConflictError); isConflict {
+			fmt.Printf("cas(%s,%s,%s) -> %s\n", cmd.Args[0], cmd.Args[1], cmd.Args[2], err.Error())
+			return
+		}
+		processKVResult("cas(%s,%s,%s) -> version %d\n", err, cmd.Args[0], cmd.Args[1], cmd.Args[2], version)
+	} else if cmd.Command == userinput.DELETE {
+		found, err := api.Delete(kvserver, cmd.Args[0])
+		processKVResult("delete(%s) -> %t\n", err, cmd.Args[0], found)
+	} else if cmd.Command == userinput.MOVE {
+		moveKey(cmd.Args[0], cmd.Args[1])
+	} else if cmd.Command == userinput.ADDSHARD {
+		val, err := api.AddShard(kvserver, cmd.Args[0])
+		processKVResult("addshard(%s) -> %s\n", err, cmd.Args[0], val)
+	} else if cmd.Command == userinput.REMOVESHARD {
+		val, err := api.RemoveShard(kvserver, cmd.Args[0])
+		processKVResult("removeshard(%s) -> %s\n", err, cmd.Args[0], val)
+	} else if cmd.Command == userinput.SCAN {
+		prefix := ""
+		if len(cmd.Args) > 0 {
+			prefix = cmd.Args[0]
+		}
+		scanPrefix(prefix)
+	}
+}
+
+// Print the key-values returned by a batch command
+func printEntries(cmdName string, entries []kvstore.KeyValue, err error) {
+	if err != nil {
+		processKVResult("", err)
+		return
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s: %s -> %s (version %d)\n", cmdName, entry.Key, entry.Value, entry.Version)
+	}
+}
+
+// Atomically move the value of from to to, if from exists and to does not
+func moveKey(from, to string) {
+	val, version, err := api.GetVersion(kvserver, from)
+	if err != nil || version == 0 {
+		processKVResult("move(%s,%s) -> %s does not exist\n", err, from, to, from)
+		return
+	}
+	txn := api.TxnArgs{
+		Compares: []kvstore.Compare{
+			{Kind: kvstore.CompareVersion, Key: from, Version: version},
+			{Kind: kvstore.CompareAbsent, Key: to},
+		},
+		Success: []kvstore.Op{{Kind: kvstore.OpSet, Key: to, Value: val}, {Kind: kvstore.OpDelete, Key: from}},
+	}
+	result, err := api.Txn(kvserver, txn)
+	if result.Succeeded {
+		processKVResult("move(%s,%s) -> %s\n", err, from, to, val)
+	} else {
+		processKVResult("move(%s,%s) -> failed: %s changed or %s exists\n", err, from, to, from, to)
+	}
+}
+
+// Print all key-values beginning with prefix, fetching them a page at a time
+func scanPrefix(prefix string) {
+	entries, cursor, err := api.ScanPrefix(kvserver, prefix, scanPageSize)
+	for {
+		if err != nil {
+			processKVResult("", err)
+			return
+		}
+		for _, entry := range entries {
+			fmt.Printf("   %s -> %s (version %d)\n", entry.Key, entry.Value, entry.Version)
+		}
+		if cursor == "" {
+			fmt.Printf("scan(%s) -> done\n", prefix)
+			return
+		}
+		entries, cursor, err = api.Scan(kvserver, cursor, kvstore.PrefixEnd(prefix), scanPageSize)
+	}
+}
+
+// Print changes to key as they occur, until the user presses enter
+func watchKey(key string, reader *bufio.Reader) {
+	events := make(chan kvstore.Mutation)
+	stop := make(chan bool)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- api.Watch(kvserver, key, false, 0, events, stop)
+	}()
+	enterPressed := make(chan bool)
+	go func() {
+		reader.ReadString('\n')
+		close(enterPressed)
+	}()
+
+	fmt.Printf("Watching %s, press enter to stop...\n", key)
+	for {
+		select {
+		case event := <-events:
+			if event.Deleted {
+				fmt.Printf("watch(%s) -> deleted (version %d)\n", key, event.Seq)
+			} else {
+				fmt.Printf("watch(%s) -> %s (version %d)\n", key, event.Value, event.Seq)
+			}
+		case err := <-watchErr:
+			processKVResult("", err)
+			<-enterPressed
+			return
+		case <-enterPressed:
+			close(stop)
+			return
+		}
 	}
 }
 
@@ -90,14 +249,21 @@ func processKVResult(msgPattern string, err error, a ...interface{}) {
 	}
 }
 
-// Close current rpc connection to server and try to reconnect
+// Close current rpc connection to server and try to reconnect,
+// starting with the next server if several were given
 func reconnectToKVServer() {
 	var err error
 	fmt.Println("Reconnecting to server...")
 	kvserver.Close()
-	kvserver, err = rpc_util.Connect(os.Args[1])
+	for try := 0; try < maxReconnectTries; try++ {
+		kvserver, serverIndex, err = api.ConnectToAny(servers, serverIndex+1)
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
 	checkError(err)
-	fmt.Println("Connection successful.")
+	fmt.Printf("Connected to %s.\n", servers[serverIndex])
 }
 
 // If error is non-nil, print error and shut down
@@ -0,0 +1,147 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// Number of levels below the root of a HashTree, which has 2^HashTreeDepth leaves
+const HashTreeDepth = 10
+
+// Merkle tree over a store's key-values, for finding which keys differ
+// between two replicas without comparing every key
+// Keys are spread across the leaves (buckets) by hash.  Each leaf's hash
+// combines the entries of its keys, including their versions and expiry
+// times, and each node above combines the hashes of its two children, so
+// replicas holding the same key-values have the same hashes at every node.
+// Expired keys are included until their removal is recorded, so the hashes
+// depend only on the mutations applied, not on when they are compared.
+// The tree is kept up to date by passing it every mutation, with Update.
+type HashTree struct {
+	buckets []map[string]uint64 // hashes of the entries of the keys in each leaf
+	seq     uint64              // sequence number of the last mutation included
+	lock    *sync.Mutex
+}
+
+// Returns a tree holding no key-values
+func NewHashTree() *HashTree {
+	tree := &HashTree{lock: &sync.Mutex{}}
+	tree.Reset(nil, 0)
+	return tree
+}
+
+// Replaces the contents of the tree with a snapshot of a store taken at
+// sequence number seq, such as one returned by KVStore.Snapshot
+// Pass subsequent mutations to Update, such as by registering it with
+// KVStore.OnMutation while the store is not being modified.
+func (tree *HashTree) Reset(entries []Mutation, seq uint64) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	tree.buckets = make([]map[string]uint64, 1<<HashTreeDepth)
+	for i := range tree.buckets {
+		tree.buckets[i] = map[string]uint64{}
+	}
+	tree.seq = 0
+	tree.update(entries)
+	tree.seq = seq
+}
+
+// Records mutations made to the store, in sequence order
+func (tree *HashTree) Update(mutations []Mutation) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	tree.update(mutations)
+}
+
+// Returns the hash of every node in the tree, level by level from the root,
+// and the sequence number of the last mutation included
+// Level i holds 2^i hashes, and the children of node j at level i are
+// nodes 2j and 2j+1 at level i+1.
+func (tree *HashTree) Levels() ([][]uint64, uint64) {
+	tree.lock.Lock()
+	leaves := make([]uint64, len(tree.buckets))
+	for i, bucket := range tree.buckets {
+		for _, hash := range bucket {
+			leaves[i] ^= hash
+		}
+	}
+	seq := tree.seq
+	tree.lock.Unlock()
+
+	levels := make([][]uint64, HashTreeDepth+1)
+	levels[HashTreeDepth] = leaves
+	for level := HashTreeDepth - 1; level >= 0; level-- {
+		below := levels[level+1]
+		levels[level] = make([]uint64, len(below)/2)
+		for i := range levels[level] {
+			levels[level][i] = combineHashes(below[2*i], below[2*i+1])
+		}
+	}
+	return levels, seq
+}
+
+// Returns the keys in the given leaves, in sorted order
+func (tree *HashTree) Keys(buckets []int) []string {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	keys := []string{}
+	for _, bucket := range buckets {
+		if bucket >= 0 && bucket < len(tree.buckets) {
+			for key := range tree.buckets[bucket] {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the leaf holding key
+func HashTreeBucket(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % (1 << HashTreeDepth))
+}
+
+// Record mutations in the tree
+// Caller must hold the tree's lock
+func (tree *HashTree) update(mutations []Mutation) {
+	for _, m := range mutations {
+		bucket := tree.buckets[HashTreeBucket(m.Key)]
+		if m.Deleted {
+			delete(bucket, m.Key)
+		} else {
+			bucket[m.Key] = hashEntry(m)
+		}
+		if m.Seq > tree.seq {
+			tree.seq = m.Seq
+		}
+	}
+}
+
+// Hash of a key with its value, version and expiry time
+func hashEntry(m Mutation) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(m.Key))
+	h.Write([]byte{0})
+	h.Write([]byte(m.Value))
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], m.Seq)
+	if !m.ExpiresAt.IsZero() {
+		binary.BigEndian.PutUint64(buf[8:], uint64(m.ExpiresAt.UnixNano()))
+	}
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// Hash of a node with the given children's hashes
+func combineHashes(left uint64, right uint64) uint64 {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], left)
+	binary.BigEndian.PutUint64(buf[8:], right)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
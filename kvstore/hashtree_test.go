@@ -0,0 +1,93 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+)
+
+// Returns a store whose mutations are recorded in the returned tree
+func newTrackedStore() (*KVStore, *HashTree) {
+	store := New()
+	tree := NewHashTree()
+	store.OnMutation(tree.Update)
+	return store, tree
+}
+
+// Returns the leaves whose hashes differ between two trees
+func differingLeaves(a *HashTree, b *HashTree) []int {
+	levelsA, _ := a.Levels()
+	levelsB, _ := b.Levels()
+	differ := []int{}
+	for i := range levelsA[HashTreeDepth] {
+		if levelsA[HashTreeDepth][i] != levelsB[HashTreeDepth][i] {
+			differ = append(differ, i)
+		}
+	}
+	return differ
+}
+
+func TestHashTree_MatchesForSameKeyValues(t *testing.T) {
+	store, tree := newTrackedStore()
+	replica, replicaTree := newTrackedStore()
+	var mutations []Mutation
+	store.OnMutation(func(batch []Mutation) {
+		mutations = append(mutations, batch...)
+	})
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Delete("a")
+	replica.Apply(mutations...)
+
+	levels, seq := tree.Levels()
+	replicaLevels, replicaSeq := replicaTree.Levels()
+	if levels[0][0] != replicaLevels[0][0] || seq != replicaSeq {
+		t.Errorf("Root hashes were %d at %d and %d at %d, expected them to match", levels[0][0], seq, replicaLevels[0][0], replicaSeq)
+	}
+	if len(levels) != HashTreeDepth+1 || len(levels[HashTreeDepth]) != 1<<HashTreeDepth {
+		t.Errorf("Tree had %d levels and %d leaves, expected %d and %d", len(levels), len(levels[len(levels)-1]), HashTreeDepth+1, 1<<HashTreeDepth)
+	}
+}
+
+func TestHashTree_DifferenceIsInKeysLeaf(t *testing.T) {
+	store, tree := newTrackedStore()
+	replica, replicaTree := newTrackedStore()
+	store.Set("a", "1")
+	replica.Set("a", "2")
+
+	differ := differingLeaves(tree, replicaTree)
+	if len(differ) != 1 || differ[0] != HashTreeBucket("a") {
+		t.Errorf("Leaves %v differed, expected only leaf %d", differ, HashTreeBucket("a"))
+	}
+	if keys := tree.Keys(differ); len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("Keys in differing leaves were %v, expected [a]", keys)
+	}
+}
+
+func TestHashTree_ResetMatchesUpdates(t *testing.T) {
+	store, tree := newTrackedStore()
+	store.Set("a", "1")
+	store.SetWithTTL("b", "2", time.Hour)
+	store.Set("c", "3")
+	store.Delete("c")
+
+	restored := NewHashTree()
+	restored.Reset(store.Snapshot())
+	if differ := differingLeaves(tree, restored); len(differ) != 0 {
+		t.Errorf("Leaves %v differed after Reset, expected none", differ)
+	}
+}
+
+func TestHashTree_KeepsExpiredKeysUntilEvicted(t *testing.T) {
+	advance := useFakeClock(t)
+	store, tree := newTrackedStore()
+	empty := NewHashTree()
+	store.SetWithTTL("a", "1", time.Second)
+	advance(2 * time.Second)
+	if differ := differingLeaves(tree, empty); len(differ) != 1 {
+		t.Errorf("Leaves %v differed from an empty tree after expiry, expected one until the key is evicted", differ)
+	}
+	store.Reap()
+	if differ := differingLeaves(tree, empty); len(differ) != 0 {
+		t.Errorf("Leaves %v differed from an empty tree after eviction, expected none", differ)
+	}
+}
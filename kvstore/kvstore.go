@@ -1,78 +1,608 @@
 package kvstore
 
 import (
+	"container/heap"
+	"fmt"
 	"sync"
+	"time"
 )
 
+// Maximum number of expired keys the reaper evicts per lock acquisition
+const reapBatchSize = 100
+
+// Current time, replaceable in tests
+var now = time.Now
+
 // Data structure for values in the key-value store
 type storeValue struct {
-	value string
+	value     string
+	version   uint64    // sequence number of the mutation that set value
+	expiresAt time.Time // zero if the value never expires
+}
+
+// Returns whether the value's time-to-live has elapsed by time at
+func (val *storeValue) expired(at time.Time) bool {
+	return !val.expiresAt.IsZero() && !at.Before(val.expiresAt)
+}
+
+// Error returned by CompareAndSwap when a key's version does not match
+type VersionConflictError struct {
+	Key             string
+	ExpectedVersion uint64
+	ActualVersion   uint64 // 0 if Key is not in the store
+}
+
+func (err *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict on %s: expected version %d, found %d",
+		err.Key, err.ExpectedVersion, err.ActualVersion)
+}
+
+// A single change to the key-value store, numbered by the store's
+// sequence counter so that changes can be logged and replayed in order
+// Seq also becomes the version of Key's new value.
+type Mutation struct {
+	Seq       uint64 // sequence number of the change, starting at 1
+	Key       string
+	Value     string    // new value for Key, unused if Deleted
+	ExpiresAt time.Time // time at which Value expires, or zero if never
+	Deleted   bool      // whether Key was removed from the store
+}
+
+// A key-value returned by a scan
+type KeyValue struct {
+	Key     string
+	Value   string
+	Version uint64
 }
 
 // Main data structure for key-value store
 type KVStore struct {
 	kvstore map[string]*storeValue // maps keys to values
+	index   *skipList              // keys of kvstore in sorted order
 	lock    *sync.RWMutex          // read/write mutex for safe concurrent access
+	seq     uint64                 // sequence number of the last mutation
+	hooks   []func([]Mutation)     // called on every mutation, see OnMutation
+	pending []Mutation             // mutations not yet passed to hooks
+	expiry  *expiryHeap            // keys with a time-to-live, soonest expiry first
+	deleted map[string]uint64      // version at which ApplyNewer removed each missing key
+	clock   func() time.Time       // current time, for deciding which values have expired
 }
 
 func New() *KVStore {
 	var store KVStore
 	// Initialize key-value store
 	store.kvstore = make(map[string]*storeValue)
+	store.index = newSkipList()
 	// Initialize read/write mutex
 	store.lock = &sync.RWMutex{}
+	store.expiry = &expiryHeap{}
+	store.deleted = make(map[string]uint64)
+	store.clock = func() time.Time { return now() }
 	return &store
 }
 
-func (store KVStore) Get(key string) string {
+// Returns an empty store which takes the current time from clock, rather
+// than the local time, when deciding which values have expired
+// Replicas applying the same log of commands at different times can pass a
+// clock which advances with the log, so that each command sees the same
+// keys expired on every replica.
+func NewWithClock(clock func() time.Time) *KVStore {
+	store := New()
+	store.clock = clock
+	return store
+}
+
+// Returns the value for key, or an empty string if key is not in the store
+func (store *KVStore) Get(key string) string {
+	val, _ := store.Lookup(key)
+	return val
+}
+
+// Returns the value for key, and whether key is present in the store
+func (store *KVStore) Lookup(key string) (string, bool) {
+	val, _, found := store.LookupVersion(key)
+	return val, found
+}
+
+// Returns the value and version for key, and whether key is present in the store
+// Versions increase with every change to a key, and are 0 for missing keys.
+func (store *KVStore) LookupVersion(key string) (string, uint64, bool) {
 	// Acquire mutex for read access to kvstore
 	store.lock.RLock()
 	// Defer mutex unlock to function exit
 	defer store.lock.RUnlock()
 
 	// Look up and return store's value
-	storeVal := store.lookup(key)
-	return storeVal.value
+	storeVal, found := store.lookup(key)
+	if !found {
+		return "", 0, false
+	}
+	return storeVal.value, storeVal.version, true
 }
 
-func (store KVStore) Set(key string, value string) string {
+func (store *KVStore) Set(key string, value string) string {
 	// Acquire mutex for exclusive access to kvstore
 	store.lock.Lock()
 	// Defer mutex unlock to function exit
-	defer store.lock.Unlock()
+	defer store.unlock()
 
-	// Initialize entry and set to given value
-	storeVal := store.lookup(key)
-	storeVal.value = value
+	// Record and apply the new value
+	store.mutate(Mutation{Key: key, Value: value})
 	return value
 }
 
-func (store KVStore) TestSet(key string, testVal string, setVal string) string {
+// Returns the value and version of each key, in the same order as keys
+// Missing keys are returned with an empty value and version 0.
+func (store *KVStore) MultiGet(keys []string) []KeyValue {
+	// Acquire mutex for read access to kvstore
+	store.lock.RLock()
+	// Defer mutex unlock to function exit
+	defer store.lock.RUnlock()
+
+	entries := make([]KeyValue, len(keys))
+	for i, key := range keys {
+		entries[i].Key = key
+		if storeVal, found := store.lookup(key); found {
+			entries[i].Value = storeVal.value
+			entries[i].Version = storeVal.version
+		}
+	}
+	return entries
+}
+
+// Atomically sets each entry's key to its value, ignoring entry versions
+// Returns the entries with their new versions.
+func (store *KVStore) MultiSet(entries []KeyValue) []KeyValue {
 	// Acquire mutex for exclusive access to kvstore
 	store.lock.Lock()
 	// Defer mutex unlock to function exit
-	defer store.lock.Unlock()
+	defer store.unlock()
+
+	// Record and apply the new values
+	results := make([]KeyValue, len(entries))
+	for i, entry := range entries {
+		store.mutate(Mutation{Key: entry.Key, Value: entry.Value})
+		results[i] = KeyValue{entry.Key, entry.Value, store.seq}
+	}
+	return results
+}
+
+// Sets key to value, removing key from the store once ttl has elapsed
+func (store *KVStore) SetWithTTL(key string, value string, ttl time.Duration) string {
+	return store.SetUntil(key, value, store.clock().Add(ttl))
+}
 
-	// Initialize and check value for key
-	storeVal := store.lookup(key)
+// Sets key to value, removing key from the store at expiresAt
+// Replicas which apply the same write at different times should use this
+// rather than SetWithTTL, so that they agree on when the key expires.
+func (store *KVStore) SetUntil(key string, value string, expiresAt time.Time) string {
+	// Acquire mutex for exclusive access to kvstore
+	store.lock.Lock()
+	// Defer mutex unlock to function exit
+	defer store.unlock()
+
+	// Record and apply the new value
+	store.mutate(Mutation{Key: key, Value: value, ExpiresAt: expiresAt})
+	return value
+}
+
+// Sets key to setVal if its current value is testVal, where a missing key
+// is treated as having an empty string value.  Returns the resulting value.
+func (store *KVStore) TestSet(key string, testVal string, setVal string) string {
+	// Acquire mutex for exclusive access to kvstore
+	store.lock.Lock()
+	// Defer mutex unlock to function exit
+	defer store.unlock()
+
+	// Check value for key, evicting it if expired
+	store.evictIfExpired(key)
+	curVal := ""
+	if storeVal, found := store.lookup(key); found {
+		curVal = storeVal.value
+	}
 
 	// Execute the test-set
-	if storeVal.value == testVal {
-		storeVal.value = setVal
+	if curVal == testVal {
+		store.mutate(Mutation{Key: key, Value: setVal})
+		return setVal
+	}
+	return curVal
+}
+
+// Sets key to newVal if its current version is expectedVersion, where
+// version 0 requires key to be absent.  Returns the new version, or a
+// *VersionConflictError if key's version differs from expectedVersion.
+func (store *KVStore) CompareAndSwap(key string, expectedVersion uint64, newVal string) (uint64, error) {
+	// Acquire mutex for exclusive access to kvstore
+	store.lock.Lock()
+	// Defer mutex unlock to function exit
+	defer store.unlock()
+
+	// Check version for key, evicting it if expired
+	store.evictIfExpired(key)
+	curVersion := uint64(0)
+	if storeVal, found := store.lookup(key); found {
+		curVersion = storeVal.version
 	}
-	return storeVal.value
+	if curVersion != expectedVersion {
+		return curVersion, &VersionConflictError{key, expectedVersion, curVersion}
+	}
+
+	// Execute the swap
+	store.mutate(Mutation{Key: key, Value: newVal})
+	return store.seq, nil
+}
+
+// Returns up to limit key-values with keys in [startKey, endKey), in key order,
+// and the key to resume from to fetch the next page, or "" if there are no more.
+// An empty endKey scans to the last key, and a limit <= 0 returns all keys.
+func (store *KVStore) Scan(startKey string, endKey string, limit int) ([]KeyValue, string) {
+	// Acquire mutex for read access to kvstore
+	store.lock.RLock()
+	// Defer mutex unlock to function exit
+	defer store.lock.RUnlock()
+
+	entries := []KeyValue{}
+	for node := store.index.seek(startKey); node != nil; node = node.next[0] {
+		if endKey != "" && node.key >= endKey {
+			break
+		}
+		storeVal, found := store.lookup(node.key)
+		if !found {
+			continue // expired, but not yet evicted
+		}
+		if limit > 0 && len(entries) == limit {
+			return entries, node.key
+		}
+		entries = append(entries, KeyValue{node.key, storeVal.value, storeVal.version})
+	}
+	return entries, ""
+}
+
+// Returns up to limit key-values with keys beginning with prefix, in key order,
+// and the key to resume from to fetch the next page, or "" if there are no more.
+// Resume with Scan(nextKey, PrefixEnd(prefix), limit).
+func (store *KVStore) ScanPrefix(prefix string, limit int) ([]KeyValue, string) {
+	return store.Scan(prefix, PrefixEnd(prefix), limit)
+}
+
+// Returns the smallest key greater than every key beginning with prefix,
+// or "" if there is none, for use as the end key of a Scan
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Removes key from the store
+// Returns whether key was present before the delete
+func (store *KVStore) Delete(key string) bool {
+	// Acquire mutex for exclusive access to kvstore
+	store.lock.Lock()
+	// Defer mutex unlock to function exit
+	defer store.unlock()
+
+	store.evictIfExpired(key)
+	_, found := store.lookup(key)
+	if found {
+		store.mutate(Mutation{Key: key, Deleted: true})
+	}
+	return found
+}
+
+// Starts a goroutine which evicts expired keys every interval, as Reap does
+// Returns a function which stops the goroutine.
+func (store *KVStore) StartReaper(interval time.Duration) func() {
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				store.Reap()
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// Registers a hook to be called with every subsequent mutation, in sequence
+// order, before the mutation becomes visible to readers.  Mutations made
+// atomically, such as by a Txn, are passed to the hook in a single batch.
+// Hooks run while the store's lock is held and must not call back into the store.
+// Returns the sequence number of the last mutation before hook was registered.
+func (store *KVStore) OnMutation(hook func([]Mutation)) uint64 {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.hooks = append(store.hooks, hook)
+	return store.seq
+}
+
+// Atomically applies mutations that were recorded by another store, such as
+// ones replayed from a log, keeping their sequence numbers
+func (store *KVStore) Apply(mutations ...Mutation) {
+	store.lock.Lock()
+	defer store.unlock()
+	for _, m := range mutations {
+		store.apply(m)
+	}
+}
+
+// Atomically applies mutations recorded by another store, as Apply does,
+// only if the last mutation applied to this store has sequence number seq
+// Returns whether the mutations were applied.
+func (store *KVStore) ApplyAt(seq uint64, mutations ...Mutation) bool {
+	store.lock.Lock()
+	defer store.unlock()
+	if store.seq != seq {
+		return false
+	}
+	for _, m := range mutations {
+		store.apply(m)
+	}
+	return true
+}
+
+// Applies mutations whose sequence numbers are versions chosen by a quorum
+// coordinator rather than by this store, keeping the latest version of each key
+// A mutation is skipped if its key already has the same or a later version,
+// including a removal, whose version is remembered so that an older write
+// arriving late cannot bring the key back.
+// Returns the number of mutations applied.
+func (store *KVStore) ApplyNewer(mutations ...Mutation) int {
+	store.lock.Lock()
+	defer store.unlock()
+	applied := 0
+	for _, m := range mutations {
+		if m.Seq <= store.latestVersion(m.Key) {
+			continue
+		}
+		if m.Deleted {
+			store.deleted[m.Key] = m.Seq
+		} else {
+			delete(store.deleted, m.Key)
+		}
+		store.apply(m)
+		applied++
+	}
+	return applied
+}
+
+// Removes each mutation's key if its value still has the mutation's version as
+// Seq, without remembering the removal as ApplyNewer does, so that a copy held
+// on behalf of another node can be dropped without hiding the key's value if
+// this node later holds it for itself
+// Returns the number of keys removed.
+func (store *KVStore) DiscardVersions(mutations ...Mutation) int {
+	store.lock.Lock()
+	defer store.unlock()
+	discarded := 0
+	for _, m := range mutations {
+		if storeVal, found := store.kvstore[m.Key]; found && storeVal.version == m.Seq {
+			store.apply(Mutation{Seq: m.Seq, Key: m.Key, Deleted: true})
+			discarded++
+		}
+	}
+	return discarded
+}
+
+// Returns the latest change to key as a mutation, for comparing with other
+// replicas: its current value, or if it is missing, a removal with the
+// version at which ApplyNewer removed it, which is 0 if it never did
+func (store *KVStore) Latest(key string) Mutation {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	if storeVal, found := store.kvstore[key]; found {
+		if storeVal.expired(store.clock()) {
+			return Mutation{Seq: storeVal.version, Key: key, Deleted: true}
+		}
+		return Mutation{Seq: storeVal.version, Key: key, Value: storeVal.value, ExpiresAt: storeVal.expiresAt}
+	}
+	return Mutation{Seq: store.deleted[key], Key: key, Deleted: true}
+}
+
+// Returns the earliest time at which a value expires, and whether any value
+// has a time-to-live
+// Values overwritten since they were set with a time-to-live may be counted.
+func (store *KVStore) NextExpiry() (time.Time, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	if store.expiry.Len() == 0 {
+		return time.Time{}, false
+	}
+	return (*store.expiry)[0].expiresAt, true
+}
+
+// Returns the sequence number of the last mutation applied to the store
+func (store *KVStore) Seq() uint64 {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.seq
+}
+
+// Returns every key-value in the store as a list of mutations, along with
+// the sequence number of the last mutation they include
+// Each entry's Seq is the version of its value.  Expired values are included
+// until they are evicted, since their removal is a later mutation.
+func (store *KVStore) Snapshot() ([]Mutation, uint64) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	entries := make([]Mutation, 0, len(store.kvstore))
+	for key, storeVal := range store.kvstore {
+		entries = append(entries, Mutation{Seq: storeVal.version, Key: key, Value: storeVal.value, ExpiresAt: storeVal.expiresAt})
+	}
+	return entries, store.seq
+}
+
+// Replaces the contents of the store with a snapshot taken at sequence number seq
+func (store *KVStore) Restore(entries []Mutation, seq uint64) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.kvstore = make(map[string]*storeValue)
+	store.index = newSkipList()
+	store.expiry = &expiryHeap{}
+	store.deleted = make(map[string]uint64)
+	for _, entry := range entries {
+		store.setValue(entry)
+	}
+	store.seq = seq
+}
+
+// Assign the next sequence number to a local mutation and apply it
+// Caller must hold the store's exclusive lock
+func (store *KVStore) mutate(m Mutation) {
+	m.Seq = store.seq + 1
+	store.apply(m)
+}
+
+// Apply a mutation to kvstore, queueing it for the hooks
+// Caller must hold the store's exclusive lock
+func (store *KVStore) apply(m Mutation) {
+	store.pending = append(store.pending, m)
+	if m.Deleted {
+		store.remove(m.Key)
+	} else {
+		store.setValue(m)
+	}
+	if m.Seq > store.seq {
+		store.seq = m.Seq
+	}
+}
+
+// Notify hooks of the mutations made while holding the exclusive lock,
+// then release the lock so that readers can see them
+func (store *KVStore) unlock() {
+	if len(store.pending) > 0 {
+		for _, hook := range store.hooks {
+			hook(store.pending)
+		}
+		store.pending = nil
+	}
+	store.lock.Unlock()
+}
+
+// Set the value, version and expiry time for m.Key
+// Caller must hold the store's exclusive lock
+func (store *KVStore) setValue(m Mutation) {
+	storeVal := store.lookupOrCreate(m.Key)
+	storeVal.value = m.Value
+	storeVal.version = m.Seq
+	storeVal.expiresAt = m.ExpiresAt
+	if !m.ExpiresAt.IsZero() {
+		heap.Push(store.expiry, expiryEntry{m.Key, m.ExpiresAt})
+	}
+}
+
+// Remove key if its value has expired, recording the removal as a mutation
+// so that hooks, such as watchers and replicas, see the key expire
+// Caller must hold the store's exclusive lock
+func (store *KVStore) evictIfExpired(key string) {
+	if storeVal, found := store.kvstore[key]; found && storeVal.expired(store.clock()) {
+		store.mutate(Mutation{Key: key, Deleted: true})
+	}
+}
+
+// Evict expired keys, recording the removal of each as a mutation, and
+// releasing the lock after each batch so that a large number of expiries
+// does not stall other requests
+// Stores replicating another store's mutations should not evict keys
+// themselves, but apply the removals recorded by the other store.
+func (store *KVStore) Reap() {
+	for {
+		store.lock.Lock()
+		evicted, current := 0, store.clock()
+		for store.expiry.Len() > 0 && evicted < reapBatchSize {
+			next := (*store.expiry)[0]
+			if current.Before(next.expiresAt) {
+				break
+			}
+			heap.Pop(store.expiry)
+			// Skip entries for keys that have since been overwritten or deleted
+			if storeVal, found := store.kvstore[next.key]; found && storeVal.expiresAt.Equal(next.expiresAt) {
+				store.mutate(Mutation{Key: next.key, Deleted: true})
+			}
+			evicted++
+		}
+		store.unlock()
+		if evicted < reapBatchSize {
+			return
+		}
+	}
+}
+
+// Returns the version of key's value, including an expired value, or the
+// version at which ApplyNewer removed it, or 0 if it has neither
+// Caller must hold the store's lock
+func (store *KVStore) latestVersion(key string) uint64 {
+	if storeVal, found := store.kvstore[key]; found {
+		return storeVal.version
+	}
+	return store.deleted[key]
+}
+
+// Return the value associated with the given key, and whether it exists
+// Expired values are treated as absent
+func (store *KVStore) lookup(key string) (*storeValue, bool) {
+	val, found := store.kvstore[key]
+	if found && val.expired(store.clock()) {
+		return nil, false
+	}
+	return val, found
 }
 
 // Return the value associated with the given key
 // Initializes its value to an empty string if this is the first access
-func (store KVStore) lookup(key string) *storeValue {
-	val := store.kvstore[key]
-	if val == nil {
+func (store *KVStore) lookupOrCreate(key string) *storeValue {
+	val, found := store.kvstore[key]
+	if !found {
 		// key used for the first time: create and initialize a storeValue
 		val = &storeValue{
 			value: "",
 		}
 		store.kvstore[key] = val
+		store.index.insert(key)
 	}
 	return val
 }
+
+// Remove key and its value from kvstore and the index
+// Caller must hold the store's exclusive lock
+func (store *KVStore) remove(key string) {
+	delete(store.kvstore, key)
+	store.index.remove(key)
+}
+
+// Key and expiry time of a value with a time-to-live
+type expiryEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// Min-heap of expiry entries ordered by expiry time, for use with container/heap
+// May contain stale entries for keys that were since overwritten or deleted.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiryEntry))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
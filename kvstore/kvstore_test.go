@@ -1,9 +1,20 @@
 package kvstore
 
 import (
+	"fmt"
 	"testing"
+	"time"
 )
 
+// Replace the store's clock with one controlled by the test
+// Returns a function which advances the clock.
+func useFakeClock(t *testing.T) func(time.Duration) {
+	fakeNow := time.Unix(1000, 0)
+	now = func() time.Time { return fakeNow }
+	t.Cleanup(func() { now = time.Now })
+	return func(d time.Duration) { fakeNow = fakeNow.Add(d) }
+}
+
 func TestGet_UninitializedKey(t *testing.T) {
 	store := New()
 	valForUnusedKey := store.Get("unusedKey")
@@ -72,3 +83,374 @@ func TestTest_AfterSet(t *testing.T) {
 		t.Errorf("TestSet(%s, %s, %s) returned %s, expected %s", key, origVal, testSetVal, val, testSetVal)
 	}
 }
+
+func TestGet_DoesNotCreateKey(t *testing.T) {
+	store := New()
+	store.Get("unusedKey")
+	store.TestSet("unusedKey", "someVal", "newVal")
+	if len(store.kvstore) != 0 {
+		t.Errorf("Get/TestSet on a missing key grew the store to %d entries, expected 0", len(store.kvstore))
+	}
+}
+
+func TestLookup(t *testing.T) {
+	store := New()
+	key := "id_123"
+	if val, found := store.Lookup(key); found {
+		t.Errorf("Lookup(%s) returned (%s, true), expected (\"\", false)", key, val)
+	}
+	store.Set(key, "")
+	if val, found := store.Lookup(key); !found || val != "" {
+		t.Errorf("Lookup(%s) returned (%s, %t), expected (\"\", true)", key, val, found)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	store := New()
+	key := "id_123"
+	if store.Delete(key) {
+		t.Errorf("Delete(%s) on a missing key returned true, expected false", key)
+	}
+	store.Set(key, "abc")
+	if !store.Delete(key) {
+		t.Errorf("Delete(%s) on an existing key returned false, expected true", key)
+	}
+	if val, found := store.Lookup(key); found {
+		t.Errorf("Lookup(%s) after Delete returned (%s, true), expected (\"\", false)", key, val)
+	}
+}
+
+func TestOnMutation_SequencesChanges(t *testing.T) {
+	store := New()
+	var mutations []Mutation
+	store.OnMutation(func(batch []Mutation) {
+		mutations = append(mutations, batch...)
+	})
+	store.Set("a", "1")
+	store.TestSet("a", "wrongVal", "2") // no change, not recorded
+	store.TestSet("a", "1", "2")
+	store.Delete("missing") // no change, not recorded
+	store.Delete("a")
+
+	expected := []Mutation{
+		{Seq: 1, Key: "a", Value: "1"},
+		{Seq: 2, Key: "a", Value: "2"},
+		{Seq: 3, Key: "a", Deleted: true},
+	}
+	if len(mutations) != len(expected) {
+		t.Fatalf("Recorded mutations %v, expected %v", mutations, expected)
+	}
+	for i := range expected {
+		if mutations[i] != expected[i] {
+			t.Errorf("Mutation %d was %v, expected %v", i, mutations[i], expected[i])
+		}
+	}
+}
+
+func TestSnapshot_Restore(t *testing.T) {
+	store := New()
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Delete("b")
+	entries, seq := store.Snapshot()
+
+	restored := New()
+	restored.Restore(entries, seq)
+	restored.Apply(Mutation{Seq: seq + 1, Key: "c", Value: "3"})
+	if val := restored.Get("a"); val != "1" {
+		t.Errorf("Get(a) after Restore returned %s, expected 1", val)
+	}
+	if _, found := restored.Lookup("b"); found {
+		t.Errorf("Lookup(b) after Restore found a deleted key")
+	}
+	if _, seq = restored.Snapshot(); seq != 4 {
+		t.Errorf("Sequence number after Restore and Apply was %d, expected 4", seq)
+	}
+}
+
+func TestApply_ReproducesVersions(t *testing.T) {
+	head := New()
+	var mutations []Mutation
+	head.OnMutation(func(batch []Mutation) {
+		mutations = append(mutations, batch...)
+	})
+	head.Set("a", "1")
+	head.Set("b", "2")
+	head.TestSet("a", "1", "3")
+
+	replica := New()
+	replica.Apply(mutations...)
+	for _, key := range []string{"a", "b"} {
+		headVal, headVersion, _ := head.LookupVersion(key)
+		val, version, _ := replica.LookupVersion(key)
+		if val != headVal || version != headVersion {
+			t.Errorf("Replica held %s at version %d for %s, expected %s at version %d", val, version, key, headVal, headVersion)
+		}
+	}
+	if replica.Seq() != head.Seq() {
+		t.Errorf("Replica sequence number was %d, expected %d", replica.Seq(), head.Seq())
+	}
+}
+
+func TestApplyAt_RequiresSequenceNumber(t *testing.T) {
+	store := New()
+	store.Set("a", "1")
+	if store.ApplyAt(0, Mutation{Seq: 1, Key: "a", Value: "2"}) {
+		t.Errorf("ApplyAt with an old sequence number succeeded, expected it to be refused")
+	}
+	if !store.ApplyAt(1, Mutation{Seq: 1, Key: "a", Value: "2"}) {
+		t.Errorf("ApplyAt with the current sequence number was refused")
+	}
+	if val, version, _ := store.LookupVersion("a"); val != "2" || version != 1 {
+		t.Errorf("LookupVersion(a) after ApplyAt returned %s at version %d, expected 2 at version 1", val, version)
+	}
+}
+
+func TestApplyNewer_KeepsLatestVersion(t *testing.T) {
+	store := New()
+	if applied := store.ApplyNewer(Mutation{Seq: 20, Key: "a", Value: "new"}, Mutation{Seq: 10, Key: "a", Value: "old"}); applied != 1 {
+		t.Errorf("ApplyNewer applied %d mutations, expected 1", applied)
+	}
+	if latest := store.Latest("a"); latest.Value != "new" || latest.Seq != 20 {
+		t.Errorf("Latest(a) returned %s at version %d, expected new at version 20", latest.Value, latest.Seq)
+	}
+}
+
+func TestApplyNewer_RemembersRemovals(t *testing.T) {
+	store := New()
+	store.ApplyNewer(Mutation{Seq: 10, Key: "a", Value: "1"}, Mutation{Seq: 30, Key: "a", Deleted: true})
+	store.ApplyNewer(Mutation{Seq: 20, Key: "a", Value: "2"})
+	if _, found := store.Lookup("a"); found {
+		t.Errorf("Write older than a removal brought the key back")
+	}
+	if latest := store.Latest("a"); !latest.Deleted || latest.Seq != 30 {
+		t.Errorf("Latest(a) returned %v, expected a removal at version 30", latest)
+	}
+	store.ApplyNewer(Mutation{Seq: 40, Key: "a", Value: "4"})
+	if val, _ := store.Lookup("a"); val != "4" {
+		t.Errorf("Lookup(a) after a write newer than the removal returned %s, expected 4", val)
+	}
+	if latest := store.Latest("b"); !latest.Deleted || latest.Seq != 0 {
+		t.Errorf("Latest(b) for a key never written returned %v, expected a removal at version 0", latest)
+	}
+}
+
+func TestSetWithTTL_ExpiresLazily(t *testing.T) {
+	advance := useFakeClock(t)
+	store := New()
+	key := "session_1"
+	store.SetWithTTL(key, "abc", 10*time.Second)
+	advance(9 * time.Second)
+	if val := store.Get(key); val != "abc" {
+		t.Errorf("Get(%s) before expiry returned %s, expected abc", key, val)
+	}
+	advance(time.Second)
+	if val, found := store.Lookup(key); found {
+		t.Errorf("Lookup(%s) after expiry returned (%s, true), expected (\"\", false)", key, val)
+	}
+	if val := store.TestSet(key, "abc", "def"); val != "" {
+		t.Errorf("TestSet(%s, abc, def) after expiry returned %s, expected empty string", key, val)
+	}
+	if len(store.kvstore) != 0 {
+		t.Errorf("TestSet after expiry left %d entries in the store, expected 0", len(store.kvstore))
+	}
+}
+
+func TestSetUntil_ExpiresAtGivenTime(t *testing.T) {
+	advance := useFakeClock(t)
+	store := New()
+	key := "session_1"
+	store.SetUntil(key, "abc", now().Add(time.Minute))
+	advance(30 * time.Second)
+	if val := store.Get(key); val != "abc" {
+		t.Errorf("Get(%s) before expiry returned %s, expected abc", key, val)
+	}
+	store.SetUntil(key, "def", now().Add(-time.Second))
+	if val, found := store.Lookup(key); found {
+		t.Errorf("Lookup(%s) after setting an expiry in the past returned (%s, true), expected (\"\", false)", key, val)
+	}
+}
+
+func TestNewWithClock_ExpiresByGivenClock(t *testing.T) {
+	useFakeClock(t)
+	clock := time.Unix(5000, 0)
+	store := NewWithClock(func() time.Time { return clock })
+	store.SetUntil("a", "1", clock.Add(time.Second))
+	if next, expiring := store.NextExpiry(); !expiring || !next.Equal(clock.Add(time.Second)) {
+		t.Errorf("NextExpiry() returned (%s, %t), expected (%s, true)", next, expiring, clock.Add(time.Second))
+	}
+	if val := store.Get("a"); val != "1" {
+		t.Errorf("Get(a) before the given clock passed its expiry returned %s, expected 1", val)
+	}
+	clock = clock.Add(time.Second)
+	if val, found := store.Lookup("a"); found {
+		t.Errorf("Lookup(a) after the given clock passed its expiry returned (%s, true), expected (\"\", false)", val)
+	}
+	store.Reap()
+	if _, expiring := store.NextExpiry(); expiring {
+		t.Errorf("NextExpiry() after Reap() reported a value expiring, expected none")
+	}
+}
+
+func TestSet_ClearsTTL(t *testing.T) {
+	advance := useFakeClock(t)
+	store := New()
+	key := "session_1"
+	store.SetWithTTL(key, "abc", time.Second)
+	store.Set(key, "def")
+	advance(time.Minute)
+	store.Reap()
+	if val := store.Get(key); val != "def" {
+		t.Errorf("Get(%s) after overwriting a TTL value returned %s, expected def", key, val)
+	}
+}
+
+func TestReap_EvictsExpiredKeys(t *testing.T) {
+	advance := useFakeClock(t)
+	store := New()
+	for i := 0; i < 3*reapBatchSize; i++ {
+		store.SetWithTTL(fmt.Sprintf("key_%d", i), "abc", time.Duration(i)*time.Millisecond+time.Second)
+	}
+	store.SetWithTTL("long_lived", "abc", time.Hour)
+	advance(time.Minute)
+	store.Reap()
+	if len(store.kvstore) != 1 {
+		t.Errorf("Reap() left %d entries in the store, expected 1", len(store.kvstore))
+	}
+	if store.expiry.Len() != 1 {
+		t.Errorf("Reap() left %d entries in the expiry heap, expected 1", store.expiry.Len())
+	}
+}
+
+func TestLookupVersion_IncreasesOnChange(t *testing.T) {
+	store := New()
+	key := "counter"
+	if _, version, _ := store.LookupVersion(key); version != 0 {
+		t.Errorf("LookupVersion(%s) on a missing key returned version %d, expected 0", key, version)
+	}
+	store.Set(key, "1")
+	_, v1, _ := store.LookupVersion(key)
+	store.Set("otherKey", "abc")
+	store.Set(key, "1")
+	_, v2, _ := store.LookupVersion(key)
+	if v1 == 0 || v2 <= v1 {
+		t.Errorf("LookupVersion(%s) returned versions %d then %d, expected them to increase", key, v1, v2)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	store := New()
+	key := "counter"
+	v1, err := store.CompareAndSwap(key, 0, "1")
+	if err != nil {
+		t.Fatalf("CompareAndSwap(%s, 0, 1) on a missing key returned unexpected error: %s", key, err.Error())
+	}
+	if _, err = store.CompareAndSwap(key, 0, "2"); err == nil {
+		t.Errorf("CompareAndSwap(%s, 0, 2) on an existing key succeeded, expected a conflict", key)
+	}
+
+	// Setting the same value again must still change the version
+	store.Set(key, "1")
+	_, err = store.CompareAndSwap(key, v1, "2")
+	conflict, ok := err.(*VersionConflictError)
+	if !ok {
+		t.Fatalf("CompareAndSwap(%s, %d, 2) after a Set returned %v, expected a *VersionConflictError", key, v1, err)
+	}
+	if conflict.ExpectedVersion != v1 || conflict.ActualVersion <= v1 {
+		t.Errorf("CompareAndSwap conflict reported versions %d/%d, expected %d/greater", conflict.ExpectedVersion, conflict.ActualVersion, v1)
+	}
+
+	v3, err := store.CompareAndSwap(key, conflict.ActualVersion, "3")
+	if err != nil {
+		t.Errorf("CompareAndSwap(%s, %d, 3) returned unexpected error: %s", key, conflict.ActualVersion, err.Error())
+	}
+	if val, version, _ := store.LookupVersion(key); val != "3" || version != v3 {
+		t.Errorf("LookupVersion(%s) returned (%s, %d), expected (3, %d)", key, val, version, v3)
+	}
+}
+
+// Returns the keys of a list of scanned key-values
+func scannedKeys(entries []KeyValue) []string {
+	keys := []string{}
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+func TestScan_Paginates(t *testing.T) {
+	store := New()
+	for _, key := range []string{"d", "a", "e", "c", "b"} {
+		store.Set(key, "val_"+key)
+	}
+	store.Delete("c")
+
+	entries, nextKey := store.Scan("b", "", 2)
+	if fmt.Sprint(scannedKeys(entries)) != "[b d]" || nextKey != "e" {
+		t.Errorf("Scan(b, \"\", 2) returned (%v, %s), expected ([b d], e)", scannedKeys(entries), nextKey)
+	}
+	if entries[0].Value != "val_b" || entries[0].Version == 0 {
+		t.Errorf("Scan returned entry %v, expected value val_b with a non-zero version", entries[0])
+	}
+	entries, nextKey = store.Scan(nextKey, "", 2)
+	if fmt.Sprint(scannedKeys(entries)) != "[e]" || nextKey != "" {
+		t.Errorf("Scan(e, \"\", 2) returned (%v, %s), expected ([e], \"\")", scannedKeys(entries), nextKey)
+	}
+	entries, _ = store.Scan("a", "d", 0)
+	if fmt.Sprint(scannedKeys(entries)) != "[a b]" {
+		t.Errorf("Scan(a, d, 0) returned %v, expected [a b]", scannedKeys(entries))
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	advance := useFakeClock(t)
+	store := New()
+	for _, key := range []string{"user_1", "user_2", "users", "user", "usea", "vendor_1"} {
+		store.Set(key, "abc")
+	}
+	store.SetWithTTL("user_3", "abc", time.Second)
+	advance(time.Minute)
+
+	entries, nextKey := store.ScanPrefix("user_", 0)
+	if fmt.Sprint(scannedKeys(entries)) != "[user_1 user_2]" || nextKey != "" {
+		t.Errorf("ScanPrefix(user_, 0) returned (%v, %s), expected ([user_1 user_2], \"\")", scannedKeys(entries), nextKey)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	testCases := []struct {
+		prefix string
+		end    string
+	}{
+		{"", ""},
+		{"abc", "abd"},
+		{"ab\xff", "ac"},
+		{"\xff\xff", ""},
+	}
+	for _, test := range testCases {
+		if end := PrefixEnd(test.prefix); end != test.end {
+			t.Errorf("PrefixEnd(%q) returned %q, expected %q", test.prefix, end, test.end)
+		}
+	}
+}
+
+func TestMultiSet_MultiGet(t *testing.T) {
+	store := New()
+	batches := 0
+	store.OnMutation(func(batch []Mutation) {
+		batches++
+	})
+	results := store.MultiSet([]KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "a", Value: "3"}})
+	if batches != 1 {
+		t.Errorf("MultiSet notified hooks %d times, expected once", batches)
+	}
+	if len(results) != 3 || results[2].Version <= results[0].Version {
+		t.Errorf("MultiSet returned %v, expected 3 entries with increasing versions", results)
+	}
+
+	entries := store.MultiGet([]string{"a", "missing", "b"})
+	expected := []KeyValue{{"a", "3", results[2].Version}, {"missing", "", 0}, {"b", "2", results[1].Version}}
+	if fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Errorf("MultiGet(a, missing, b) returned %v, expected %v", entries, expected)
+	}
+}
@@ -0,0 +1,333 @@
+// Package persist makes a kvstore.KVStore durable across restarts.
+//
+// Every batch of mutations is appended to a write-ahead log as a single
+// record before it becomes visible, and the store is periodically written
+// to a snapshot so that the log can be truncated.  On startup the latest
+// snapshot is loaded and the log replayed.
+package persist
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/msayson/kvservice/kvstore"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const logFileName = "wal.log"
+const snapshotFileName = "snapshot.json"
+
+// Configuration for a persistence layer
+type Options struct {
+	DataDir          string        // directory holding the log and snapshot files
+	Fsync            bool          // if true, fsync the log after every batch of mutations
+	SnapshotInterval time.Duration // time between snapshots, or 0 to disable them
+}
+
+// On-disk format of a snapshot
+type snapshot struct {
+	Seq     uint64 // sequence number of the last mutation included
+	Entries []kvstore.Mutation
+}
+
+// Write-ahead log and snapshots for a single key-value store
+type Log struct {
+	store        *kvstore.KVStore
+	opts         Options
+	file         *os.File    // log file, opened for appending
+	lock         *sync.Mutex // serializes writes to file
+	snapshotLock *sync.Mutex // serializes snapshots, which rewrite the log
+	stop         chan bool   // closed to stop the snapshot goroutine
+	stopped      *sync.WaitGroup
+}
+
+// Restores store from the files in opts.DataDir, then logs all of its
+// subsequent mutations there.  store should be empty and not yet in use.
+func Open(store *kvstore.KVStore, opts Options) (*Log, error) {
+	if opts.DataDir == "" {
+		return nil, errors.New("persist.Open: expected a data directory, received empty string")
+	}
+	if err := os.MkdirAll(opts.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := restore(store, opts.DataDir); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(opts.DataDir, logFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	wal := &Log{
+		store:        store,
+		opts:         opts,
+		file:         file,
+		lock:         &sync.Mutex{},
+		snapshotLock: &sync.Mutex{},
+		stop:         make(chan bool),
+		stopped:      &sync.WaitGroup{},
+	}
+	store.OnMutation(wal.append)
+	if opts.SnapshotInterval > 0 {
+		wal.stopped.Add(1)
+		go wal.snapshotPeriodically()
+	}
+	return wal, nil
+}
+
+// Writes the store's current contents to a snapshot and truncates the log
+func (wal *Log) Snapshot() error {
+	wal.snapshotLock.Lock()
+	defer wal.snapshotLock.Unlock()
+	entries, seq := wal.store.Snapshot()
+	err := WriteFileAtomic(filepath.Join(wal.opts.DataDir, snapshotFileName), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(snapshot{seq, entries})
+	})
+	if err != nil {
+		return err
+	}
+	return wal.truncate(seq)
+}
+
+// Stops taking snapshots and closes the log file
+// The store must not be mutated after Close is called.
+func (wal *Log) Close() error {
+	close(wal.stop)
+	wal.stopped.Wait()
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	return wal.file.Close()
+}
+
+// Mutation hook: append a batch of mutations to the log as one record,
+// syncing it to disk if configured
+// A store that cannot log its writes must not acknowledge them, so
+// failures here are unrecoverable.
+func (wal *Log) append(batch []kvstore.Mutation) {
+	record, err := json.Marshal(batch)
+	if err != nil {
+		log.Fatal("Error encoding write-ahead log record:", err)
+	}
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if _, err = wal.file.Write(append(record, '\n')); err != nil {
+		log.Fatal("Error writing to write-ahead log:", err)
+	}
+	if wal.opts.Fsync {
+		if err = wal.file.Sync(); err != nil {
+			log.Fatal("Error syncing write-ahead log:", err)
+		}
+	}
+}
+
+// Take a snapshot every SnapshotInterval until Close is called
+func (wal *Log) snapshotPeriodically() {
+	defer wal.stopped.Done()
+	ticker := time.NewTicker(wal.opts.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wal.stop:
+			return
+		case <-ticker.C:
+			if err := wal.Snapshot(); err != nil {
+				fmt.Printf("Error taking snapshot: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// Rewrite the log without the records included in a snapshot up to seq
+// The records logged so far are rewritten to a new file while writes carry on
+// being appended to the log, and the lock is only held to copy the records
+// appended meanwhile and swap in the new file.
+// Caller must hold snapshotLock
+func (wal *Log) truncate(seq uint64) error {
+	logPath := filepath.Join(wal.opts.DataDir, logFileName)
+	wal.lock.Lock()
+	info, err := wal.file.Stat()
+	wal.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	logged := info.Size()
+
+	tmpPath := logPath + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmpFile)
+	err = readLogPrefix(logPath, logged, func(batch []kvstore.Mutation, record []byte) error {
+		if batch[len(batch)-1].Seq <= seq {
+			return nil
+		}
+		_, err := writer.Write(record)
+		return err
+	})
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	err = copyLogFrom(logPath, logged, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err = commitFile(tmpFile, tmpPath, logPath, err); err != nil {
+		return err
+	}
+
+	// Switch to appending to the rewritten log
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	wal.file.Close()
+	wal.file = file
+	return nil
+}
+
+// Copy the log at logPath from offset onwards to w
+func copyLogFrom(logPath string, offset int64, w io.Writer) error {
+	file, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// Load the snapshot and replay the log in dataDir into store
+func restore(store *kvstore.KVStore, dataDir string) error {
+	data, err := os.ReadFile(filepath.Join(dataDir, snapshotFileName))
+	if err == nil {
+		var snap snapshot
+		if err = json.Unmarshal(data, &snap); err != nil {
+			return errors.New(fmt.Sprintf("persist: corrupt snapshot: %s", err.Error()))
+		}
+		store.Restore(snap.Entries, snap.Seq)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	_, snapSeq := store.Snapshot()
+	logPath := filepath.Join(dataDir, logFileName)
+	validLen := int64(0)
+	err = readLog(logPath, func(batch []kvstore.Mutation, record []byte) error {
+		validLen += int64(len(record))
+		if batch[len(batch)-1].Seq > snapSeq {
+			store.Apply(batch...)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Discard a partially written final record left by a crash
+	return os.Truncate(logPath, validLen)
+}
+
+// Call fn with each complete record in the log at logPath, stopping at the
+// first incomplete or corrupt record
+func readLog(logPath string, fn func(batch []kvstore.Mutation, record []byte) error) error {
+	file, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return readRecords(file, fn)
+}
+
+// Call fn with each complete record in the first size bytes of the log at
+// logPath, as readLog does
+func readLogPrefix(logPath string, size int64, fn func(batch []kvstore.Mutation, record []byte) error) error {
+	file, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return readRecords(io.LimitReader(file, size), fn)
+}
+
+// Call fn with each complete record read from r, stopping at the first
+// incomplete or corrupt record
+func readRecords(r io.Reader, fn func(batch []kvstore.Mutation, record []byte) error) error {
+	reader := bufio.NewReader(r)
+	for {
+		record, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var batch []kvstore.Mutation
+		if json.Unmarshal(record, &batch) != nil || len(batch) == 0 {
+			return nil
+		}
+		if err = fn(batch, record); err != nil {
+			return err
+		}
+	}
+}
+
+// Replaces the file at path with the output of write, so that readers
+// see either the old or the new contents even after a crash
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	return commitFile(file, tmpPath, path, err)
+}
+
+// Sync and close the file written at tmpPath, then rename it to path and sync
+// the directory so that the rename survives a crash.  If err is not nil, the
+// file is instead removed and err returned.
+func commitFile(file *os.File, tmpPath string, path string, err error) error {
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Sync a directory, making renames and file creations in it durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
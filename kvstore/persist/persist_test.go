@@ -0,0 +1,123 @@
+package persist
+
+import (
+	"fmt"
+	"github.com/msayson/kvservice/kvstore"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openStore(t *testing.T, dataDir string) (*kvstore.KVStore, *Log) {
+	store := kvstore.New()
+	wal, err := Open(store, Options{DataDir: dataDir, Fsync: true})
+	if err != nil {
+		t.Fatalf("Open(%s) returned unexpected error: %s", dataDir, err.Error())
+	}
+	return store, wal
+}
+
+func TestOpen_ReplaysLog(t *testing.T) {
+	dataDir := t.TempDir()
+	store, wal := openStore(t, dataDir)
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.TestSet("a", "1", "3")
+	store.Delete("b")
+	wal.Close()
+
+	store, wal = openStore(t, dataDir)
+	defer wal.Close()
+	if val := store.Get("a"); val != "3" {
+		t.Errorf("Get(a) after replay returned %s, expected 3", val)
+	}
+	if _, found := store.Lookup("b"); found {
+		t.Errorf("Lookup(b) after replay found a deleted key")
+	}
+}
+
+func TestSnapshot_TruncatesLog(t *testing.T) {
+	dataDir := t.TempDir()
+	store, wal := openStore(t, dataDir)
+	store.Set("a", "1")
+	store.Set("b", "2")
+	if err := wal.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() returned unexpected error: %s", err.Error())
+	}
+	logInfo, _ := os.Stat(filepath.Join(dataDir, logFileName))
+	if logInfo.Size() != 0 {
+		t.Errorf("Log size after Snapshot was %d bytes, expected 0", logInfo.Size())
+	}
+	store.Set("b", "3")
+	wal.Close()
+
+	store, wal = openStore(t, dataDir)
+	defer wal.Close()
+	if val := store.Get("a"); val != "1" {
+		t.Errorf("Get(a) after restore returned %s, expected 1", val)
+	}
+	if val := store.Get("b"); val != "3" {
+		t.Errorf("Get(b) after restore returned %s, expected 3", val)
+	}
+}
+
+func TestSnapshot_KeepsWritesMadeWhileTruncating(t *testing.T) {
+	dataDir := t.TempDir()
+	store, wal := openStore(t, dataDir)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			store.Set(fmt.Sprintf("key_%d", i), "1")
+		}
+	}()
+	for snapshotting := true; snapshotting; {
+		select {
+		case <-done:
+			snapshotting = false
+		default:
+		}
+		if err := wal.Snapshot(); err != nil {
+			t.Fatalf("Snapshot() returned unexpected error: %s", err.Error())
+		}
+	}
+	store.Set("key_0", "2")
+	wal.Close()
+
+	store, wal = openStore(t, dataDir)
+	defer wal.Close()
+	for i := 1; i < 200; i++ {
+		if val := store.Get(fmt.Sprintf("key_%d", i)); val != "1" {
+			t.Fatalf("Get(key_%d) after restore returned %s, expected 1", i, val)
+		}
+	}
+	if val := store.Get("key_0"); val != "2" {
+		t.Errorf("Get(key_0) after restore returned %s, expected 2", val)
+	}
+}
+
+func TestOpen_DiscardsTornRecord(t *testing.T) {
+	dataDir := t.TempDir()
+	store, wal := openStore(t, dataDir)
+	store.Set("a", "1")
+	wal.Close()
+
+	// Simulate a crash part-way through writing a record
+	logPath := filepath.Join(dataDir, logFileName)
+	file, _ := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`[{"Seq":2,"Key":"a","Val`)
+	file.Close()
+
+	store, wal = openStore(t, dataDir)
+	store.Set("b", "2")
+	wal.Close()
+
+	store, wal = openStore(t, dataDir)
+	defer wal.Close()
+	if val := store.Get("a"); val != "1" {
+		t.Errorf("Get(a) after replay returned %s, expected 1", val)
+	}
+	if val := store.Get("b"); val != "2" {
+		t.Errorf("Get(b) after replay returned %s, expected 2", val)
+	}
+}
@@ -0,0 +1,91 @@
+package kvstore
+
+import (
+	"math/rand"
+)
+
+// Maximum number of levels in a skip list, enough for 4^16 keys
+const maxSkipLevel = 16
+
+// Node in a skip list, linked to its successor on each of its levels
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+// Ordered set of keys, supporting O(log n) insertion, removal and seeking
+type skipList struct {
+	head  *skipNode // sentinel node preceding all keys
+	level int       // number of levels currently in use
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, maxSkipLevel)},
+		level: 1,
+	}
+}
+
+// Adds key to the list, if not already present
+func (list *skipList) insert(key string) {
+	update := list.predecessors(key)
+	if next := update[0].next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := randomSkipLevel()
+	if level > list.level {
+		for i := list.level; i < level; i++ {
+			update[i] = list.head
+		}
+		list.level = level
+	}
+	node := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+}
+
+// Removes key from the list, if present
+func (list *skipList) remove(key string) {
+	update := list.predecessors(key)
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for list.level > 1 && list.head.next[list.level-1] == nil {
+		list.level--
+	}
+}
+
+// Returns the first node with a key >= key, or nil if there is none
+func (list *skipList) seek(key string) *skipNode {
+	return list.predecessors(key)[0].next[0]
+}
+
+// Returns, for each level, the last node with a key < key
+func (list *skipList) predecessors(key string) []*skipNode {
+	update := make([]*skipNode, maxSkipLevel)
+	node := list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+// Returns a level in [1, maxSkipLevel], where each level is a quarter
+// as likely as the one below it
+func randomSkipLevel() int {
+	level := 1
+	for level < maxSkipLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
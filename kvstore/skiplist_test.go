@@ -0,0 +1,66 @@
+package kvstore
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Returns all keys in the list, in list order
+func skipListKeys(list *skipList) []string {
+	keys := []string{}
+	for node := list.head.next[0]; node != nil; node = node.next[0] {
+		keys = append(keys, node.key)
+	}
+	return keys
+}
+
+func TestSkipList_MatchesSortedSet(t *testing.T) {
+	list := newSkipList()
+	set := make(map[string]bool)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key_%d", rand.Intn(500))
+		if rand.Intn(3) == 0 {
+			list.remove(key)
+			delete(set, key)
+		} else {
+			list.insert(key)
+			set[key] = true
+		}
+	}
+
+	expected := []string{}
+	for key := range set {
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+	if fmt.Sprint(skipListKeys(list)) != fmt.Sprint(expected) {
+		t.Errorf("Skip list contains %v, expected %v", skipListKeys(list), expected)
+	}
+}
+
+func TestSkipList_Seek(t *testing.T) {
+	list := newSkipList()
+	for _, key := range []string{"b", "d", "f"} {
+		list.insert(key)
+	}
+	testCases := []struct {
+		key      string
+		expected string
+	}{
+		{"", "b"},
+		{"b", "b"},
+		{"c", "d"},
+		{"f", "f"},
+	}
+	for _, test := range testCases {
+		node := list.seek(test.key)
+		if node == nil || node.key != test.expected {
+			t.Errorf("seek(%s) returned %v, expected node with key %s", test.key, node, test.expected)
+		}
+	}
+	if node := list.seek("g"); node != nil {
+		t.Errorf("seek(g) returned node with key %s, expected nil", node.key)
+	}
+}
@@ -0,0 +1,153 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of guard conditions in a transaction
+const (
+	CompareValue   = "value"   // key is present and has Compare.Value
+	CompareAbsent  = "absent"  // key is not present
+	CompareVersion = "version" // key has Compare.Version, where 0 means absent
+)
+
+// Kinds of operations in a transaction
+const (
+	OpGet    = "get"
+	OpSet    = "set"
+	OpDelete = "delete"
+)
+
+// A guard condition on a key, checked at the start of a transaction
+type Compare struct {
+	Kind    string // one of the Compare* constants
+	Key     string
+	Value   string // CompareValue only
+	Version uint64 // CompareVersion only
+}
+
+// An operation on a key, executed by a transaction
+type Op struct {
+	Kind  string // one of the Op* constants
+	Key   string
+	Value string // OpSet only
+}
+
+// A transaction: if all Compares hold, executes the Success operations,
+// otherwise executes the Failure operations
+type Txn struct {
+	Compares []Compare
+	Success  []Op
+	Failure  []Op
+}
+
+// Result of a single operation in a transaction
+type OpResult struct {
+	Value   string // value of the key after the operation
+	Version uint64 // version of Value, or 0 if the key is absent
+	Found   bool   // OpDelete: whether the key was present; otherwise whether it is now
+}
+
+// Result of a transaction
+type TxnResult struct {
+	Succeeded bool       // whether all Compares held
+	Results   []OpResult // one per executed operation
+}
+
+// Atomically checks txn's guard conditions and executes its success or
+// failure operations, in order.  Returns an error, without checking or
+// executing anything, if a guard condition or operation has an unknown kind.
+func (store *KVStore) Txn(txn Txn) (TxnResult, error) {
+	if err := txn.Validate(); err != nil {
+		return TxnResult{}, err
+	}
+	// Acquire mutex for exclusive access to kvstore
+	store.lock.Lock()
+	// Defer mutex unlock to function exit
+	defer store.unlock()
+
+	result := TxnResult{Succeeded: true}
+	for _, cmp := range txn.Compares {
+		if !store.compareHolds(cmp) {
+			result.Succeeded = false
+			break
+		}
+	}
+	ops := txn.Success
+	if !result.Succeeded {
+		ops = txn.Failure
+	}
+	for _, op := range ops {
+		result.Results = append(result.Results, store.executeOp(op))
+	}
+	return result, nil
+}
+
+// Returns an error naming the first guard condition or operation in txn
+// with an unknown kind, or nil if every kind is known
+func (txn Txn) Validate() error {
+	for _, cmp := range txn.Compares {
+		switch cmp.Kind {
+		case CompareValue, CompareAbsent, CompareVersion:
+		default:
+			return errors.New(fmt.Sprintf("Txn: unknown guard condition kind %q on %s", cmp.Kind, cmp.Key))
+		}
+	}
+	for _, op := range append(append([]Op{}, txn.Success...), txn.Failure...) {
+		switch op.Kind {
+		case OpGet, OpSet, OpDelete:
+		default:
+			return errors.New(fmt.Sprintf("Txn: unknown operation kind %q on %s", op.Kind, op.Key))
+		}
+	}
+	return nil
+}
+
+// Returns the operations that a transaction executed, given its result
+func (txn Txn) ExecutedOps(result TxnResult) []Op {
+	if result.Succeeded {
+		return txn.Success
+	}
+	return txn.Failure
+}
+
+// Returns whether a guard condition holds
+// Caller must hold the store's exclusive lock
+func (store *KVStore) compareHolds(cmp Compare) bool {
+	store.evictIfExpired(cmp.Key)
+	storeVal, found := store.lookup(cmp.Key)
+	switch cmp.Kind {
+	case CompareValue:
+		return found && storeVal.value == cmp.Value
+	case CompareAbsent:
+		return !found
+	case CompareVersion:
+		if !found {
+			return cmp.Version == 0
+		}
+		return storeVal.version == cmp.Version
+	}
+	return false
+}
+
+// Execute a single operation within a transaction
+// Caller must hold the store's exclusive lock
+func (store *KVStore) executeOp(op Op) OpResult {
+	store.evictIfExpired(op.Key)
+	switch op.Kind {
+	case OpSet:
+		store.mutate(Mutation{Key: op.Key, Value: op.Value})
+	case OpDelete:
+		_, found := store.lookup(op.Key)
+		if found {
+			store.mutate(Mutation{Key: op.Key, Deleted: true})
+		}
+		return OpResult{Found: found}
+	}
+	storeVal, found := store.lookup(op.Key)
+	if !found {
+		return OpResult{}
+	}
+	return OpResult{storeVal.value, storeVal.version, true}
+}
@@ -0,0 +1,92 @@
+package kvstore
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns a transaction moving the value of from to to, if to is absent
+func moveTxn(from, fromVal, to string) Txn {
+	return Txn{
+		Compares: []Compare{{Kind: CompareValue, Key: from, Value: fromVal}, {Kind: CompareAbsent, Key: to}},
+		Success:  []Op{{Kind: OpSet, Key: to, Value: fromVal}, {Kind: OpDelete, Key: from}},
+		Failure:  []Op{{Kind: OpGet, Key: from}, {Kind: OpGet, Key: to}},
+	}
+}
+
+func TestTxn_Success(t *testing.T) {
+	store := New()
+	store.Set("a", "1")
+	result, err := store.Txn(moveTxn("a", "1", "b"))
+	if err != nil || !result.Succeeded || len(result.Results) != 2 {
+		t.Fatalf("Txn(move a to b) returned %v, expected success with 2 results", result)
+	}
+	if !result.Results[0].Found || result.Results[0].Value != "1" || !result.Results[1].Found {
+		t.Errorf("Txn(move a to b) returned results %v, expected set b=1 then delete of a", result.Results)
+	}
+	if _, found := store.Lookup("a"); found || store.Get("b") != "1" {
+		t.Errorf("After Txn(move a to b), store has a present=%t and b=%s, expected a absent and b=1", found, store.Get("b"))
+	}
+}
+
+func TestTxn_Failure(t *testing.T) {
+	store := New()
+	store.Set("a", "1")
+	store.Set("b", "2")
+	result, err := store.Txn(moveTxn("a", "1", "b"))
+	if err != nil || result.Succeeded || len(result.Results) != 2 {
+		t.Fatalf("Txn(move a to b) returned %v, expected failure with 2 results", result)
+	}
+	if result.Results[0].Value != "1" || result.Results[1].Value != "2" {
+		t.Errorf("Txn(move a to b) returned results %v, expected gets of a=1 and b=2", result.Results)
+	}
+	if store.Get("a") != "1" || store.Get("b") != "2" {
+		t.Errorf("Failed Txn(move a to b) changed the store")
+	}
+}
+
+func TestTxn_CompareVersion(t *testing.T) {
+	store := New()
+	store.Set("a", "1")
+	_, version, _ := store.LookupVersion("a")
+	txn := Txn{
+		Compares: []Compare{{Kind: CompareVersion, Key: "a", Version: version}, {Kind: CompareVersion, Key: "b", Version: 0}},
+		Success:  []Op{{Kind: OpSet, Key: "a", Value: "2"}},
+	}
+	if result, err := store.Txn(txn); err != nil || !result.Succeeded {
+		t.Errorf("Txn with matching versions failed, expected success")
+	}
+	if result, err := store.Txn(txn); err != nil || result.Succeeded {
+		t.Errorf("Txn with a stale version succeeded, expected failure")
+	}
+}
+
+func TestTxn_SingleMutationBatch(t *testing.T) {
+	store := New()
+	store.Set("a", "1")
+	batches := [][]Mutation{}
+	store.OnMutation(func(batch []Mutation) {
+		batches = append(batches, batch)
+	})
+	store.Txn(moveTxn("a", "1", "b"))
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Errorf("Txn(move a to b) notified hooks with %v, expected one batch of 2 mutations", batches)
+	}
+}
+
+func TestTxn_RejectsUnknownKind(t *testing.T) {
+	store := New()
+	store.Set("a", "1")
+	txn := Txn{Success: []Op{{Kind: OpSet, Key: "a", Value: "2"}, {Kind: "put", Key: "b", Value: "2"}}}
+	if _, err := store.Txn(txn); err == nil || !strings.Contains(err.Error(), `"put"`) {
+		t.Errorf("Txn with an unknown operation kind returned %v, expected an error naming it", err)
+	}
+	if store.Get("a") != "1" {
+		t.Errorf("Rejected Txn changed the store")
+	}
+
+	txn = Txn{Compares: []Compare{{Kind: "present", Key: "a"}}}
+	if _, err := store.Txn(txn); err == nil {
+		t.Errorf("Txn with an unknown guard condition kind succeeded, expected an error")
+	}
+}
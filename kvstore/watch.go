@@ -0,0 +1,133 @@
+package kvstore
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by Watcher.Wait when mutations after the requested sequence
+// number are no longer retained, so changes may have been missed
+var ErrHistoryCompacted = errors.New("watch history compacted: re-read current values and watch from a later version")
+
+// Records a bounded history of a store's mutations so that clients
+// can wait for changes to a key or key prefix
+type Watcher struct {
+	lock       *sync.Mutex
+	history    []Mutation // most recent mutations, oldest first
+	maxHistory int        // maximum length of history
+	oldestSeq  uint64     // every mutation after oldestSeq is in history
+	lastSeq    uint64     // sequence number of the last mutation recorded
+	changed    chan bool  // closed and replaced whenever a mutation is recorded
+}
+
+// Returns a Watcher for all subsequent mutations of store, keeping up
+// to maxHistory of them for clients that fall behind
+func NewWatcher(store *KVStore, maxHistory int) *Watcher {
+	watcher := &Watcher{
+		lock:       &sync.Mutex{},
+		maxHistory: maxHistory,
+		changed:    make(chan bool),
+	}
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+	watcher.lastSeq = store.OnMutation(watcher.record)
+	watcher.oldestSeq = watcher.lastSeq
+	return watcher
+}
+
+// Waits up to timeout for mutations after sinceSeq to key, or to keys
+// beginning with key if isPrefix is set.  A sinceSeq of 0 waits for
+// mutations after the latest one.  Returns the matching mutations, which
+// are empty if the timeout elapsed, and the sequence number to pass as
+// sinceSeq to wait for further changes.
+func (watcher *Watcher) Wait(key string, isPrefix bool, sinceSeq uint64, timeout time.Duration) ([]Mutation, uint64, error) {
+	if sinceSeq == 0 {
+		watcher.lock.Lock()
+		sinceSeq = watcher.lastSeq
+		watcher.lock.Unlock()
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		watcher.lock.Lock()
+		if sinceSeq < watcher.oldestSeq {
+			watcher.lock.Unlock()
+			return nil, sinceSeq, ErrHistoryCompacted
+		}
+		events := []Mutation{}
+		for _, m := range watcher.history {
+			if m.Seq > sinceSeq && watchMatches(key, isPrefix, m.Key) {
+				events = append(events, m)
+			}
+		}
+		lastSeq, changed := watcher.lastSeq, watcher.changed
+		watcher.lock.Unlock()
+
+		if sinceSeq < lastSeq {
+			sinceSeq = lastSeq
+		}
+		if len(events) > 0 {
+			return events, sinceSeq, nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return events, sinceSeq, nil
+		}
+	}
+}
+
+// Mutation hook: add a batch of mutations to the history and wake up waiting clients
+// Mutations applied with earlier sequence numbers than ones already recorded,
+// such as key-values repaired by anti-entropy, are kept in sequence order, or
+// left out if they are older than the history, and never move lastSeq back.
+// Clients which have already waited past them do not see them.
+func (watcher *Watcher) record(batch []Mutation) {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+	for _, m := range batch {
+		if m.Seq <= watcher.oldestSeq {
+			continue
+		}
+		i := len(watcher.history)
+		for i > 0 && watcher.history[i-1].Seq > m.Seq {
+			i--
+		}
+		watcher.history = append(watcher.history, Mutation{})
+		copy(watcher.history[i+1:], watcher.history[i:])
+		watcher.history[i] = m
+		if m.Seq > watcher.lastSeq {
+			watcher.lastSeq = m.Seq
+		}
+	}
+	if excess := len(watcher.history) - watcher.maxHistory; excess > 0 {
+		watcher.oldestSeq = watcher.history[excess-1].Seq
+		watcher.history = watcher.history[excess:]
+	}
+	close(watcher.changed)
+	watcher.changed = make(chan bool)
+}
+
+// Discard the history after the store is restored from a snapshot taken at
+// sequence number seq, which does not pass through the mutation hooks
+// Waiting clients are woken up and, since the changes up to seq are not in
+// the history, told to re-read current values and watch from seq.
+func (watcher *Watcher) Restored(seq uint64) {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+	watcher.history = nil
+	watcher.oldestSeq = seq
+	watcher.lastSeq = seq
+	close(watcher.changed)
+	watcher.changed = make(chan bool)
+}
+
+// Returns whether a watch on key (or prefix, if isPrefix) covers changedKey
+func watchMatches(key string, isPrefix bool, changedKey string) bool {
+	if isPrefix {
+		return strings.HasPrefix(changedKey, key)
+	}
+	return changedKey == key
+}
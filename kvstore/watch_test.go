@@ -0,0 +1,131 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWait_ReturnsPastChanges(t *testing.T) {
+	store := New()
+	watcher := NewWatcher(store, 10)
+	store.Set("user_0", "a")
+	store.Set("user_1", "a")
+	store.Set("other", "b")
+	store.Delete("user_1")
+
+	events, nextSeq, err := watcher.Wait("user_", true, 1, time.Second)
+	if err != nil {
+		t.Fatalf("Wait(user_, prefix, 1) returned unexpected error: %s", err.Error())
+	}
+	if len(events) != 2 || events[0].Value != "a" || !events[1].Deleted {
+		t.Errorf("Wait(user_, prefix, 1) returned %v, expected a set then a delete of user_1", events)
+	}
+	if nextSeq != 4 {
+		t.Errorf("Wait(user_, prefix, 1) returned next sequence number %d, expected 4", nextSeq)
+	}
+}
+
+func TestWait_BlocksUntilChange(t *testing.T) {
+	store := New()
+	watcher := NewWatcher(store, 10)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		store.Set("other", "a")
+		store.Set("config", "b")
+	}()
+
+	events, _, err := watcher.Wait("config", false, 0, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Wait(config, 0) returned unexpected error: %s", err.Error())
+	}
+	if len(events) != 1 || events[0].Key != "config" || events[0].Value != "b" {
+		t.Errorf("Wait(config, 0) returned %v, expected the change to config", events)
+	}
+}
+
+func TestWait_TimesOut(t *testing.T) {
+	store := New()
+	watcher := NewWatcher(store, 10)
+	store.Set("config", "a")
+	store.Set("other", "a")
+	events, nextSeq, err := watcher.Wait("config", false, 1, 10*time.Millisecond)
+	if err != nil || len(events) != 0 || nextSeq != 2 {
+		t.Errorf("Wait(config, 1) returned (%v, %d, %v), expected ([], 2, nil)", events, nextSeq, err)
+	}
+}
+
+func TestWait_ReportsExpiry(t *testing.T) {
+	advance := useFakeClock(t)
+	store := New()
+	watcher := NewWatcher(store, 10)
+	store.SetWithTTL("session", "a", time.Second)
+	advance(2 * time.Second)
+	store.Reap()
+
+	events, _, err := watcher.Wait("session", false, 1, time.Second)
+	if err != nil {
+		t.Fatalf("Wait(session, 1) returned unexpected error: %s", err.Error())
+	}
+	if len(events) != 1 || !events[0].Deleted || events[0].Seq != 2 {
+		t.Errorf("Wait(session, 1) returned %v, expected the removal of the expired key", events)
+	}
+}
+
+func TestWait_KeepsOrderForEarlierSequenceNumbers(t *testing.T) {
+	store := New()
+	watcher := NewWatcher(store, 10)
+	store.Set("a", "1")
+	store.Set("b", "1")
+	store.Set("c", "1")
+	store.ApplyAt(3, Mutation{Seq: 1, Key: "a", Value: "repaired"})
+
+	events, nextSeq, err := watcher.Wait("", true, 1, time.Second)
+	if err != nil || nextSeq != 3 {
+		t.Fatalf("Wait(\"\", prefix, 1) returned next sequence number %d, error %v, expected 3", nextSeq, err)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Seq < events[i-1].Seq {
+			t.Errorf("Wait(\"\", prefix, 1) returned %v, expected changes in sequence order", events)
+		}
+	}
+	store.Set("d", "1")
+	if events, nextSeq, _ := watcher.Wait("d", false, 3, time.Second); len(events) != 1 || nextSeq != 4 {
+		t.Errorf("Wait(d, 3) returned (%v, %d), expected the change to d at 4", events, nextSeq)
+	}
+}
+
+func TestWait_HistoryCompacted(t *testing.T) {
+	store := New()
+	watcher := NewWatcher(store, 2)
+	store.Set("a", "1")
+	store.Set("a", "2")
+	store.Set("a", "3")
+	store.Set("a", "4")
+	if _, _, err := watcher.Wait("a", false, 1, time.Second); err != ErrHistoryCompacted {
+		t.Errorf("Wait(a, 1) after history was compacted returned %v, expected ErrHistoryCompacted", err)
+	}
+	events, _, err := watcher.Wait("a", false, 2, time.Second)
+	if err != nil || len(events) != 2 {
+		t.Errorf("Wait(a, 2) returned (%v, %v), expected the last 2 changes", events, err)
+	}
+}
+
+func TestWait_WakesOnRestore(t *testing.T) {
+	store := New()
+	watcher := NewWatcher(store, 10)
+	store.Set("a", "1")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		store.Restore([]Mutation{{Seq: 5, Key: "a", Value: "5"}}, 5)
+		watcher.Restored(5)
+	}()
+	if _, _, err := watcher.Wait("a", false, 1, 5*time.Second); err != ErrHistoryCompacted {
+		t.Errorf("Wait(a, 1) across a restore returned %v, expected ErrHistoryCompacted", err)
+	}
+
+	store.Set("a", "6")
+	events, nextSeq, err := watcher.Wait("a", false, 5, time.Second)
+	if err != nil || len(events) != 1 || events[0].Value != "6" || nextSeq != 6 {
+		t.Errorf("Wait(a, 5) after a restore returned (%v, %d, %v), expected ([a=6], 6, nil)", events, nextSeq, err)
+	}
+}
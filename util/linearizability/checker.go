@@ -0,0 +1,198 @@
+package linearizability
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Maximum number of a key's operations listed when they are not linearizable
+const maxListedOps = 50
+
+// Returns nil if the operations are linearizable for a key-value store which
+// starts empty, or an error naming a key whose operations are not
+// Each key is checked separately, since operations on different keys never
+// affect each other.  A missing key's value is the empty string, as for
+// kvstore.KVStore's Get and TestSet.
+func Check(ops []Operation) error {
+	byKey := map[string][]Operation{}
+	for _, op := range ops {
+		byKey[op.Input.Key] = append(byKey[op.Input.Key], op)
+	}
+	keys := []string{}
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !checkKey(byKey[key]) {
+			return notLinearizableError(key, byKey[key])
+		}
+	}
+	return nil
+}
+
+// Applies op to a key whose value is state
+// Returns whether op's output is consistent with state, and the key's new value.
+func step(state string, op Operation) (bool, string) {
+	switch op.Input.Kind {
+	case OpSet:
+		return op.Output.Unknown || op.Output.Value == op.Input.Value, op.Input.Value
+	case OpTestSet:
+		next := state
+		if state == op.Input.TestVal {
+			next = op.Input.Value
+		}
+		return op.Output.Unknown || op.Output.Value == next, next
+	}
+	return op.Output.Unknown || op.Output.Value == state, state
+}
+
+// Call or return of an operation, linked in time order
+type entry struct {
+	id    int    // index of the operation
+	match *entry // call entries only: the operation's return entry
+	prev  *entry
+	next  *entry
+}
+
+// An operation linearized during the search, with the key's value before it
+type linearized struct {
+	call  *entry
+	state string
+}
+
+// Returns whether the operations on a single key are linearizable
+// Searches for an order using Lowe's extension of the Wing and Gong
+// algorithm, as used by Porcupine: repeatedly linearize the earliest
+// operation that is consistent with the key's value and has not been tried
+// from the same set of linearized operations and value, backtracking when an
+// operation returns before being linearized.
+func checkKey(ops []Operation) bool {
+	head := newEntries(ops)
+	done := newBitset(len(ops))
+	seen := map[string]bool{}
+	stack := []linearized{}
+	state := ""
+	e := head.next
+	for head.next != nil {
+		if e.match != nil {
+			if ok, next := step(state, ops[e.id]); ok {
+				done.set(e.id)
+				key := done.key() + "\x00" + next
+				if !seen[key] {
+					seen[key] = true
+					stack = append(stack, linearized{call: e, state: state})
+					state = next
+					lift(e)
+					e = head.next
+					continue
+				}
+				done.clear(e.id)
+			}
+			e = e.next
+			continue
+		}
+		// An operation returns before every operation called earlier is linearized
+		if len(stack) == 0 {
+			return false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		done.clear(top.call.id)
+		unlift(top.call)
+		e = top.call.next
+	}
+	return true
+}
+
+// Returns the head of a list of the operations' calls and returns in time
+// order, with calls before returns made at the same time
+func newEntries(ops []Operation) *entry {
+	type event struct {
+		time   int64
+		isCall bool
+		entry  *entry
+	}
+	events := []event{}
+	for i, op := range ops {
+		ret := &entry{id: i}
+		call := &entry{id: i, match: ret}
+		events = append(events, event{op.Call, true, call}, event{op.Return, false, ret})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].isCall && !events[j].isCall
+	})
+	head := &entry{id: -1}
+	last := head
+	for _, event := range events {
+		event.entry.prev = last
+		last.next = event.entry
+		last = event.entry
+	}
+	return head
+}
+
+// Remove a call entry and its return entry from the list
+func lift(call *entry) {
+	call.prev.next = call.next
+	call.next.prev = call.prev
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// Put back a call entry and its return entry removed by lift
+func unlift(call *entry) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	call.next.prev = call
+}
+
+// Set of operation indexes
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitset) clear(i int) {
+	b[i/64] &^= 1 << uint(i%64)
+}
+
+// Returns a string identifying the set
+func (b bitset) key() string {
+	var builder strings.Builder
+	for _, word := range b {
+		for shift := uint(0); shift < 64; shift += 8 {
+			builder.WriteByte(byte(word >> shift))
+		}
+	}
+	return builder.String()
+}
+
+func notLinearizableError(key string, ops []Operation) error {
+	msg := fmt.Sprintf("Operations on key %q are not linearizable", key)
+	if len(ops) > maxListedOps {
+		return errors.New(fmt.Sprintf("%s (%d operations)", msg, len(ops)))
+	}
+	for _, op := range ops {
+		msg += fmt.Sprintf("\n  [%d, %d] %s", op.Call, op.Return, op)
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,141 @@
+package linearizability
+
+import (
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"math"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+func get(client int, key string, value string, call int64, ret int64) Operation {
+	return Operation{ClientId: client, Input: Input{Kind: OpGet, Key: key}, Output: Output{Value: value}, Call: call, Return: ret}
+}
+
+func set(client int, key string, value string, call int64, ret int64) Operation {
+	return Operation{ClientId: client, Input: Input{Kind: OpSet, Key: key, Value: value}, Output: Output{Value: value}, Call: call, Return: ret}
+}
+
+func testSet(client int, key string, testVal string, newVal string, result string, call int64, ret int64) Operation {
+	return Operation{ClientId: client, Input: Input{Kind: OpTestSet, Key: key, Value: newVal, TestVal: testVal}, Output: Output{Value: result}, Call: call, Return: ret}
+}
+
+func TestCheck_ConcurrentReadsMaySeeEitherValue(t *testing.T) {
+	ops := []Operation{
+		set(1, "a", "1", 0, 10),
+		set(2, "a", "2", 5, 20),
+		get(3, "a", "1", 12, 14),
+		get(4, "a", "2", 15, 30),
+		get(5, "a", "1", 15, 30),
+	}
+	if err := Check(ops); err != nil {
+		t.Errorf("Check returned unexpected error: %s", err.Error())
+	}
+}
+
+func TestCheck_RejectsStaleRead(t *testing.T) {
+	ops := []Operation{
+		set(1, "a", "1", 0, 10),
+		set(1, "a", "2", 11, 20),
+		get(2, "a", "1", 21, 30),
+	}
+	if err := Check(ops); err == nil {
+		t.Errorf("Check accepted a read of an overwritten value")
+	}
+}
+
+func TestCheck_RejectsReadsGoingBackInTime(t *testing.T) {
+	// Both reads overlap the write, but the second starts after the first returned the new value
+	ops := []Operation{
+		set(1, "a", "1", 0, 100),
+		get(2, "a", "1", 10, 20),
+		get(3, "a", "", 30, 40),
+	}
+	if err := Check(ops); err == nil {
+		t.Errorf("Check accepted a read of the old value after a read of the new value")
+	}
+}
+
+func TestCheck_TestSetSucceedsOnlyOnce(t *testing.T) {
+	ops := []Operation{
+		testSet(1, "a", "", "1", "1", 0, 10),
+		testSet(2, "a", "", "2", "2", 0, 10),
+	}
+	if err := Check(ops); err == nil {
+		t.Errorf("Check accepted two concurrent test-sets of an empty key both succeeding")
+	}
+	ops[1] = testSet(2, "a", "", "2", "1", 0, 10)
+	if err := Check(ops); err != nil {
+		t.Errorf("Check returned unexpected error: %s", err.Error())
+	}
+}
+
+func TestCheck_FailedWriteMayTakeEffect(t *testing.T) {
+	failed := set(1, "a", "1", 0, math.MaxInt64)
+	failed.Output = Output{Unknown: true}
+	ops := []Operation{failed, get(2, "a", "", 5, 10), get(2, "a", "1", 20, 30)}
+	if err := Check(ops); err != nil {
+		t.Errorf("Check returned unexpected error: %s", err.Error())
+	}
+	ops = []Operation{failed, get(2, "a", "", 5, 10)}
+	if err := Check(ops); err != nil {
+		t.Errorf("Check returned unexpected error: %s", err.Error())
+	}
+}
+
+func TestCheck_KeysAreIndependent(t *testing.T) {
+	ops := []Operation{
+		set(1, "a", "1", 0, 10),
+		get(2, "b", "", 20, 30),
+		get(2, "a", "2", 40, 50),
+	}
+	if err := Check(ops); err == nil {
+		t.Errorf("Check accepted a read of a value never written")
+	}
+}
+
+// Key-value service serving calls directly from a store
+type storeService struct {
+	store *kvstore.KVStore
+}
+
+func (service *storeService) Get(args *api.GetArgs, reply *api.ValReply) error {
+	reply.Val = service.store.Get(args.Key)
+	return nil
+}
+
+func (service *storeService) Set(args *api.SetArgs, reply *api.ValReply) error {
+	reply.Val = service.store.Set(args.Key, args.Val)
+	return nil
+}
+
+func (service *storeService) TestSet(args *api.TestSetArgs, reply *api.ValReply) error {
+	reply.Val = service.store.TestSet(args.Key, args.TestVal, args.NewVal)
+	return nil
+}
+
+func TestWorkload_SingleStoreIsLinearizable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err.Error())
+	}
+	defer listener.Close()
+	server := rpc.NewServer()
+	server.RegisterName("KeyValService", &storeService{store: kvstore.New()})
+	go server.Accept(listener)
+
+	history, err := DefaultWorkload().Run(func(int) (*rpc.Client, error) {
+		return rpc.Dial("tcp", listener.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("Error running workload: %s", err.Error())
+	}
+	ops := history.Operations()
+	if len(ops) != 800 {
+		t.Errorf("History recorded %d calls, expected 800", len(ops))
+	}
+	if err := Check(ops); err != nil {
+		t.Errorf("Check returned unexpected error: %s", err.Error())
+	}
+}
@@ -0,0 +1,148 @@
+// Package linearizability records the calls made by concurrent clients of
+// the key-value service and checks that they behave like a single key-value
+// store, as if each call took effect at one instant between its call and return
+package linearizability
+
+import (
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"math"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kind of key-value operation recorded
+type OpKind int
+
+const (
+	OpGet OpKind = iota
+	OpSet
+	OpTestSet
+)
+
+// Arguments of a recorded call
+type Input struct {
+	Kind    OpKind
+	Key     string
+	Value   string // Set, or TestSet's new value
+	TestVal string // TestSet only
+}
+
+// Result of a recorded call
+type Output struct {
+	Value   string
+	Unknown bool // the call failed, so it may or may not have taken effect
+}
+
+// A call made by a client, with the times it was called and returned, in
+// nanoseconds since the history started
+// Failed writes are recorded as returning after every other call.
+type Operation struct {
+	ClientId int
+	Input    Input
+	Output   Output
+	Call     int64
+	Return   int64
+}
+
+func (op Operation) String() string {
+	switch op.Input.Kind {
+	case OpSet:
+		return fmt.Sprintf("client %d: Set(%s,%s) -> %s", op.ClientId, op.Input.Key, op.Input.Value, op.Output)
+	case OpTestSet:
+		return fmt.Sprintf("client %d: TestSet(%s,%s,%s) -> %s", op.ClientId, op.Input.Key, op.Input.TestVal, op.Input.Value, op.Output)
+	}
+	return fmt.Sprintf("client %d: Get(%s) -> %s", op.ClientId, op.Input.Key, op.Output)
+}
+
+func (output Output) String() string {
+	if output.Unknown {
+		return "unknown"
+	}
+	return fmt.Sprintf("%q", output.Value)
+}
+
+// Calls made by every client of a service, safe for concurrent use
+type History struct {
+	start   time.Time
+	ops     []Operation
+	clients int
+	lock    *sync.Mutex
+}
+
+func NewHistory() *History {
+	return &History{start: time.Now(), lock: &sync.Mutex{}}
+}
+
+// Returns the calls recorded so far, ordered by call time
+func (history *History) Operations() []Operation {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	ops := append([]Operation{}, history.ops...)
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+	return ops
+}
+
+// Returns a client with its own id, recording the calls it makes on kvserver
+func (history *History) NewClient(kvserver *rpc.Client) *Client {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	history.clients++
+	return &Client{id: history.clients, kvserver: kvserver, history: history}
+}
+
+// Records a call made between call and now, which returned value or failed
+// with err
+// Failed reads have no effect and are left out.
+func (history *History) record(clientId int, input Input, call int64, value string, err error) {
+	op := Operation{ClientId: clientId, Input: input, Output: Output{Value: value}, Call: call, Return: history.now()}
+	if err != nil {
+		if input.Kind == OpGet {
+			return
+		}
+		op.Output = Output{Unknown: true}
+		op.Return = math.MaxInt64
+	}
+	history.lock.Lock()
+	history.ops = append(history.ops, op)
+	history.lock.Unlock()
+}
+
+// Returns the nanoseconds elapsed since the history started
+func (history *History) now() int64 {
+	return int64(time.Since(history.start))
+}
+
+// Client of a key-value service which records each call in a history
+// A client makes one call at a time.
+type Client struct {
+	id       int
+	kvserver *rpc.Client
+	history  *History
+}
+
+// Retrieves the value for key, recording the call
+func (client *Client) Get(key string) (string, error) {
+	call := client.history.now()
+	value, err := api.Get(client.kvserver, key)
+	client.history.record(client.id, Input{Kind: OpGet, Key: key}, call, value, err)
+	return value, err
+}
+
+// Sets the value for key, recording the call
+func (client *Client) Set(key, value string) (string, error) {
+	call := client.history.now()
+	result, err := api.Set(client.kvserver, key, value)
+	client.history.record(client.id, Input{Kind: OpSet, Key: key, Value: value}, call, result, err)
+	return result, err
+}
+
+// Sets the value for key to newValue if it is testValue, recording the call
+func (client *Client) TestSet(key, testValue, newValue string) (string, error) {
+	call := client.history.now()
+	result, err := api.TestSet(client.kvserver, key, testValue, newValue)
+	client.history.record(client.id, Input{Kind: OpTestSet, Key: key, Value: newValue, TestVal: testValue}, call, result, err)
+	return result, err
+}
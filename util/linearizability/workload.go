@@ -0,0 +1,61 @@
+package linearizability
+
+import (
+	"fmt"
+	"math/rand"
+	"net/rpc"
+	"sync"
+)
+
+// Concurrent clients making random Get, Set and TestSet calls on a few keys
+type Workload struct {
+	Clients      int // number of concurrent clients
+	OpsPerClient int // number of calls made by each client
+	Keys         int // number of distinct keys called on
+}
+
+func DefaultWorkload() Workload {
+	return Workload{Clients: 8, OpsPerClient: 100, Keys: 4}
+}
+
+// Runs the workload, connecting each client with connect, and returns the
+// calls made
+// Every value set is distinct, and TestSet tests the value the client last
+// saw for the key, so that some test-sets succeed under contention.
+func (workload Workload) Run(connect func(client int) (*rpc.Client, error)) (*History, error) {
+	history := NewHistory()
+	clients := []*Client{}
+	for i := 0; i < workload.Clients; i++ {
+		kvserver, err := connect(i)
+		if err != nil {
+			return nil, err
+		}
+		defer kvserver.Close()
+		clients = append(clients, history.NewClient(kvserver))
+	}
+
+	wg := sync.WaitGroup{}
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(client.id)))
+			lastSeen := map[string]string{}
+			for i := 0; i < workload.OpsPerClient; i++ {
+				key := fmt.Sprint("key", random.Intn(workload.Keys))
+				value := fmt.Sprintf("%d.%d", client.id, i)
+				switch random.Intn(3) {
+				case 0:
+					lastSeen[key], _ = client.Get(key)
+				case 1:
+					client.Set(key, value)
+					lastSeen[key] = value
+				default:
+					lastSeen[key], _ = client.TestSet(key, lastSeen[key], value)
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+	return history, nil
+}
@@ -0,0 +1,169 @@
+package memnet
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// One end of a connection between two nodes
+type conn struct {
+	network *Network
+	local   addr
+	remote  addr
+	peer    *conn      // the other end of the connection
+	in      *pipe      // messages sent by the other end
+	out     *pipe      // messages sent by this end
+	random  *rand.Rand // decides the faults injected into messages sent by this end
+	lock    *sync.Mutex
+}
+
+// Returns both ends of a new connection from the node at fromIpPort to the
+// one at ipPort, each injecting faults into the messages it sends using random
+func newConnPair(network *Network, fromIpPort string, ipPort string, clientRandom *rand.Rand, serverRandom *rand.Rand) (*conn, *conn) {
+	toServer, toClient := newPipe(), newPipe()
+	client := &conn{network: network, local: addr(fromIpPort), remote: addr(ipPort), in: toClient, out: toServer, random: clientRandom, lock: &sync.Mutex{}}
+	server := &conn{network: network, local: addr(ipPort), remote: addr(fromIpPort), in: toServer, out: toClient, random: serverRandom, lock: &sync.Mutex{}}
+	client.peer, server.peer = server, client
+	return client, server
+}
+
+// Blocks until a message is delivered, returning as much of it as fits in b
+func (c *conn) Read(b []byte) (int, error) {
+	return c.in.read(b)
+}
+
+// Sends b as one message, which is lost, breaking the connection, or
+// delivered after a delay
+func (c *conn) Write(b []byte) (int, error) {
+	faults := c.network.currentFaults()
+	c.lock.Lock()
+	lost := c.random.Float64() < faults.DropRate
+	delay := faults.MinDelay
+	if faults.MaxDelay > faults.MinDelay {
+		delay += time.Duration(c.random.Int63n(int64(faults.MaxDelay - faults.MinDelay)))
+	}
+	c.lock.Unlock()
+
+	if lost {
+		c.network.breakConn(c)
+		return 0, errors.New("memnet: message was lost, connection was reset")
+	}
+	if err := c.out.write(append([]byte{}, b...), delay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close both ends of the connection
+func (c *conn) Close() error {
+	c.network.lock.Lock()
+	delete(c.network.conns, c)
+	delete(c.network.conns, c.peer)
+	c.network.lock.Unlock()
+	c.in.close(io.EOF)
+	c.out.close(io.EOF)
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Deadlines are not supported, since net/rpc does not use them
+func (c *conn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Message in flight, delivered once its delivery time has passed
+type message struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// Messages sent in one direction of a connection, delivered in order
+type pipe struct {
+	messages []message
+	last     time.Time // delivery time of the last message sent
+	err      error     // returned by every read and write once the pipe is closed
+	cond     *sync.Cond
+	lock     *sync.Mutex
+}
+
+func newPipe() *pipe {
+	lock := &sync.Mutex{}
+	return &pipe{cond: sync.NewCond(lock), lock: lock}
+}
+
+// Send data, to be delivered after delay but not before any earlier message
+func (p *pipe) write(data []byte, delay time.Duration) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	deliverAt := time.Now().Add(delay)
+	if deliverAt.Before(p.last) {
+		deliverAt = p.last
+	}
+	p.last = deliverAt
+	p.messages = append(p.messages, message{data: data, deliverAt: deliverAt})
+	p.cond.Broadcast()
+	return nil
+}
+
+// Blocks until the next message is delivered or the pipe is closed,
+// returning as much of the message as fits in b and keeping the rest
+func (p *pipe) read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if len(p.messages) > 0 {
+			wait := time.Until(p.messages[0].deliverAt)
+			if wait <= 0 {
+				n := copy(b, p.messages[0].data)
+				if n < len(p.messages[0].data) {
+					p.messages[0].data = p.messages[0].data[n:]
+				} else {
+					p.messages = p.messages[1:]
+				}
+				return n, nil
+			}
+			timer := time.AfterFunc(wait, p.cond.Broadcast)
+			p.cond.Wait()
+			timer.Stop()
+			continue
+		}
+		p.cond.Wait()
+	}
+}
+
+// Close the pipe with err, discarding messages in flight
+// Later calls keep the first error.
+func (p *pipe) close(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.messages = nil
+	}
+	p.cond.Broadcast()
+}
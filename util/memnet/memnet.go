@@ -0,0 +1,257 @@
+// Package memnet is an in-memory network for tests, which injects message
+// drops, delays, partitions and node crashes into RPC connections between
+// nodes running in one process
+//
+// Install a Network beneath every RPC connection with rpc_util.SetTransport.
+// Each connection draws its faults from its own random number generator,
+// seeded from the network's seed, the two ends of the connection and how many
+// connections the caller had made to the same node before, so the faults a
+// connection sees do not depend on how goroutines on other connections are
+// scheduled.
+package memnet
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Maximum number of connections waiting to be accepted by each listener
+const acceptBacklog = 128
+
+// Faults injected into every message, where a message is the data passed to
+// one Write call on a connection
+type Faults struct {
+	DropRate float64       // probability that a message is lost
+	MinDelay time.Duration // each message is delivered after a delay chosen
+	MaxDelay time.Duration // uniformly between MinDelay and MaxDelay
+}
+
+// In-memory network of nodes named by ip:port
+// Like TCP, a connection delivers its messages in order, and a lost message
+// breaks the connection, failing calls on it; messages on different
+// connections are reordered by their delays.  Requests to connect are never
+// lost, as TCP resends them.  A node which has crashed still
+// runs in the test's process, but can neither send nor receive messages
+// until it is restarted.
+type Network struct {
+	seed       int64
+	faults     Faults
+	listeners  map[string]*listener
+	crashed    map[string]bool
+	partitions map[string]int // group of each partitioned node
+	dials      map[string]int // number of connections made on each link
+	conns      map[*conn]bool // open connections, both ends of each
+	lock       *sync.Mutex
+}
+
+// Returns a network without faults whose random choices are seeded by seed
+func New(seed int64) *Network {
+	return &Network{
+		seed:       seed,
+		listeners:  map[string]*listener{},
+		crashed:    map[string]bool{},
+		partitions: map[string]int{},
+		dials:      map[string]int{},
+		conns:      map[*conn]bool{},
+		lock:       &sync.Mutex{},
+	}
+}
+
+// Inject faults into every later message
+func (network *Network) SetFaults(faults Faults) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.faults = faults
+}
+
+// Listen for connections on ipPort
+func (network *Network) Listen(ipPort string) (net.Listener, error) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if _, listening := network.listeners[ipPort]; listening {
+		return nil, errors.New(fmt.Sprintf("memnet: %s is already in use", ipPort))
+	}
+	l := &listener{network: network, addr: addr(ipPort), pending: make(chan *conn, acceptBacklog), closed: make(chan bool)}
+	network.listeners[ipPort] = l
+	return l, nil
+}
+
+// Connect to ipPort from the node at fromIpPort, or "" if the caller is not
+// a node
+// Fails at once if either node has crashed or nothing is listening on ipPort,
+// and after timeout if the nodes are partitioned from each other, or at once
+// if timeout is 0.
+func (network *Network) Dial(fromIpPort, ipPort string, timeout time.Duration) (net.Conn, error) {
+	network.lock.Lock()
+	l := network.listeners[ipPort]
+	if l == nil || network.crashed[fromIpPort] || network.crashed[ipPort] {
+		network.lock.Unlock()
+		return nil, dialError(ipPort, "connection refused")
+	}
+	if !network.reachable(fromIpPort, ipPort) {
+		network.lock.Unlock()
+		time.Sleep(timeout)
+		return nil, dialError(ipPort, "timed out")
+	}
+	link := fromIpPort + "->" + ipPort
+	n := network.dials[link]
+	network.dials[link]++
+	client, server := newConnPair(network, fromIpPort, ipPort, network.random(link, n, "dial"), network.random(link, n, "accept"))
+	network.conns[client], network.conns[server] = true, true
+	network.lock.Unlock()
+
+	select {
+	case <-l.closed:
+	default:
+		select {
+		case l.pending <- server:
+			return client, nil
+		default:
+		}
+	}
+	network.breakConn(client)
+	return nil, dialError(ipPort, "connection refused")
+}
+
+// Crash the node at ipPort, breaking its connections and refusing new ones
+// to or from it until it is restarted
+func (network *Network) Crash(ipPort string) {
+	network.lock.Lock()
+	network.crashed[ipPort] = true
+	network.lock.Unlock()
+	network.breakConnsWhere(func(c *conn) bool { return c.local == addr(ipPort) || c.remote == addr(ipPort) })
+}
+
+// Let a crashed node at ipPort send and receive messages again
+func (network *Network) Restart(ipPort string) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	delete(network.crashed, ipPort)
+}
+
+// Split the nodes into groups which cannot reach each other, breaking
+// connections between groups, until Heal is called
+// Nodes in no group, such as clients, can still reach every node.
+func (network *Network) Partition(groups ...[]string) {
+	network.lock.Lock()
+	network.partitions = map[string]int{}
+	for i, group := range groups {
+		for _, ipPort := range group {
+			network.partitions[ipPort] = i + 1
+		}
+	}
+	network.lock.Unlock()
+	network.breakConnsWhere(func(c *conn) bool {
+		network.lock.Lock()
+		defer network.lock.Unlock()
+		return !network.reachable(string(c.local), string(c.remote))
+	})
+}
+
+// Remove any partition, letting every node reach every other
+func (network *Network) Heal() {
+	network.Partition()
+}
+
+// Returns whether the node at a can reach the node at b
+// Caller must hold the network's lock
+func (network *Network) reachable(a string, b string) bool {
+	groupA, partitionedA := network.partitions[a]
+	groupB, partitionedB := network.partitions[b]
+	return !partitionedA || !partitionedB || groupA == groupB
+}
+
+// Returns a random number generator for the nth connection made on link,
+// seeded from the network's seed
+// Caller must hold the network's lock
+func (network *Network) random(link string, n int, side string) *rand.Rand {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d/%s/%d/%s", network.seed, link, n, side)
+	return rand.New(rand.NewSource(int64(hash.Sum64())))
+}
+
+// Returns the faults currently injected
+func (network *Network) currentFaults() Faults {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	return network.faults
+}
+
+// Break both ends of every open connection for which broken returns true
+func (network *Network) breakConnsWhere(broken func(c *conn) bool) {
+	network.lock.Lock()
+	conns := []*conn{}
+	for c := range network.conns {
+		conns = append(conns, c)
+	}
+	network.lock.Unlock()
+	for _, c := range conns {
+		if broken(c) {
+			network.breakConn(c)
+		}
+	}
+}
+
+// Break both ends of connection c, failing reads and writes on them
+func (network *Network) breakConn(c *conn) {
+	network.lock.Lock()
+	delete(network.conns, c)
+	delete(network.conns, c.peer)
+	network.lock.Unlock()
+	err := errors.New(fmt.Sprintf("memnet: connection between %s and %s was reset", c.local, c.remote))
+	c.in.close(err)
+	c.out.close(err)
+}
+
+func dialError(ipPort string, reason string) error {
+	return errors.New(fmt.Sprintf("memnet: dial %s: %s", ipPort, reason))
+}
+
+// Address of a node on the network
+type addr string
+
+func (a addr) Network() string {
+	return "memnet"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
+
+// Listener accepting connections to one ip:port
+type listener struct {
+	network *Network
+	addr    addr
+	pending chan *conn // connections waiting to be accepted
+	closed  chan bool  // closed once the listener is closed
+	once    sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.pending:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New(fmt.Sprintf("memnet: listener on %s is closed", l.addr))
+	}
+}
+
+// Stop listening, refusing later connections and freeing the ip:port
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.network.lock.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.lock.Unlock()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
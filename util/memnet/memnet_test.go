@@ -0,0 +1,152 @@
+package memnet
+
+import (
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// Service echoing its argument, or waiting until released
+type echo struct {
+	release chan bool
+}
+
+func (service *echo) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func (service *echo) Wait(_ string, reply *string) error {
+	<-service.release
+	return nil
+}
+
+// Serve an echo service on the network at ipPort
+func serveEcho(t *testing.T, network *Network, ipPort string) *echo {
+	listener, err := network.Listen(ipPort)
+	if err != nil {
+		t.Fatalf("Listen(%s) returned unexpected error: %s", ipPort, err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	service := &echo{release: make(chan bool)}
+	server := rpc.NewServer()
+	server.RegisterName("Echo", service)
+	go server.Accept(listener)
+	return service
+}
+
+// Call Echo on ipPort from the node at fromIpPort
+func callEcho(network *Network, fromIpPort string, ipPort string, args string) (string, error) {
+	conn, err := network.Dial(fromIpPort, ipPort, 50*time.Millisecond)
+	if err != nil {
+		return "", err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	reply := ""
+	err = client.Call("Echo.Echo", args, &reply)
+	return reply, err
+}
+
+func TestNetwork_DeliversAfterDelay(t *testing.T) {
+	network := New(1)
+	network.SetFaults(Faults{MinDelay: 20 * time.Millisecond, MaxDelay: 30 * time.Millisecond})
+	serveEcho(t, network, "server:1")
+
+	start := time.Now()
+	if reply, err := callEcho(network, "client:1", "server:1", "hello"); err != nil || reply != "hello" {
+		t.Fatalf("Echo returned %s, error %v, expected hello", reply, err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Round trip took %s, expected at least two delays of 20ms", elapsed)
+	}
+}
+
+func TestNetwork_SameSeedLosesSameMessages(t *testing.T) {
+	lost := func(seed int64) []bool {
+		network := New(seed)
+		network.SetFaults(Faults{DropRate: 0.3})
+		serveEcho(t, network, "server:1")
+		results := []bool{}
+		for i := 0; i < 30; i++ {
+			_, err := callEcho(network, "client:1", "server:1", "hello")
+			results = append(results, err != nil)
+		}
+		return results
+	}
+	first, second, other := lost(1), lost(1), lost(2)
+	losses, differences := 0, 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Call %d was lost %t then %t with the same seed", i, first[i], second[i])
+		}
+		if first[i] {
+			losses++
+		}
+		if first[i] != other[i] {
+			differences++
+		}
+	}
+	if losses == 0 || losses == len(first) {
+		t.Errorf("%d of %d calls were lost, expected some with a drop rate of 0.3", losses, len(first))
+	}
+	if differences == 0 {
+		t.Errorf("Different seeds lost the same calls")
+	}
+}
+
+func TestNetwork_CrashBreaksAndRefusesConnections(t *testing.T) {
+	network := New(1)
+	service := serveEcho(t, network, "server:1")
+	conn, err := network.Dial("client:1", "server:1", 0)
+	if err != nil {
+		t.Fatalf("Dial returned unexpected error: %s", err.Error())
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	defer close(service.release)
+	call := client.Go("Echo.Wait", "", new(string), nil)
+
+	network.Crash("server:1")
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			t.Errorf("Call to a crashed node succeeded, expected an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Call to a crashed node did not fail")
+	}
+	if _, err := callEcho(network, "client:1", "server:1", "hello"); err == nil {
+		t.Errorf("Call to a crashed node succeeded, expected it refused")
+	}
+	if _, err := callEcho(network, "server:1", "server:1", "hello"); err == nil {
+		t.Errorf("Call from a crashed node succeeded, expected it refused")
+	}
+
+	network.Restart("server:1")
+	if reply, err := callEcho(network, "client:1", "server:1", "hello"); err != nil || reply != "hello" {
+		t.Errorf("Echo after restart returned %s, error %v, expected hello", reply, err)
+	}
+}
+
+func TestNetwork_PartitionSeparatesGroups(t *testing.T) {
+	network := New(1)
+	serveEcho(t, network, "a:1")
+	serveEcho(t, network, "b:1")
+	network.Partition([]string{"a:1"}, []string{"b:1", "c:1"})
+
+	if _, err := callEcho(network, "a:1", "b:1", "hello"); err == nil {
+		t.Errorf("Call across the partition succeeded, expected it to time out")
+	}
+	if _, err := callEcho(network, "c:1", "b:1", "hello"); err != nil {
+		t.Errorf("Call within a group returned unexpected error: %s", err.Error())
+	}
+	if _, err := callEcho(network, "", "a:1", "hello"); err != nil {
+		t.Errorf("Call from a client in no group returned unexpected error: %s", err.Error())
+	}
+
+	network.Heal()
+	if _, err := callEcho(network, "a:1", "b:1", "hello"); err != nil {
+		t.Errorf("Call after healing returned unexpected error: %s", err.Error())
+	}
+}
@@ -0,0 +1,79 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Error returned by Submit for a command lost when leadership changed
+var ErrLost = errors.New("raft: leadership changed before the command was committed, try again")
+
+// Commands submitted by a service on this node, waiting to be applied, so
+// that each can be matched to the result of applying it
+type Proposals struct {
+	waiting map[uint64]*proposal // by log index
+	lock    *sync.Mutex
+}
+
+// A submitted command, waiting to be applied
+type proposal struct {
+	term  uint64           // term in which the command was appended to the log
+	reply chan interface{} // receives the result once the command is applied
+}
+
+// Returns an empty set of proposals
+func NewProposals() *Proposals {
+	return &Proposals{waiting: map[uint64]*proposal{}, lock: &sync.Mutex{}}
+}
+
+// Appends command to rf's log and waits up to timeout for the service to
+// apply it and pass its result to Finish
+// Returns the result, and false if rf is not the leader.  Returns ErrLost if
+// leadership changed before the command was committed.
+func (proposals *Proposals) Submit(rf *Raft, command []byte, timeout time.Duration) (interface{}, bool, error) {
+	// Hold the lock until the proposal is recorded, so that the command
+	// cannot be applied before it can be matched to its result
+	proposals.lock.Lock()
+	index, term, isLeader := rf.Start(command)
+	if !isLeader {
+		proposals.lock.Unlock()
+		return nil, false, nil
+	}
+	waiting := &proposal{term, make(chan interface{}, 1)}
+	proposals.waiting[index] = waiting
+	proposals.lock.Unlock()
+
+	select {
+	case result, applied := <-waiting.reply:
+		if !applied {
+			return nil, true, ErrLost
+		}
+		return result, true, nil
+	case <-time.After(timeout):
+		proposals.lock.Lock()
+		delete(proposals.waiting, index)
+		proposals.lock.Unlock()
+		return nil, true, errors.New(fmt.Sprintf("raft: command was not committed within %s", timeout))
+	}
+}
+
+// Reply to the proposals up to index, now that the entry at index has been
+// applied with the given term and result, or replaced by a snapshot if result
+// is nil.  Proposals made in a different term, or replaced by a snapshot,
+// were lost when leadership changed.
+func (proposals *Proposals) Finish(index uint64, term uint64, result interface{}) {
+	proposals.lock.Lock()
+	defer proposals.lock.Unlock()
+	for proposalIndex, waiting := range proposals.waiting {
+		if proposalIndex > index {
+			continue
+		}
+		if proposalIndex == index && waiting.term == term && result != nil {
+			waiting.reply <- result
+		}
+		close(waiting.reply)
+		delete(proposals.waiting, proposalIndex)
+	}
+}
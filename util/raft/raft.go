@@ -0,0 +1,444 @@
+// Package raft replicates a log of commands across a fixed group of nodes
+// using the Raft consensus algorithm, over net/rpc.
+//
+// A service submits commands to the leader with Start, and applies each
+// command once it is reported as committed on the service's apply channel,
+// in log order.  The service periodically passes a snapshot of its state
+// to Snapshot so that the log can be discarded; followers which have fallen
+// behind the snapshot are sent it instead of the discarded entries.
+//
+// Each node registers its Raft with an rpc.Server under the name "Raft"
+// so that the other nodes can call RequestVote, AppendEntries and
+// InstallSnapshot.
+package raft
+
+import (
+	"errors"
+	"github.com/msayson/kvservice/util/rpc_util"
+	"math/rand"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+// Roles of a node in the group
+const (
+	Follower  = "follower"
+	Candidate = "candidate"
+	Leader    = "leader"
+)
+
+// Error returned by RPC calls to a node which has been stopped
+var ErrStopped = errors.New("raft: node is stopped")
+
+// Configuration for a node
+type Options struct {
+	ElectionTimeout   time.Duration // minimum time without a leader before starting an election, randomized up to twice this
+	HeartbeatInterval time.Duration // time between AppendEntries calls from the leader to each follower
+	DataDir           string        // directory holding the node's term, vote, log and snapshot, or "" to keep them in memory only
+}
+
+// Returns the configuration used if none is given
+func DefaultOptions() Options {
+	return Options{
+		ElectionTimeout:   300 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+	}
+}
+
+// An entry in the replicated log
+type Entry struct {
+	Index   uint64
+	Term    uint64 // term of the leader which appended the entry
+	Command []byte // nil for the entry each leader appends when it is elected
+}
+
+// A committed entry or snapshot, sent to the service on its apply channel
+type ApplyMsg struct {
+	Index    uint64
+	Term     uint64
+	Command  []byte // nil if Snapshot is set, or for an entry without a command
+	Snapshot []byte // if set, the service must replace its state with this snapshot, taken at Index
+}
+
+// A single node in a Raft group
+type Raft struct {
+	self  string   // ip:port of this node
+	peers []string // ip:port of every node in the group, including this one
+	opts  Options
+	apply chan<- ApplyMsg
+
+	// Persistent state, saved before replying to any RPC call
+	currentTerm uint64
+	votedFor    string  // candidate voted for in currentTerm, or ""
+	log         []Entry // log[0] holds the index and term of the last entry in snapshot
+	snapshot    []byte
+	logFile     *os.File // log file in opts.DataDir, opened for appending new entries
+
+	// Volatile state
+	state            string
+	leader           string // ip:port of the leader of currentTerm, or "" if unknown
+	commitIndex      uint64
+	lastApplied      uint64
+	nextIndex        map[string]uint64 // leader only: next entry to send to each peer
+	matchIndex       map[string]uint64 // leader only: last entry known to be replicated on each peer
+	sending          map[string]bool   // leader only: whether a call to each peer is in progress
+	electionDeadline time.Time
+
+	clients    map[string]*rpc.Client // connection to each peer, dialled on first use
+	clientLock *sync.Mutex            // protects clients
+	lock       *sync.Mutex            // protects all other fields
+	applyCond  *sync.Cond             // signalled when there are entries to apply
+	stop       chan bool              // closed by Stop
+	stopped    bool
+}
+
+// Starts a node at ip:port self in a group of peers, which must include
+// self.  Restores the node's state from opts.DataDir if it was saved there,
+// then sends committed entries to apply until the node is stopped.
+func New(self string, peers []string, opts Options, apply chan<- ApplyMsg) (*Raft, error) {
+	rf := &Raft{
+		self:       self,
+		peers:      peers,
+		opts:       opts,
+		apply:      apply,
+		log:        []Entry{{}},
+		state:      Follower,
+		clients:    map[string]*rpc.Client{},
+		clientLock: &sync.Mutex{},
+		lock:       &sync.Mutex{},
+		stop:       make(chan bool),
+	}
+	rf.applyCond = sync.NewCond(rf.lock)
+	if err := rf.restore(); err != nil {
+		return nil, err
+	}
+	rf.commitIndex = rf.snapshotIndex()
+	rf.resetElectionTimer()
+	go rf.run()
+	go rf.applyCommitted()
+	return rf, nil
+}
+
+// Appends command to the log if this node is the leader
+// Returns the index the command will have if it is committed, the current
+// term, and whether this node is the leader.  The command may still be lost
+// if leadership changes before it is committed, in which case a different
+// entry, or one with a different term, is applied at its index.
+func (rf *Raft) Start(command []byte) (uint64, uint64, bool) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.state != Leader || rf.stopped {
+		return 0, rf.currentTerm, false
+	}
+	index := rf.appendEntry(command)
+	rf.broadcast()
+	return index, rf.currentTerm, true
+}
+
+// Returns the current term, whether this node is the leader, and the
+// ip:port of the leader if known
+func (rf *Raft) State() (uint64, bool, string) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return rf.currentTerm, rf.state == Leader, rf.leader
+}
+
+// Returns the number of log entries since the last snapshot
+func (rf *Raft) LogLength() int {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return len(rf.log) - 1
+}
+
+// Discards the log up to and including index, which the service has
+// applied and included in snapshot
+func (rf *Raft) Snapshot(index uint64, snapshot []byte) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if index <= rf.snapshotIndex() || index > rf.lastApplied {
+		return
+	}
+	rf.log = append([]Entry{{Index: index, Term: rf.entry(index).Term}}, rf.log[index-rf.snapshotIndex()+1:]...)
+	rf.snapshot = snapshot
+	rf.persistSnapshot()
+	rf.persistLog()
+}
+
+// Stops the node: it no longer takes part in elections, sends entries to
+// apply, or replies to RPC calls
+func (rf *Raft) Stop() {
+	rf.lock.Lock()
+	if !rf.stopped {
+		rf.stopped = true
+		close(rf.stop)
+		rf.applyCond.Broadcast()
+		rf.closeLog()
+	}
+	rf.lock.Unlock()
+
+	rf.clientLock.Lock()
+	defer rf.clientLock.Unlock()
+	for peer, client := range rf.clients {
+		client.Close()
+		delete(rf.clients, peer)
+	}
+}
+
+// Struct for RequestVote() RPC call arguments
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateId  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// Struct for RequestVote() RPC call replies
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// RequestVote RPC call: votes for a candidate whose log is at least as
+// up to date as this node's, if this node has not voted for another
+// candidate in the same term
+func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.stopped {
+		return ErrStopped
+	}
+	if args.Term > rf.currentTerm {
+		rf.becomeFollower(args.Term)
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm || (rf.votedFor != "" && rf.votedFor != args.CandidateId) {
+		return nil
+	}
+	lastIndex, lastTerm := rf.lastIndex(), rf.entry(rf.lastIndex()).Term
+	if args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex) {
+		rf.votedFor = args.CandidateId
+		rf.persist()
+		rf.resetElectionTimer()
+		reply.VoteGranted = true
+	}
+	return nil
+}
+
+// Start elections when no leader has been heard from within the election
+// timeout, and send heartbeats while leading, until the node is stopped
+func (rf *Raft) run() {
+	ticker := time.NewTicker(rf.opts.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rf.stop:
+			return
+		case <-ticker.C:
+		}
+		rf.lock.Lock()
+		if rf.state == Leader {
+			rf.broadcast()
+		} else if time.Now().After(rf.electionDeadline) {
+			rf.startElection()
+		}
+		rf.lock.Unlock()
+	}
+}
+
+// Become a candidate in the next term and request votes from every peer
+// Caller must hold the lock
+func (rf *Raft) startElection() {
+	rf.currentTerm++
+	rf.state = Candidate
+	rf.votedFor = rf.self
+	rf.leader = ""
+	rf.persist()
+	rf.resetElectionTimer()
+
+	args := RequestVoteArgs{
+		Term:         rf.currentTerm,
+		CandidateId:  rf.self,
+		LastLogIndex: rf.lastIndex(),
+		LastLogTerm:  rf.entry(rf.lastIndex()).Term,
+	}
+	votes := 1
+	if votes > len(rf.peers)/2 {
+		rf.becomeLeader()
+		return
+	}
+	for _, peer := range rf.otherPeers() {
+		go func(peer string) {
+			reply := RequestVoteReply{}
+			if !rf.call(peer, "Raft.RequestVote", &args, &reply) {
+				return
+			}
+			rf.lock.Lock()
+			defer rf.lock.Unlock()
+			if reply.Term > rf.currentTerm {
+				rf.becomeFollower(reply.Term)
+			}
+			if !reply.VoteGranted || rf.state != Candidate || rf.currentTerm != args.Term {
+				return
+			}
+			votes++
+			if votes > len(rf.peers)/2 {
+				rf.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// Lead the current term, appending an entry without a command so that
+// entries from earlier terms are committed as soon as possible
+// Caller must hold the lock
+func (rf *Raft) becomeLeader() {
+	rf.state = Leader
+	rf.leader = rf.self
+	rf.nextIndex = map[string]uint64{}
+	rf.matchIndex = map[string]uint64{}
+	rf.sending = map[string]bool{}
+	for _, peer := range rf.otherPeers() {
+		rf.nextIndex[peer] = rf.lastIndex() + 1
+	}
+	rf.appendEntry(nil)
+	rf.broadcast()
+}
+
+// Follow the leader of term, which is at least the current term
+// Caller must hold the lock
+func (rf *Raft) becomeFollower(term uint64) {
+	if term > rf.currentTerm {
+		rf.currentTerm = term
+		rf.votedFor = ""
+		rf.leader = ""
+		rf.persist()
+	}
+	rf.state = Follower
+}
+
+// Append an entry for command in the current term, returning its index
+// Caller must hold the lock
+func (rf *Raft) appendEntry(command []byte) uint64 {
+	index := rf.lastIndex() + 1
+	rf.log = append(rf.log, Entry{Index: index, Term: rf.currentTerm, Command: command})
+	rf.persistEntries(rf.log[len(rf.log)-1])
+	rf.advanceCommitIndex()
+	return index
+}
+
+// Send committed entries, or the snapshot if it is ahead of them, to the
+// apply channel in order until the node is stopped
+func (rf *Raft) applyCommitted() {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	for {
+		for !rf.stopped && rf.lastApplied >= rf.commitIndex {
+			rf.applyCond.Wait()
+		}
+		if rf.stopped {
+			return
+		}
+		var msg ApplyMsg
+		if rf.lastApplied < rf.snapshotIndex() {
+			msg = ApplyMsg{Index: rf.snapshotIndex(), Term: rf.log[0].Term, Snapshot: rf.snapshot}
+		} else {
+			entry := rf.entry(rf.lastApplied + 1)
+			msg = ApplyMsg{Index: entry.Index, Term: entry.Term, Command: entry.Command}
+		}
+		rf.lastApplied = msg.Index
+
+		rf.lock.Unlock()
+		select {
+		case rf.apply <- msg:
+		case <-rf.stop:
+		}
+		rf.lock.Lock()
+	}
+}
+
+// Choose a new random time to start an election if no leader is heard from
+// Caller must hold the lock
+func (rf *Raft) resetElectionTimer() {
+	timeout := rf.opts.ElectionTimeout + time.Duration(rand.Int63n(int64(rf.opts.ElectionTimeout)))
+	rf.electionDeadline = time.Now().Add(timeout)
+}
+
+// Returns the ip:port of every other node in the group
+func (rf *Raft) otherPeers() []string {
+	others := []string{}
+	for _, peer := range rf.peers {
+		if peer != rf.self {
+			others = append(others, peer)
+		}
+	}
+	return others
+}
+
+// Returns the index of the last entry in the log or snapshot
+// Caller must hold the lock
+func (rf *Raft) lastIndex() uint64 {
+	return rf.log[len(rf.log)-1].Index
+}
+
+// Returns the index of the last entry in the snapshot
+// Caller must hold the lock
+func (rf *Raft) snapshotIndex() uint64 {
+	return rf.log[0].Index
+}
+
+// Returns the entry at index, which must be in the log, or be the last
+// entry in the snapshot in which case only its index and term are known
+// Caller must hold the lock
+func (rf *Raft) entry(index uint64) Entry {
+	return rf.log[index-rf.snapshotIndex()]
+}
+
+// Call method on peer, returning whether it replied within the election
+// timeout.  Connections are reused until a call on them fails.
+func (rf *Raft) call(peer string, method string, args interface{}, reply interface{}) bool {
+	rf.clientLock.Lock()
+	client := rf.clients[peer]
+	rf.clientLock.Unlock()
+	if client == nil {
+		var err error
+		if client, err = rpc_util.DialFrom(rf.self, peer, rf.opts.ElectionTimeout); err != nil {
+			return false
+		}
+		rf.clientLock.Lock()
+		if rf.clients[peer] != nil || rf.isStopped() {
+			client.Close()
+			client = rf.clients[peer]
+		} else {
+			rf.clients[peer] = client
+		}
+		rf.clientLock.Unlock()
+		if client == nil {
+			return false
+		}
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			return true
+		}
+	case <-time.After(rf.opts.ElectionTimeout):
+	}
+	rf.clientLock.Lock()
+	if rf.clients[peer] == client {
+		delete(rf.clients, peer)
+	}
+	rf.clientLock.Unlock()
+	client.Close()
+	return false
+}
+
+// Returns whether Stop has been called
+func (rf *Raft) isStopped() bool {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return rf.stopped
+}
@@ -0,0 +1,323 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Node in a test cluster, which applies commands by appending them to a list
+type testNode struct {
+	raft      *Raft
+	listener  net.Listener
+	applied   []string // commands applied so far, in order
+	snapshots int      // number of snapshots applied
+	lock      *sync.Mutex
+	done      chan bool // closed to stop applying commands
+}
+
+// Group of nodes listening on local ports, each saving its state to its own
+// data directory so that it can be stopped and restarted
+type testCluster struct {
+	t             *testing.T
+	ipPorts       []string
+	dataDirs      []string
+	nodes         []*testNode // nil for stopped nodes
+	snapshotEvery int         // number of log entries after which each node snapshots, or 0 to never snapshot
+}
+
+func testOptions() Options {
+	return Options{
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+	}
+}
+
+// Start a cluster of n nodes
+func newTestCluster(t *testing.T, n int, snapshotEvery int) *testCluster {
+	cluster := &testCluster{t: t, nodes: make([]*testNode, n), snapshotEvery: snapshotEvery}
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		var err error
+		if listeners[i], err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatalf("Error starting test node: %s", err.Error())
+		}
+		cluster.ipPorts = append(cluster.ipPorts, listeners[i].Addr().String())
+		cluster.dataDirs = append(cluster.dataDirs, t.TempDir())
+	}
+	for i, listener := range listeners {
+		cluster.start(i, listener)
+	}
+	t.Cleanup(func() {
+		for i := range cluster.nodes {
+			cluster.stop(i)
+		}
+	})
+	return cluster
+}
+
+// Start node i serving RPC calls on listener, or on its original ip:port if
+// listener is nil
+func (cluster *testCluster) start(i int, listener net.Listener) {
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", cluster.ipPorts[i]); err != nil {
+			cluster.t.Fatalf("Error restarting test node: %s", err.Error())
+		}
+	}
+	opts := testOptions()
+	opts.DataDir = cluster.dataDirs[i]
+	applyCh := make(chan ApplyMsg)
+	rf, err := New(cluster.ipPorts[i], cluster.ipPorts, opts, applyCh)
+	if err != nil {
+		cluster.t.Fatalf("Error starting raft: %s", err.Error())
+	}
+	node := &testNode{raft: rf, listener: listener, lock: &sync.Mutex{}, done: make(chan bool)}
+	server := rpc.NewServer()
+	server.RegisterName("Raft", rf)
+	go server.Accept(listener)
+	go node.applyAll(applyCh, cluster.snapshotEvery)
+	cluster.nodes[i] = node
+}
+
+// Stop node i, as if it had failed
+func (cluster *testCluster) stop(i int) {
+	if node := cluster.nodes[i]; node != nil {
+		node.raft.Stop()
+		node.listener.Close()
+		close(node.done)
+		cluster.nodes[i] = nil
+	}
+}
+
+// Apply messages from applyCh until the node is stopped, taking a snapshot
+// once the log has snapshotEvery entries
+func (node *testNode) applyAll(applyCh <-chan ApplyMsg, snapshotEvery int) {
+	for {
+		var msg ApplyMsg
+		select {
+		case <-node.done:
+			return
+		case msg = <-applyCh:
+		}
+		node.lock.Lock()
+		if msg.Snapshot != nil {
+			node.applied = nil
+			json.Unmarshal(msg.Snapshot, &node.applied)
+			node.snapshots++
+		} else if msg.Command != nil {
+			node.applied = append(node.applied, string(msg.Command))
+		}
+		var snapshot []byte
+		if snapshotEvery > 0 && node.raft.LogLength() >= snapshotEvery {
+			snapshot, _ = json.Marshal(node.applied)
+		}
+		node.lock.Unlock()
+		if snapshot != nil {
+			node.raft.Snapshot(msg.Index, snapshot)
+		}
+	}
+}
+
+// Returns the commands applied by the node so far
+func (node *testNode) commands() []string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return append([]string{}, node.applied...)
+}
+
+// Wait up to two seconds for a single running node to lead the latest
+// term, returning its index
+func (cluster *testCluster) waitForLeader() int {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		leaders := map[uint64][]int{}
+		latest := uint64(0)
+		for i, node := range cluster.nodes {
+			if node == nil {
+				continue
+			}
+			term, isLeader, _ := node.raft.State()
+			if isLeader {
+				leaders[term] = append(leaders[term], i)
+			}
+			if term > latest {
+				latest = term
+			}
+		}
+		for term, inTerm := range leaders {
+			if len(inTerm) > 1 {
+				cluster.t.Fatalf("Nodes %v all lead term %d", inTerm, term)
+			}
+		}
+		if len(leaders[latest]) == 1 {
+			return leaders[latest][0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cluster.t.Fatalf("No leader was elected")
+	return -1
+}
+
+// Submit each command to the leader, retrying if leadership changes
+func (cluster *testCluster) submit(commands ...string) {
+	for _, command := range commands {
+		for {
+			if _, _, isLeader := cluster.nodes[cluster.waitForLeader()].raft.Start([]byte(command)); isLeader {
+				break
+			}
+		}
+	}
+}
+
+// Wait up to two seconds for every running node to have applied commands
+func (cluster *testCluster) waitForCommands(commands ...string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for i, node := range cluster.nodes {
+		if node == nil {
+			continue
+		}
+		applied := node.commands()
+		for !reflect.DeepEqual(applied, commands) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			applied = node.commands()
+		}
+		if !reflect.DeepEqual(applied, commands) {
+			cluster.t.Errorf("Node %d applied %v, expected %v", i, applied, commands)
+		}
+	}
+}
+
+// Returns commands "<prefix>0" to "<prefix><n-1>"
+func numbered(prefix string, n int) []string {
+	commands := make([]string, n)
+	for i := range commands {
+		commands[i] = fmt.Sprintf("%s%d", prefix, i)
+	}
+	return commands
+}
+
+func TestElection_ElectsStableLeader(t *testing.T) {
+	cluster := newTestCluster(t, 3, 0)
+	leader := cluster.waitForLeader()
+	term, _, _ := cluster.nodes[leader].raft.State()
+
+	time.Sleep(5 * testOptions().ElectionTimeout)
+	if current := cluster.waitForLeader(); current != leader {
+		t.Errorf("Leadership moved from node %d to %d without any failures", leader, current)
+	}
+	if current, _, _ := cluster.nodes[leader].raft.State(); current != term {
+		t.Errorf("Term advanced from %d to %d without any failures", term, current)
+	}
+	for i, node := range cluster.nodes {
+		if _, _, known := node.raft.State(); known != cluster.ipPorts[leader] {
+			t.Errorf("Node %d followed %s, expected %s", i, known, cluster.ipPorts[leader])
+		}
+	}
+}
+
+func TestStart_CommitsOnEveryNode(t *testing.T) {
+	cluster := newTestCluster(t, 3, 0)
+	commands := numbered("set-", 20)
+	cluster.submit(commands...)
+	cluster.waitForCommands(commands...)
+}
+
+func TestStart_RejectedByFollower(t *testing.T) {
+	cluster := newTestCluster(t, 3, 0)
+	follower := (cluster.waitForLeader() + 1) % 3
+	if _, _, isLeader := cluster.nodes[follower].raft.Start([]byte("set")); isLeader {
+		t.Errorf("Start on a follower accepted a command")
+	}
+}
+
+func TestElection_ReelectsAfterLeaderStops(t *testing.T) {
+	cluster := newTestCluster(t, 3, 0)
+	before := numbered("before-", 5)
+	cluster.submit(before...)
+	cluster.waitForCommands(before...)
+
+	oldLeader := cluster.waitForLeader()
+	cluster.stop(oldLeader)
+	after := numbered("after-", 5)
+	cluster.submit(after...)
+	all := append(before, after...)
+	cluster.waitForCommands(all...)
+
+	// The old leader catches up once it restarts
+	cluster.start(oldLeader, nil)
+	cluster.waitForCommands(all...)
+}
+
+func TestElection_NoProgressWithoutMajority(t *testing.T) {
+	cluster := newTestCluster(t, 3, 0)
+	leader := cluster.waitForLeader()
+	cluster.stop((leader + 1) % 3)
+	cluster.stop((leader + 2) % 3)
+	cluster.nodes[leader].raft.Start([]byte("lost"))
+
+	time.Sleep(5 * testOptions().ElectionTimeout)
+	if applied := cluster.nodes[leader].commands(); len(applied) != 0 {
+		t.Errorf("Node without a majority applied %v", applied)
+	}
+}
+
+func TestSnapshot_LaggingNodeInstallsSnapshot(t *testing.T) {
+	cluster := newTestCluster(t, 3, 5)
+	lagging := (cluster.waitForLeader() + 1) % 3
+	cluster.stop(lagging)
+	commands := numbered("set-", 30)
+	cluster.submit(commands...)
+	cluster.waitForCommands(commands...)
+
+	cluster.start(lagging, nil)
+	cluster.waitForCommands(commands...)
+	node := cluster.nodes[lagging]
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if node.snapshots == 0 {
+		t.Errorf("Lagging node caught up without installing a snapshot")
+	}
+	if length := node.raft.LogLength(); length >= 30 {
+		t.Errorf("Lagging node's log had %d entries after snapshotting every 5", length)
+	}
+}
+
+func TestNew_RestoresStateAfterRestart(t *testing.T) {
+	cluster := newTestCluster(t, 1, 3)
+	commands := numbered("set-", 10)
+	cluster.submit(commands...)
+	cluster.waitForCommands(commands...)
+	term, _, _ := cluster.nodes[0].raft.State()
+
+	cluster.stop(0)
+	cluster.start(0, nil)
+	cluster.waitForCommands(commands...)
+	if restarted, _, _ := cluster.nodes[0].raft.State(); restarted <= term {
+		t.Errorf("Term after restart was %d, expected more than %d", restarted, term)
+	}
+}
+
+func TestNew_IgnoresPartiallyWrittenEntry(t *testing.T) {
+	cluster := newTestCluster(t, 1, 0)
+	commands := numbered("set-", 5)
+	cluster.submit(commands...)
+	cluster.waitForCommands(commands...)
+
+	cluster.stop(0)
+	logFile, err := os.OpenFile(filepath.Join(cluster.dataDirs[0], logFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Error opening log file: %s", err.Error())
+	}
+	logFile.Write([]byte(`{"Index":99,"Te`))
+	logFile.Close()
+	cluster.start(0, nil)
+	cluster.waitForCommands(commands...)
+}
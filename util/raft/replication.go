@@ -0,0 +1,287 @@
+package raft
+
+// Maximum number of entries sent in one AppendEntries call
+const maxEntriesPerCall = 512
+
+// Struct for AppendEntries() RPC call arguments
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderId     string
+	PrevLogIndex uint64 // index of the entry before Entries
+	PrevLogTerm  uint64
+	Entries      []Entry // empty for a heartbeat
+	LeaderCommit uint64
+}
+
+// Struct for AppendEntries() RPC call replies
+type AppendEntriesReply struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64 // if not Success: first index the leader should send next
+}
+
+// Struct for InstallSnapshot() RPC call arguments
+type InstallSnapshotArgs struct {
+	Term              uint64
+	LeaderId          string
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	Data              []byte
+}
+
+// Struct for InstallSnapshot() RPC call replies
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+// AppendEntries RPC call: appends the leader's entries to the log if it
+// matches the leader's log up to PrevLogIndex, replacing any conflicting
+// entries, and commits entries up to LeaderCommit
+func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.stopped {
+		return ErrStopped
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+	rf.followLeader(args.Term, args.LeaderId)
+	reply.Term = rf.currentTerm
+
+	// Entries in the snapshot are committed, so they match the leader's
+	prevIndex, entries := args.PrevLogIndex, args.Entries
+	if prevIndex < rf.snapshotIndex() {
+		skip := rf.snapshotIndex() - prevIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		prevIndex, entries = prevIndex+skip, entries[skip:]
+		if prevIndex < rf.snapshotIndex() {
+			reply.Success = true
+			return nil
+		}
+	} else if prevIndex > rf.lastIndex() {
+		reply.ConflictIndex = rf.lastIndex() + 1
+		return nil
+	} else if prevTerm := rf.entry(prevIndex).Term; prevTerm != args.PrevLogTerm {
+		// Skip back over every entry from the conflicting term at once
+		conflict := prevIndex
+		for conflict > rf.snapshotIndex()+1 && rf.entry(conflict-1).Term == prevTerm {
+			conflict--
+		}
+		reply.ConflictIndex = conflict
+		return nil
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= rf.lastIndex() {
+			if rf.entry(entry.Index).Term == entry.Term {
+				continue
+			}
+			rf.log = append(rf.log[:entry.Index-rf.snapshotIndex()], entries[i:]...)
+			rf.persistLog()
+		} else {
+			rf.log = append(rf.log, entries[i:]...)
+			rf.persistEntries(entries[i:]...)
+		}
+		break
+	}
+	reply.Success = true
+
+	lastNew := prevIndex + uint64(len(entries))
+	if args.LeaderCommit > rf.commitIndex && lastNew > rf.commitIndex {
+		rf.commitIndex = args.LeaderCommit
+		if lastNew < rf.commitIndex {
+			rf.commitIndex = lastNew
+		}
+		rf.applyCond.Broadcast()
+	}
+	return nil
+}
+
+// InstallSnapshot RPC call: replaces the log with the leader's snapshot,
+// keeping any entries which follow it
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.stopped {
+		return ErrStopped
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+	rf.followLeader(args.Term, args.LeaderId)
+	reply.Term = rf.currentTerm
+	if args.LastIncludedIndex <= rf.commitIndex {
+		return nil
+	}
+
+	rf.discardLogBefore(args.LastIncludedIndex, args.LastIncludedTerm)
+	rf.snapshot = args.Data
+	rf.commitIndex = args.LastIncludedIndex
+	rf.persistSnapshot()
+	rf.persistLog()
+	rf.applyCond.Broadcast()
+	return nil
+}
+
+// Recognise leaderId as the leader of term, which is at least the current
+// term, and wait for it to be heard from again before starting an election
+// Caller must hold the lock
+func (rf *Raft) followLeader(term uint64, leaderId string) {
+	rf.becomeFollower(term)
+	rf.leader = leaderId
+	rf.resetElectionTimer()
+}
+
+// Replace the entries up to index, which has the given term, with a single
+// entry holding its index and term.  Keeps the entries after index only if
+// the log has a matching entry at index.
+// Caller must hold the lock
+func (rf *Raft) discardLogBefore(index uint64, term uint64) {
+	kept := []Entry{{Index: index, Term: term}}
+	if index > rf.snapshotIndex() && index <= rf.lastIndex() && rf.entry(index).Term == term {
+		kept = append(kept, rf.log[index-rf.snapshotIndex()+1:]...)
+	}
+	rf.log = kept
+}
+
+// Send new entries, or a heartbeat, to every peer
+// Caller must hold the lock
+func (rf *Raft) broadcast() {
+	for _, peer := range rf.otherPeers() {
+		if !rf.sending[peer] {
+			rf.sending[peer] = true
+			go rf.replicateTo(peer)
+		}
+	}
+}
+
+// Send entries to peer until it has every entry in the log, or a call
+// fails or this node stops leading.  Sends the snapshot instead if peer
+// needs entries which have been discarded.
+func (rf *Raft) replicateTo(peer string) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	for rf.state == Leader && !rf.stopped {
+		var replied bool
+		if rf.nextIndex[peer] <= rf.snapshotIndex() {
+			replied = rf.sendSnapshot(peer)
+		} else {
+			replied = rf.sendEntries(peer)
+		}
+		if !replied || rf.nextIndex[peer] > rf.lastIndex() {
+			break
+		}
+	}
+	rf.sending[peer] = false
+}
+
+// Send the entries from nextIndex onwards to peer, returning whether it
+// replied.  Releases the lock during the call.
+// Caller must hold the lock
+func (rf *Raft) sendEntries(peer string) bool {
+	next := rf.nextIndex[peer]
+	end := rf.lastIndex() + 1
+	if end-next > maxEntriesPerCall {
+		end = next + maxEntriesPerCall
+	}
+	args := AppendEntriesArgs{
+		Term:         rf.currentTerm,
+		LeaderId:     rf.self,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  rf.entry(next - 1).Term,
+		Entries:      append([]Entry{}, rf.log[next-rf.snapshotIndex():end-rf.snapshotIndex()]...),
+		LeaderCommit: rf.commitIndex,
+	}
+	reply := AppendEntriesReply{}
+	rf.lock.Unlock()
+	replied := rf.call(peer, "Raft.AppendEntries", &args, &reply)
+	rf.lock.Lock()
+	if !replied || !rf.stillLeading(args.Term, reply.Term) {
+		return false
+	}
+
+	if reply.Success {
+		rf.matched(peer, args.PrevLogIndex+uint64(len(args.Entries)))
+	} else if reply.ConflictIndex > rf.matchIndex[peer] {
+		rf.nextIndex[peer] = reply.ConflictIndex
+	} else {
+		rf.nextIndex[peer] = rf.matchIndex[peer] + 1
+	}
+	return true
+}
+
+// Send the snapshot to peer, returning whether it replied
+// Releases the lock during the call.
+// Caller must hold the lock
+func (rf *Raft) sendSnapshot(peer string) bool {
+	args := InstallSnapshotArgs{
+		Term:              rf.currentTerm,
+		LeaderId:          rf.self,
+		LastIncludedIndex: rf.snapshotIndex(),
+		LastIncludedTerm:  rf.log[0].Term,
+		Data:              rf.snapshot,
+	}
+	reply := InstallSnapshotReply{}
+	rf.lock.Unlock()
+	replied := rf.call(peer, "Raft.InstallSnapshot", &args, &reply)
+	rf.lock.Lock()
+	if !replied || !rf.stillLeading(args.Term, reply.Term) {
+		return false
+	}
+	rf.matched(peer, args.LastIncludedIndex)
+	return true
+}
+
+// Returns whether this node still leads the term in which it made a call,
+// after a peer replied from replyTerm, stepping down if the peer has seen
+// a later term
+// Caller must hold the lock
+func (rf *Raft) stillLeading(callTerm uint64, replyTerm uint64) bool {
+	if replyTerm > rf.currentTerm {
+		rf.becomeFollower(replyTerm)
+		return false
+	}
+	return rf.state == Leader && rf.currentTerm == callTerm
+}
+
+// Record that peer's log matches this node's up to index, and commit any
+// entries now replicated on a majority of nodes
+// Caller must hold the lock
+func (rf *Raft) matched(peer string, index uint64) {
+	if index > rf.matchIndex[peer] {
+		rf.matchIndex[peer] = index
+	}
+	if rf.nextIndex[peer] <= rf.matchIndex[peer] {
+		rf.nextIndex[peer] = rf.matchIndex[peer] + 1
+	}
+	rf.advanceCommitIndex()
+}
+
+// Commit the latest entry from the current term that is replicated on a
+// majority of nodes, along with every entry before it.  Entries from earlier
+// terms are only committed this way, as a majority holding them does not
+// prevent a later leader from replacing them.
+// Caller must hold the lock
+func (rf *Raft) advanceCommitIndex() {
+	for index := rf.lastIndex(); index > rf.commitIndex && index > rf.snapshotIndex(); index-- {
+		if rf.entry(index).Term != rf.currentTerm {
+			return
+		}
+		replicas := 1
+		for _, match := range rf.matchIndex {
+			if match >= index {
+				replicas++
+			}
+		}
+		if replicas > len(rf.peers)/2 {
+			rf.commitIndex = index
+			rf.applyCond.Broadcast()
+			return
+		}
+	}
+}
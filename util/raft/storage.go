@@ -0,0 +1,207 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/msayson/kvservice/kvstore/persist"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const stateFileName = "raft-state.json"
+const logFileName = "raft-log.json"
+const snapshotFileName = "raft-snapshot.json"
+
+// On-disk format of a node's term and vote
+// The log is kept in a file of its own, holding one entry per line, so that
+// new entries are appended to it rather than rewriting every entry.
+type persistentState struct {
+	CurrentTerm uint64
+	VotedFor    string
+}
+
+// On-disk format of a node's snapshot
+type persistentSnapshot struct {
+	Index uint64 // index of the last entry included
+	Term  uint64
+	Data  []byte
+}
+
+// Save the node's term and vote to opts.DataDir, if set
+// A node which cannot save its state must not reply to RPC calls, as it
+// could later contradict its votes or lose committed entries, so failures
+// here are unrecoverable.
+// Caller must hold the lock
+func (rf *Raft) persist() {
+	if rf.opts.DataDir == "" {
+		return
+	}
+	state := persistentState{rf.currentTerm, rf.votedFor}
+	err := persist.WriteFileAtomic(filepath.Join(rf.opts.DataDir, stateFileName), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(state)
+	})
+	if err != nil {
+		log.Fatal("Error saving raft state:", err)
+	}
+}
+
+// Append entries just added to the end of the log to the log file, if any
+// Caller must hold the lock
+func (rf *Raft) persistEntries(entries ...Entry) {
+	if rf.logFile == nil {
+		return
+	}
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			log.Fatal("Error encoding raft log entry:", err)
+		}
+	}
+	_, err := rf.logFile.Write(buf.Bytes())
+	if err == nil {
+		err = rf.logFile.Sync()
+	}
+	if err != nil {
+		log.Fatal("Error saving raft log:", err)
+	}
+}
+
+// Rewrite the whole log file in opts.DataDir, if set, after entries were
+// removed from the log, then append later entries to the rewritten file
+// Caller must hold the lock
+func (rf *Raft) persistLog() {
+	if rf.opts.DataDir == "" {
+		return
+	}
+	logPath := filepath.Join(rf.opts.DataDir, logFileName)
+	err := persist.WriteFileAtomic(logPath, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for _, entry := range rf.log {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal("Error saving raft log:", err)
+	}
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatal("Error opening raft log:", err)
+	}
+	rf.closeLog()
+	rf.logFile = file
+}
+
+// Close the log file, if open
+// Caller must hold the lock
+func (rf *Raft) closeLog() {
+	if rf.logFile != nil {
+		rf.logFile.Close()
+		rf.logFile = nil
+	}
+}
+
+// Save the node's snapshot to opts.DataDir, if set
+// Must be called before the log that the snapshot replaces is saved.
+// Caller must hold the lock
+func (rf *Raft) persistSnapshot() {
+	if rf.opts.DataDir == "" {
+		return
+	}
+	snap := persistentSnapshot{rf.snapshotIndex(), rf.log[0].Term, rf.snapshot}
+	err := persist.WriteFileAtomic(filepath.Join(rf.opts.DataDir, snapshotFileName), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(snap)
+	})
+	if err != nil {
+		log.Fatal("Error saving raft snapshot:", err)
+	}
+}
+
+// Load the node's term, vote, log and snapshot from opts.DataDir, if set
+func (rf *Raft) restore() error {
+	if rf.opts.DataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(rf.opts.DataDir, 0755); err != nil {
+		return err
+	}
+
+	var state persistentState
+	if found, err := readJSON(filepath.Join(rf.opts.DataDir, stateFileName), &state); err != nil {
+		return err
+	} else if found {
+		rf.currentTerm, rf.votedFor = state.CurrentTerm, state.VotedFor
+	}
+	if entries, err := readLog(filepath.Join(rf.opts.DataDir, logFileName)); err != nil {
+		return err
+	} else if len(entries) > 0 {
+		rf.log = entries
+	}
+
+	var snap persistentSnapshot
+	if found, err := readJSON(filepath.Join(rf.opts.DataDir, snapshotFileName), &snap); err != nil {
+		return err
+	} else if found {
+		// The snapshot is saved first, so the log may not yet have been
+		// truncated to match it
+		if snap.Index > rf.snapshotIndex() {
+			rf.discardLogBefore(snap.Index, snap.Term)
+		}
+		rf.snapshot = snap.Data
+	}
+
+	// Rewrite the log once, without any partially written final entry or
+	// entries included in the snapshot, and append to it from then on
+	rf.persistLog()
+	return nil
+}
+
+// Read the entries in the log file at logPath, ignoring a partially written
+// final entry left by a crash
+func readLog(logPath string) ([]Entry, error) {
+	file, err := os.Open(logPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var entry Entry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return nil, errors.New(fmt.Sprintf("raft: corrupt %s: %s", logPath, err.Error()))
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Decode the JSON file at path into v, returning whether the file exists
+func readJSON(path string, v interface{}) (bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return false, errors.New(fmt.Sprintf("raft: corrupt %s: %s", path, err.Error()))
+	}
+	return true, nil
+}
@@ -5,11 +5,46 @@ import (
 	"log"
 	"net"
 	"net/rpc"
+	"sync"
 	"time"
 )
 
 var maxConnectTries = 10
 
+// Network over which RPC connections are made and served
+// Connections use TCP unless tests replace the transport, such as with a
+// memnet.Network which injects faults.
+type Transport interface {
+	// Connect to ipPort from the node at fromIpPort, or "" if the caller is
+	// not a node, giving up after timeout, or never if timeout is 0
+	Dial(fromIpPort, ipPort string, timeout time.Duration) (net.Conn, error)
+	// Listen for connections on ipPort
+	Listen(ipPort string) (net.Listener, error)
+}
+
+// Transport used for every connection
+var transport Transport = tcpTransport{}
+
+// Read/write mutex for safe concurrent access to transport
+var transportLock = &sync.RWMutex{}
+
+// Replace the transport used for every later connection, returning the
+// previous one so that it can be restored
+func SetTransport(t Transport) Transport {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	previous := transport
+	transport = t
+	return previous
+}
+
+// Returns the transport used for new connections
+func currentTransport() Transport {
+	transportLock.RLock()
+	defer transportLock.RUnlock()
+	return transport
+}
+
 // Returns an rpc connection, or an error
 // if unable to connect after a max number of tries
 func Connect(ip_port string) (*rpc.Client, error) {
@@ -20,7 +55,7 @@ func Connect(ip_port string) (*rpc.Client, error) {
 	var rpcClient *rpc.Client
 	var err error
 	for i := 0; i < maxConnectTries; i++ {
-		rpcClient, err = rpc.Dial("tcp", ip_port)
+		rpcClient, err = DialTimeout(ip_port, 0)
 		if err == nil {
 			break
 		}
@@ -31,20 +66,60 @@ func Connect(ip_port string) (*rpc.Client, error) {
 	return rpcClient, err
 }
 
+// Returns an rpc connection, or an error if unable to connect
+// within timeout. Unlike Connect, does not retry.
+func DialTimeout(ip_port string, timeout time.Duration) (*rpc.Client, error) {
+	return DialFrom("", ip_port, timeout)
+}
+
+// Returns an rpc connection made by the node at from_ip_port, or an error
+// if unable to connect within timeout
+// Naming the caller lets the transport cut off nodes which have crashed or
+// are partitioned from each other.
+func DialFrom(from_ip_port string, ip_port string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := currentTransport().Dial(from_ip_port, ip_port, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Returns a listener for connections on the given ip:port
+func Listen(ip_port string) (net.Listener, error) {
+	return currentTransport().Listen(ip_port)
+}
+
 // Serve RPC calls to incoming clients
 func ServeRpc(ip_port string) {
-	listener := initializeTcpListener(ip_port)
+	ServeRpcOn(rpc.DefaultServer, ip_port)
+}
+
+// Serve RPC calls to incoming clients with server, for services which must
+// only be reachable on the given ip:port
+func ServeRpcOn(server *rpc.Server, ip_port string) {
+	listener := initializeListener(ip_port)
 	for {
 		conn, _ := listener.Accept()
-		go rpc.ServeConn(conn)
+		go server.ServeConn(conn)
 	}
 }
 
-// Initialize a TCP listener on the given ip:port
-func initializeTcpListener(ip_port string) net.Listener {
-	listener, err := net.Listen("tcp", ip_port)
+// Initialize a listener on the given ip:port
+func initializeListener(ip_port string) net.Listener {
+	listener, err := Listen(ip_port)
 	if err != nil {
 		log.Fatal("Error initializing listener:", err)
 	}
 	return listener
 }
+
+// Transport over TCP, ignoring who is connecting
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(fromIpPort, ipPort string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", ipPort, timeout)
+}
+
+func (tcpTransport) Listen(ipPort string) (net.Listener, error) {
+	return net.Listen("tcp", ipPort)
+}
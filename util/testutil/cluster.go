@@ -0,0 +1,61 @@
+// Package testutil holds helpers for tests which run a cluster of the
+// service's binaries, such as variation2's back-end nodes, which each keep
+// their state in package variables and so cannot share one process
+// It is only imported by tests.
+package testutil
+
+import (
+	"net"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Build the main package at path, relative to the test's package directory,
+// returning the binary's path
+func Build(t testing.TB, path string) string {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		t.Fatalf("Error finding %s: %s", path, err.Error())
+	}
+	binary := filepath.Join(t.TempDir(), filepath.Base(dir))
+	if output, err := exec.Command("go", "build", "-o", binary, path).CombinedOutput(); err != nil {
+		t.Fatalf("Error building %s: %s\n%s", path, err.Error(), output)
+	}
+	return binary
+}
+
+// Returns an ip:port on the loopback interface which was free when checked
+func FreeIpPort(t testing.TB) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error finding a free port: %s", err.Error())
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// Start binary with args, killing it when the test finishes
+func Start(t testing.TB, binary string, args ...string) *exec.Cmd {
+	cmd := exec.Command(binary, args...)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Error starting %s: %s", binary, err.Error())
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd
+}
+
+// Wait up to timeout for ready to return true, failing the test otherwise
+func WaitFor(t testing.TB, timeout time.Duration, what string, ready func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -9,15 +9,40 @@ import (
 
 var GET string = "get"
 var SET string = "set"
+var SETTTL string = "setttl"
+var MGET string = "mget"
+var MSET string = "mset"
 var TESTSET string = "testset"
+var CAS string = "cas"
+var DELETE string = "delete"
+var SCAN string = "scan"
+var WATCH string = "watch"
+var MOVE string = "move"
+var ADDSHARD string = "addshard"
+var REMOVESHARD string = "removeshard"
 var EXIT string = "exit"
 
 var legalWord string = "([a-zA-Z0-9_]+)"
+var legalNumber string = "([0-9]+)"
+var legalPrefix string = "([a-zA-Z0-9_]*)"
 var legalGet string = fmt.Sprintf("(%s)\\(%s\\)", GET, legalWord)
 var legalSet string = fmt.Sprintf("(%s)\\(%s,%s\\)", SET, legalWord, legalWord)
+var legalMGet string = fmt.Sprintf("(%s)\\(%s(,%s)*\\)", MGET, legalWord, legalWord)
+var legalMSet string = fmt.Sprintf("(%s)\\(%s,%s(,%s,%s)*\\)", MSET, legalWord, legalWord, legalWord, legalWord)
+var legalSetTTL string = fmt.Sprintf("(%s)\\(%s,%s,%s\\)", SETTTL, legalWord, legalWord, legalNumber)
 var legalTestSet string = fmt.Sprintf("(%s)\\(%s,%s,%s\\)", TESTSET, legalWord, legalWord, legalWord)
 
-var legalCommands string = fmt.Sprintf("^(%s|%s|%s)$", legalGet, legalSet, legalTestSet)
+var legalCAS string = fmt.Sprintf("(%s)\\(%s,%s,%s\\)", CAS, legalWord, legalNumber, legalWord)
+var legalDelete string = fmt.Sprintf("(%s)\\(%s\\)", DELETE, legalWord)
+var legalScan string = fmt.Sprintf("(%s)\\(%s\\)", SCAN, legalPrefix)
+var legalWatch string = fmt.Sprintf("(%s)\\(%s\\)", WATCH, legalWord)
+var legalMove string = fmt.Sprintf("(%s)\\(%s,%s\\)", MOVE, legalWord, legalWord)
+var legalAddShard string = fmt.Sprintf("(%s)\\(%s\\)", ADDSHARD, legalWord)
+var legalRemoveShard string = fmt.Sprintf("(%s)\\(%s\\)", REMOVESHARD, legalWord)
+
+var legalCommands string = fmt.Sprintf("^(%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s)$",
+	legalGet, legalSet, legalMGet, legalMSet, legalSetTTL, legalTestSet, legalCAS, legalDelete, legalScan, legalWatch, legalMove,
+	legalAddShard, legalRemoveShard)
 
 type LegalCommand struct {
 	Command string
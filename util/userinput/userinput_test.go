@@ -26,17 +26,47 @@ func TestIsLegalCommand(t *testing.T) {
 		{"set", false},
 		{"set(hello)1", false},
 		{"set(Hello_123,MyVal123)123", false},
+		{"mget(a)", true},
+		{"mget(a,b,c)", true},
+		{"mget()", false},
+		{"mget(a,)", false},
+		{"mset(a,1)", true},
+		{"mset(a,1,b,2)", true},
+		{"mset(a,1,b)", false},
+		{"mset()", false},
+		{"setttl(Hello_123,MyVal123,30)", true},
+		{"setttl(Hello_123,MyVal123,abc)", false},
+		{"setttl(Hello_123,MyVal123)", false},
+		{"setttl(Hello_123,MyVal123,-5)", false},
 		{"testset(Hello_123,MyVal123,NewVal123)", true},
 		{"testset(Hello_123,a,b,c)", false},
 		{"testset(Hello_123,a)", false},
 		{"testset(Hello_123,)", false},
 		{"testset(Hello_123)", false},
+		{"cas(Hello_123,4,NewVal123)", true},
+		{"cas(Hello_123,abc,NewVal123)", false},
+		{"cas(Hello_123,4)", false},
+		{"delete(Hello_123)", true},
+		{"delete(Hello_123,MyVal123)", false},
+		{"delete()", false},
+		{"delete(hi", false},
+		{"scan(user_)", true},
+		{"scan()", true},
+		{"scan(a,b)", false},
+		{"watch(Hello_123)", true},
+		{"watch()", false},
+		{"move(Hello_123,Bye_123)", true},
+		{"move(Hello_123)", false},
+		{"addshard(shard_2)", true},
+		{"addshard()", false},
+		{"removeshard(shard_2)", true},
+		{"removeshard(shard_2,shard_3)", false},
 	}
 	for _, test := range testCases {
 		input := test.input
 		expected := test.expectedLegality
 		if IsLegalCommand(input) != expected {
-			t.Errorf("IsLegalCommand(%s) returned %b, expected %b",
+			t.Errorf("IsLegalCommand(%s) returned %t, expected %t",
 				input, !expected, expected)
 		}
 	}
@@ -51,6 +81,17 @@ func TestParseCommand(t *testing.T) {
 		{"get(Hello123)", "get", []string{"Hello123"}},
 		{"set(Hello123,MyVal)", "set", []string{"Hello123", "MyVal"}},
 		{"testset(Hello123,OldVal,NewVal)", "testset", []string{"Hello123", "OldVal", "NewVal"}},
+		{"mget(a,b,c)", "mget", []string{"a", "b", "c"}},
+		{"mset(a,1,b,2)", "mset", []string{"a", "1", "b", "2"}},
+		{"setttl(Hello123,MyVal,60)", "setttl", []string{"Hello123", "MyVal", "60"}},
+		{"cas(Hello123,7,NewVal)", "cas", []string{"Hello123", "7", "NewVal"}},
+		{"delete(Hello123)", "delete", []string{"Hello123"}},
+		{"scan(user_)", "scan", []string{"user_"}},
+		{"scan()", "scan", []string{}},
+		{"watch(Hello123)", "watch", []string{"Hello123"}},
+		{"move(Hello123,Bye123)", "move", []string{"Hello123", "Bye123"}},
+		{"addshard(shard_2)", "addshard", []string{"shard_2"}},
+		{"removeshard(shard_2)", "removeshard", []string{"shard_2"}},
 		{" get(Hello123)   ", "get", []string{"Hello123"}}, //trims whitespace
 	}
 	for _, test := range testCases {
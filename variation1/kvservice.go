@@ -3,30 +3,52 @@
 // Supported operations:
 // - get(key)
 // - set(key,val)
+// - setttl(key,val,seconds)
+// - mget(key1,key2,...)
+// - mset(key1,val1,key2,val2,...)
 // - testset(key,testval,newval)
+// - cas(key,version,newval)
+// - delete(key)
+// - move(key,newkey)
+// - scan(prefix)
+// - watch(key)
 //
-// Usage: go run kvservice.go [ip:port]
+// Usage: go run kvservice.go [--data-dir dir] [--fsync=true] [--snapshot-interval 1m] [ip:port]
 //
 // - [ip:port] : the IP address and TCP port to use to listen for connections
+// - [--data-dir dir] : if given, persist key-values to a write-ahead log in dir
+//   and recover them on startup
+// - [--fsync] : sync the write-ahead log to disk before acknowledging each write
+// - [--snapshot-interval] : time between snapshots that truncate the write-ahead log
 
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/msayson/kvservice/api"
 	"github.com/msayson/kvservice/kvstore"
+	"github.com/msayson/kvservice/kvstore/persist"
 	"github.com/msayson/kvservice/util/rpc_util"
+	"log"
 	"net/rpc"
 	"os"
+	"time"
 )
 
 type KeyValService int
 
 var store *kvstore.KVStore
 
+// Recent changes to store, for Watch RPC calls
+var watcher *kvstore.Watcher
+
+// Number of recent changes kept for clients watching for changes
+const watchHistorySize = 10000
+
 // Get RPC Call
 func (kvs *KeyValService) Get(args *api.GetArgs, reply *api.ValReply) error {
-	reply.Val = store.Get(args.Key)
+	reply.Val, reply.Version, reply.Found = store.LookupVersion(args.Key)
 	return nil
 }
 
@@ -36,26 +58,99 @@ func (kvs *KeyValService) Set(args *api.SetArgs, reply *api.ValReply) error {
 	return nil
 }
 
+// MultiGet RPC Call
+func (kvs *KeyValService) MultiGet(args *api.MultiGetArgs, reply *api.MultiReply) error {
+	reply.Entries = store.MultiGet(args.Keys)
+	return nil
+}
+
+// MultiSet RPC Call
+func (kvs *KeyValService) MultiSet(args *api.MultiSetArgs, reply *api.MultiReply) error {
+	reply.Entries = store.MultiSet(args.Entries)
+	return nil
+}
+
+// SetTTL RPC Call
+func (kvs *KeyValService) SetTTL(args *api.SetTTLArgs, reply *api.ValReply) error {
+	reply.Val = store.SetWithTTL(args.Key, args.Val, args.TTL)
+	return nil
+}
+
 // TestSet RPC Call
 func (kvs *KeyValService) TestSet(args *api.TestSetArgs, reply *api.ValReply) error {
 	reply.Val = store.TestSet(args.Key, args.TestVal, args.NewVal)
 	return nil
 }
 
-func parseRuntimeParams() string {
-	usage := fmt.Sprintf("Usage: %s ip:port\n", os.Args[0])
-	if len(os.Args) != 2 {
-		fmt.Printf(usage)
+// CompareAndSwap RPC Call
+func (kvs *KeyValService) CompareAndSwap(args *api.CompareAndSwapArgs, reply *api.CompareAndSwapReply) error {
+	var err error
+	reply.Version, err = store.CompareAndSwap(args.Key, args.ExpectedVersion, args.NewVal)
+	reply.Swapped = err == nil
+	return nil
+}
+
+// Scan RPC Call
+func (kvs *KeyValService) Scan(args *api.ScanArgs, reply *api.ScanReply) error {
+	reply.Entries, reply.NextKey = store.Scan(args.StartKey, args.EndKey, args.Limit)
+	return nil
+}
+
+// Watch RPC Call
+func (kvs *KeyValService) Watch(args *api.WatchArgs, reply *api.WatchReply) error {
+	var err error
+	reply.Events, reply.NextVersion, err = watcher.Wait(args.Key, args.IsPrefix, args.SinceVersion, args.Timeout)
+	reply.Compacted = err == kvstore.ErrHistoryCompacted
+	return nil
+}
+
+// Txn RPC Call
+func (kvs *KeyValService) Txn(args *api.TxnArgs, reply *api.TxnReply) error {
+	result, err := store.Txn(kvstore.Txn(*args))
+	*reply = api.TxnReply(result)
+	return err
+}
+
+// Delete RPC Call
+func (kvs *KeyValService) Delete(args *api.DeleteArgs, reply *api.ValReply) error {
+	reply.Found = store.Delete(args.Key)
+	return nil
+}
+
+// Returns ip:port to listen on, and persistence options
+// (an empty DataDir means key-values are kept in memory only)
+func parseRuntimeParams() (string, persist.Options) {
+	var opts persist.Options
+	flag.StringVar(&opts.DataDir, "data-dir", "", "persist key-values to a write-ahead log in this directory")
+	flag.BoolVar(&opts.Fsync, "fsync", true, "sync the write-ahead log to disk before acknowledging each write")
+	flag.DurationVar(&opts.SnapshotInterval, "snapshot-interval", time.Minute, "time between snapshots, or 0 to disable")
+	flag.Usage = func() {
+		fmt.Printf("Usage: %s [options] ip:port\n\nOPTIONS\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
-	return os.Args[1]
+	return flag.Arg(0), opts
 }
 
 func main() {
-	ip_port := parseRuntimeParams()
+	ip_port, persistOpts := parseRuntimeParams()
 
-	// Setup key-value store and register service.
+	// Setup key-value store, recovering it from disk if enabled, and register service.
+	// Expired keys are only evicted once recovery has finished, since the
+	// store must not be in use while it is recovered.
 	store = kvstore.New()
+	if persistOpts.DataDir != "" {
+		_, err := persist.Open(store, persistOpts)
+		if err != nil {
+			log.Fatal("Error recovering key-value store:", err)
+		}
+	}
+	store.StartReaper(time.Second)
+	watcher = kvstore.NewWatcher(store, watchHistorySize)
 	kvservice := new(KeyValService)
 	rpc.Register(kvservice)
 
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/msayson/kvservice/kvstore"
+	"github.com/msayson/kvservice/util/linearizability"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+// Serve the key-value service from an empty store on a free port
+// Returns the service's ip:port.
+func startService(t *testing.T) string {
+	store = kvstore.New()
+	watcher = kvstore.NewWatcher(store, watchHistorySize)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting key-value service: %s", err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := rpc.NewServer()
+	server.Register(new(KeyValService))
+	go server.Accept(listener)
+	return listener.Addr().String()
+}
+
+func TestKeyValService_IsLinearizable(t *testing.T) {
+	ipPort := startService(t)
+	history, err := linearizability.DefaultWorkload().Run(func(int) (*rpc.Client, error) {
+		return rpc.Dial("tcp", ipPort)
+	})
+	if err != nil {
+		t.Fatalf("Error running workload: %s", err.Error())
+	}
+	if err := linearizability.Check(history.Operations()); err != nil {
+		t.Error(err.Error())
+	}
+}
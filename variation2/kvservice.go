@@ -3,70 +3,283 @@
 // Supported operations:
 // - get(key)
 // - set(key,val)
+// - setttl(key,val,seconds)
+// - mget(key1,key2,...)
+// - mset(key1,val1,key2,val2,...)
 // - testset(key,testval,newval)
+// - cas(key,version,newval)
+// - delete(key)
+// - move(key,newkey)
+// - scan(prefix)
+// - watch(key)
 //
-// Usage: go run kvservice.go [ip:port] [backend ip:port]
+// Usage: go run kvservice.go [ip:port] [backend ip:port] [--peers ip:port,...] [--data-dir dir] [--sharded]
+//          [--quorum] [--replicas 3] [--read-quorum 2] [--write-quorum 2] [--replica-timeout 1s]
+//          [--heartbeat-interval 1s] [--suspect-timeout 3s] [--dead-timeout 5s]
 //
 // - [ip:port] : the IP address and TCP port to use to listen for client connections
 // - [backend ip:port] : the IP address and TCP port to use to listen for backend connections
+// - [--peers] : backend ip:port of every replicated front-end, including this one.
+//   The front-ends elect a leader with Raft, which decides the chain's membership
+//   once a majority of front-ends have agreed to each change.
+// - [--data-dir] : with --peers, save the front-ends' log of membership changes in
+//   this directory and recover it on restart
+// - [--sharded] : spread keys across several chains, one per shard named by the
+//   nodes when they join, using a consistent-hash ring.  Shards are placed on and
+//   taken off the ring with the AddShard and RemoveShard RPC calls, moving their
+//   keys.  Cannot be combined with --peers.
+// - [--quorum] : instead of a chain, replicate each key on --replicas nodes chosen by a
+//   consistent-hash ring, waiting for --write-quorum of them to apply each write and
+//   --read-quorum of them to reply to each read, with the latest write winning.
+//   Writes are versioned by the clock of the front-end receiving them, so with
+//   several front-ends, last writer wins only as far as their clocks agree, and
+//   a write through a front-end whose clock is behind can be lost.
+//   TestSet, CompareAndSwap, Txn, Scan and Watch are not supported.  Cannot be
+//   combined with --peers or --sharded.
+// - [--replica-timeout] : quorum only: time allowed for each node's reply
+// - [--heartbeat-interval] : time between heartbeats to the nodes,
+//   or with --quorum, between attempts to hand off writes to nodes which are down
+// - [--suspect-timeout] : time without a heartbeat reply before a node is suspected
+// - [--dead-timeout] : time without a heartbeat reply before a node is removed from the chain
 
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/util/raft"
 	"github.com/msayson/kvservice/util/rpc_util"
 	"github.com/msayson/kvservice/variation2/nodechain"
+	"github.com/msayson/kvservice/variation2/quorum"
+	"github.com/msayson/kvservice/variation2/sharding"
 	"net/rpc"
 	"os"
+	"strings"
 )
 
 type KeyValService int
 
+// Key-value operations and membership changes on the network of back-end
+// nodes, served by a single chain, a chain per shard, or quorum replication
+type keyValNetwork interface {
+	Get(args *api.GetArgs, reply *api.ValReply) error
+	Set(args *api.SetArgs, reply *api.ValReply) error
+	MultiGet(args *api.MultiGetArgs, reply *api.MultiReply) error
+	MultiSet(args *api.MultiSetArgs, reply *api.MultiReply) error
+	SetTTL(args *api.SetTTLArgs, reply *api.ValReply) error
+	TestSet(args *api.TestSetArgs, reply *api.ValReply) error
+	CompareAndSwap(args *api.CompareAndSwapArgs, reply *api.CompareAndSwapReply) error
+	Scan(args *api.ScanArgs, reply *api.ScanReply) error
+	Watch(args *api.WatchArgs, reply *api.WatchReply) error
+	Txn(args *api.TxnArgs, reply *api.TxnReply) error
+	Delete(args *api.DeleteArgs, reply *api.ValReply) error
+	Join(args *api.JoinArgs, reply *api.Membership) error
+	Leave(args *api.LeaveArgs, reply *api.ValReply) error
+	Activate(args *api.JoinArgs, reply *api.ValReply) error
+}
+
 // Network of back-end nodes which store key-values
+var network keyValNetwork
+
+// The network, if it is a single chain
 var nodeChain *nodechain.NodeChain
 
+// The network, if it is sharded across several chains
+var shardedChain *sharding.ShardedChain
+
+// The network, if it replicates keys by quorum
+var quorumNetwork *quorum.QuorumNetwork
+
 // Get RPC call: retrieves a key-value from the network
 func (kvs *KeyValService) Get(args *api.GetArgs, reply *api.ValReply) error {
-	return nodeChain.Get(args, reply)
+	return network.Get(args, reply)
 }
 
 // Set RPC call: sets a key-value in the network
 func (kvs *KeyValService) Set(args *api.SetArgs, reply *api.ValReply) error {
-	return nodeChain.Set(args, reply)
+	return network.Set(args, reply)
+}
+
+// MultiGet RPC call: retrieves a batch of key-values from the network
+func (kvs *KeyValService) MultiGet(args *api.MultiGetArgs, reply *api.MultiReply) error {
+	return network.MultiGet(args, reply)
+}
+
+// MultiSet RPC call: sets a batch of key-values in the network
+func (kvs *KeyValService) MultiSet(args *api.MultiSetArgs, reply *api.MultiReply) error {
+	return network.MultiSet(args, reply)
+}
+
+// SetTTL RPC call: sets a key-value in the network that expires after a time-to-live
+func (kvs *KeyValService) SetTTL(args *api.SetTTLArgs, reply *api.ValReply) error {
+	return network.SetTTL(args, reply)
 }
 
 // TestSet RPC call: test-sets a key-value in the network
 func (kvs *KeyValService) TestSet(args *api.TestSetArgs, reply *api.ValReply) error {
-	return nodeChain.TestSet(args, reply)
+	return network.TestSet(args, reply)
+}
+
+// CompareAndSwap RPC call: sets a key-value in the network if its version matches
+func (kvs *KeyValService) CompareAndSwap(args *api.CompareAndSwapArgs, reply *api.CompareAndSwapReply) error {
+	return network.CompareAndSwap(args, reply)
+}
+
+// Scan RPC call: lists key-values in a key range from the network
+func (kvs *KeyValService) Scan(args *api.ScanArgs, reply *api.ScanReply) error {
+	return network.Scan(args, reply)
+}
+
+// Watch RPC call: waits for changes to key-values in the network
+func (kvs *KeyValService) Watch(args *api.WatchArgs, reply *api.WatchReply) error {
+	return network.Watch(args, reply)
+}
+
+// Txn RPC call: executes a multi-key transaction in the network
+func (kvs *KeyValService) Txn(args *api.TxnArgs, reply *api.TxnReply) error {
+	return network.Txn(args, reply)
+}
+
+// Delete RPC call: removes a key-value from the network
+func (kvs *KeyValService) Delete(args *api.DeleteArgs, reply *api.ValReply) error {
+	return network.Delete(args, reply)
 }
 
 // Join RPC call: add a new back-end node to the network
-func (kvs *KeyValService) Join(args *api.JoinArgs, reply *api.ValReply) error {
-	return nodeChain.Join(args, reply)
+func (kvs *KeyValService) Join(args *api.JoinArgs, reply *api.Membership) error {
+	return network.Join(args, reply)
+}
+
+// Leave RPC call: remove a back-end node from the network
+func (kvs *KeyValService) Leave(args *api.LeaveArgs, reply *api.ValReply) error {
+	return network.Leave(args, reply)
+}
+
+// Activate RPC call: route reads to a back-end node that has joined the end of the chain
+func (kvs *KeyValService) Activate(args *api.JoinArgs, reply *api.ValReply) error {
+	return network.Activate(args, reply)
+}
+
+// GetMembership RPC call: returns the members of the caller's chain and their epoch
+func (kvs *KeyValService) GetMembership(callerIpPort string, reply *api.Membership) error {
+	if shardedChain != nil {
+		return shardedChain.GetMembership(callerIpPort, reply)
+	} else if quorumNetwork != nil {
+		return quorumNetwork.GetMembership(callerIpPort, reply)
+	}
+	return nodeChain.GetMembership(reply)
+}
+
+// AddShard RPC call: place a shard on the ring, moving the keys it now owns to its chain
+func (kvs *KeyValService) AddShard(args *api.ShardArgs, reply *api.ValReply) error {
+	if shardedChain == nil {
+		return notShardedError("AddShard")
+	}
+	return shardedChain.AddShard(args, reply)
+}
+
+// RemoveShard RPC call: take a shard off the ring, moving its keys to the other shards
+func (kvs *KeyValService) RemoveShard(args *api.ShardArgs, reply *api.ValReply) error {
+	if shardedChain == nil {
+		return notShardedError("RemoveShard")
+	}
+	return shardedChain.RemoveShard(args, reply)
 }
 
 func main() {
-	client_ip_port, backend_ip_port := parseRuntimeParams()
+	client_ip_port, backend_ip_port, peers, raftOpts, sharded, quorumOpts, detectorOpts := parseRuntimeParams()
 
-	// Setup key-value service.
+	// Setup key-value service.  Back-end nodes and other front-ends connect
+	// to a separate server, which alone serves the front-ends' Raft group.
 	kvservice := new(KeyValService)
 	rpc.Register(kvservice)
+	backendServer := rpc.NewServer()
+	backendServer.Register(kvservice)
 
-	// Listen for backend node connections in a concurrent goroutine
-	nodeChain = nodechain.New()
-	go rpc_util.ServeRpc(backend_ip_port)
+	// Catch up with the other front-ends, then listen for backend node
+	// connections in a concurrent goroutine
+	if quorumOpts != nil {
+		quorumNetwork = quorum.New(*quorumOpts)
+		quorumNetwork.StartHandoff(detectorOpts.Interval)
+		network = quorumNetwork
+	} else if sharded {
+		shardedChain = sharding.New(backend_ip_port)
+		shardedChain.StartFailureDetector(detectorOpts)
+		network = shardedChain
+	} else {
+		nodeChain = nodechain.NewFrontEnd(backend_ip_port, peers)
+		if len(peers) > 1 {
+			raftNode, _, err := nodeChain.StartAgreement(raftOpts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error recovering membership changes: %s\n", err.Error())
+				os.Exit(1)
+			}
+			backendServer.RegisterName("Raft", raftNode)
+		}
+		nodeChain.Refresh()
+		nodeChain.StartFailureDetector(detectorOpts)
+		network = nodeChain
+	}
+	go rpc_util.ServeRpcOn(backendServer, backend_ip_port)
 
 	// Listen for client connections
 	rpc_util.ServeRpc(client_ip_port)
 }
 
-// Returns ip:port addresses to listen on for clients and backends
-func parseRuntimeParams() (string, string) {
-	usage := fmt.Sprintf("Usage: %s [ip:port] [backend ip:port]\n", os.Args[0])
-	if len(os.Args) != 3 {
-		fmt.Printf(usage)
+// Returns ip:port addresses to listen on for clients and backends, the
+// backend ip:port addresses of all front-ends, the configuration of the
+// front-ends' Raft group, whether to shard keys across
+// several chains, the quorum configuration if replicating by quorum, and the
+// failure detector configuration
+func parseRuntimeParams() (string, string, []string, raft.Options, bool, *quorum.Options, nodechain.DetectorOptions) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	peerList := flags.String("peers", "", "comma-separated backend ip:port of every front-end, including this one")
+	raftOpts := raft.DefaultOptions()
+	flags.StringVar(&raftOpts.DataDir, "data-dir", "", "with --peers, persist the front-ends' log of membership changes in this directory")
+	sharded := flags.Bool("sharded", false, "spread keys across a chain per shard using a consistent-hash ring")
+	useQuorum := flags.Bool("quorum", false, "replicate each key on several nodes by quorum instead of a chain")
+	quorumOpts := quorum.Flags(flags)
+	detectorOpts := nodechain.DetectorFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [ip:port] [backend ip:port] [--peers ip:port,...] [--data-dir dir] [--sharded] [--quorum] [quorum options] [failure detector options]\n\nOPTIONS\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if len(os.Args) < 3 {
+		flags.Usage()
 		os.Exit(1)
 	}
-	return os.Args[1], os.Args[2]
+	flags.Parse(os.Args[3:])
+	var peers []string
+	if *peerList != "" {
+		peers = strings.Split(*peerList, ",")
+	}
+	if flags.NArg() != 0 || (len(peers) > 0 && !contains(peers, os.Args[2])) || (*sharded && len(peers) > 1) ||
+		(*useQuorum && (*sharded || len(peers) > 1)) {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if !*useQuorum {
+		return os.Args[1], os.Args[2], peers, raftOpts, *sharded, nil, *detectorOpts
+	}
+	if err := quorumOpts.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid quorum options: %s\n", err.Error())
+		os.Exit(1)
+	}
+	return os.Args[1], os.Args[2], peers, raftOpts, *sharded, quorumOpts, *detectorOpts
+}
+
+// Returns whether ipPorts includes ipPort
+func contains(ipPorts []string, ipPort string) bool {
+	for _, candidate := range ipPorts {
+		if candidate == ipPort {
+			return true
+		}
+	}
+	return false
+}
+
+func notShardedError(serviceMethod string) error {
+	return errors.New(fmt.Sprintf("%s: front-end is not sharded, restart it with --sharded", serviceMethod))
 }
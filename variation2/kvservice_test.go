@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/util/linearizability"
+	"github.com/msayson/kvservice/util/testutil"
+	"github.com/msayson/kvservice/variation2/nodechain"
+	"net"
+	"net/rpc"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Failure detector configuration for the front-end and every node, removing
+// failed nodes quickly
+var testDetectorOpts = nodechain.DetectorOptions{
+	Interval:       100 * time.Millisecond,
+	SuspectTimeout: 300 * time.Millisecond,
+	DeadTimeout:    500 * time.Millisecond,
+}
+
+// Serve a front-end for a single chain in this process, with back-end nodes
+// built from ./node running in their own processes
+// Returns the front-end's ip:port, which serves both clients and nodes, and
+// each node's process, from head to tail.
+func startChain(t *testing.T, nodes int) (string, []*exec.Cmd) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting front-end: %s", err.Error())
+	}
+	ipPort := listener.Addr().String()
+	nodeChain = nodechain.NewFrontEnd(ipPort, nil)
+	t.Cleanup(nodeChain.StartFailureDetector(testDetectorOpts))
+	network = nodeChain
+	serve(t, listener)
+
+	binary := testutil.Build(t, "./node")
+	processes := []*exec.Cmd{}
+	for i := 0; i < nodes; i++ {
+		processes = append(processes, testutil.Start(t, binary, testutil.FreeIpPort(t), ipPort,
+			"--heartbeat-interval", testDetectorOpts.Interval.String(),
+			"--suspect-timeout", testDetectorOpts.SuspectTimeout.String(),
+			"--dead-timeout", testDetectorOpts.DeadTimeout.String()))
+		testutil.WaitFor(t, 10*time.Second, "node to join the chain", func() bool {
+			membership := api.Membership{}
+			nodeChain.GetMembership(&membership)
+			return len(membership.Members) == i+1 && len(membership.Joining) == 0
+		})
+	}
+	return ipPort, processes
+}
+
+// Serve RPC calls to the front-end on listener until the test finishes, then
+// close every connection and wait for calls in progress to return, so that a
+// later test can replace the package variables the front-end uses
+func serve(t *testing.T, listener net.Listener) {
+	server := rpc.NewServer()
+	server.Register(new(KeyValService))
+	conns := map[net.Conn]bool{}
+	closed := false
+	lock := &sync.Mutex{}
+	serving := &sync.WaitGroup{}
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			if closed {
+				conn.Close()
+			} else {
+				conns[conn] = true
+				serving.Add(1)
+				go func() {
+					defer serving.Done()
+					server.ServeConn(conn)
+				}()
+			}
+			lock.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		lock.Lock()
+		closed = true
+		for conn := range conns {
+			conn.Close()
+		}
+		lock.Unlock()
+		serving.Wait()
+	})
+}
+
+// Run the default workload through the front-end at ipPort, failing the
+// test if its history is not linearizable
+func checkWorkload(t *testing.T, ipPort string) {
+	history, err := linearizability.DefaultWorkload().Run(func(int) (*rpc.Client, error) {
+		return rpc.Dial("tcp", ipPort)
+	})
+	if err != nil {
+		t.Fatalf("Error running workload: %s", err.Error())
+	}
+	if err := linearizability.Check(history.Operations()); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestChain_IsLinearizable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Runs back-end nodes in their own processes")
+	}
+	ipPort, _ := startChain(t, 3)
+	checkWorkload(t, ipPort)
+}
+
+func TestChain_IsLinearizableWhileNodeFails(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Runs back-end nodes in their own processes")
+	}
+	ipPort, processes := startChain(t, 3)
+	time.AfterFunc(100*time.Millisecond, func() { processes[1].Process.Kill() })
+	checkWorkload(t, ipPort)
+}
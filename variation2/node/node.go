@@ -3,17 +3,50 @@
 // Supported operations:
 // - get(key)
 // - set(key,val)
+// - setttl(key,val,seconds)
+// - mget(key1,key2,...)
+// - mset(key1,val1,key2,val2,...)
 // - testset(key,testval,newval)
+// - cas(key,version,newval)
+// - delete(key)
+// - move(key,newkey)
+// - scan(prefix)
+// - watch(key)
 //
-// Usage: go run node.go [ip:port] [frontend ip:port] [--debug]
+// Usage: go run node.go [ip:port] [frontend ip:port,...] [--debug] [--shard name]
+//          [--anti-entropy-interval 10s] [--replication-log-size 10000]
+//          [--heartbeat-interval 1s] [--suspect-timeout 3s] [--dead-timeout 5s]
 //
 // - [ip:port] : the IP address and TCP port to use to listen for connections
-// - [frontend ip:port] : the IP address and TCP port of the frontend server
+// - [frontend ip:port,...] : comma-separated backend IP addresses and TCP ports of the
+//   frontend servers
 // - [--debug] : if included, enables logging of activity to console
+// - [--shard] : if the front-end is sharded, the name of the shard whose chain to join
+// - [--anti-entropy-interval] : time between comparisons of key-values with the next
+//   node in the chain, repairing any differences, or 0 to never compare
+// - [--replication-log-size] : number of recent changes kept for a next node which
+//   rejoins after being removed, so it can catch up without copying every key-value
+// - [--heartbeat-interval] : time between heartbeats to the next nodes in the chain
+// - [--suspect-timeout] : time without a heartbeat reply before a node is suspected
+// - [--dead-timeout] : time without a heartbeat reply before a node is removed from the chain
+//
+// On SIGTERM or interrupt, the node leaves the network after passing on any
+// writes it has already received.
+//
+// If the node is removed from the chain while it is still running, such as
+// after being unreachable for longer than the dead timeout, it rejoins after
+// its previous predecessor and catches up on the changes it missed from the
+// predecessor's replication log.  If the predecessor no longer holds them,
+// the node rejoins at the end of the chain and copies every key-value instead.
+//
+// A front-end run with --quorum makes each node a chain of one, reading and
+// writing versioned key-values on it directly.
 
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/msayson/kvservice/api"
 	"github.com/msayson/kvservice/kvstore"
@@ -22,6 +55,11 @@ import (
 	"log"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type KeyValService int
@@ -29,93 +67,580 @@ type KeyValService int
 // Key-value store
 var store *kvstore.KVStore
 
+// Recent changes to store, for Watch RPC calls
+var watcher *kvstore.Watcher
+
+// Number of recent changes kept for clients watching for changes
+const watchHistorySize = 10000
+
 // Network of subsequent back-end nodes
 var nodeChain *nodechain.NodeChain
 
+// Closed once the node has copied the key-values of its predecessor
+var stateTransferred = make(chan bool)
+
+// Writes being applied and propagated by this node, drained before leaving
+var inFlightWrites = &sync.WaitGroup{}
+
+// Changes made to store, in the order in which they were made, waiting to be
+// passed on to the next node
+var replicationQueue *nodechain.ReplicationQueue
+
+// Held while checking and applying changes passed on by the previous node
+var applyLock = &sync.Mutex{}
+
+// Number of recent changes kept for a next node catching up after rejoining
+var replicationLogSize int
+
+// Closed once the node starts leaving the network, so that it does not rejoin
+var leaving = make(chan bool)
+
+// Hash tree over store, for comparing key-values with neighbouring nodes
+var hashTree *kvstore.HashTree
+
+// Repairs differences between this node's key-values and its successor's
+var antiEntropy *nodechain.AntiEntropy
+
+// Time between anti-entropy comparisons with the successor, or 0 for none
+var antiEntropyInterval time.Duration
+
 var debugMode bool = false
 
+// Shard whose chain to join, if the front-end is sharded
+var shard string
+
 // Get RPC call: retrieves a key-value from the network
+// Served locally unless the key has changes which the tail may not yet have
+// applied, in which case the tail's committed value is returned instead.
+// The key-value is looked up before checking for changes, which are marked
+// as soon as they are applied, so a change is never returned uncommitted.
+// The tail itself may have changes not yet applied by a new tail which is
+// still joining, so it waits for them to be applied before replying.
 func (kvs *KeyValService) Get(args *api.GetArgs, reply *api.ValReply) error {
-	reply.Val = store.Get(args.Key)
+	waitForStateTransfer()
+	reply.Val, reply.Version, reply.Found = store.LookupVersion(args.Key)
+	if replicationQueue.Dirty(args.Key) {
+		if !nodeChain.IsTail() {
+			*reply = api.ValReply{}
+			debugLog("Get(%s) is dirty, asking the tail\n", args.Key)
+			return nodeChain.GetCommitted(args, reply)
+		}
+		if err := awaitCommitted(); err != nil {
+			return err
+		}
+	}
 	debugLog("Get(%s) -> %s\n", args.Key, reply.Val)
 	return nil
 }
 
+// GetCommitted RPC call: retrieves a key-value from this node, as the tail,
+// for a node holding changes to the key which the tail may not yet have applied
+func (kvs *KeyValService) GetCommitted(args *api.GetArgs, reply *api.ValReply) error {
+	waitForStateTransfer()
+	reply.Val, reply.Version, reply.Found = store.LookupVersion(args.Key)
+	debugLog("GetCommitted(%s) -> %s\n", args.Key, reply.Val)
+	return nil
+}
+
 // Set RPC call: sets a key-value in the network
 func (kvs *KeyValService) Set(args *api.SetArgs, reply *api.ValReply) error {
+	if err := beginClientWrite(); err != nil {
+		return err
+	}
+	defer endWrite()
 	reply.Val = store.Set(args.Key, args.Val)
 	debugLog("Set(%s,%s) -> %s\n", args.Key, args.Val, reply.Val)
-	go nodeChain.Set(args, reply) // Propagate change to subsequent nodes
-	return nil
+	return replicate()
+}
+
+// MultiGet RPC call: retrieves a batch of key-values from the network
+func (kvs *KeyValService) MultiGet(args *api.MultiGetArgs, reply *api.MultiReply) error {
+	waitForStateTransfer()
+	reply.Entries = store.MultiGet(args.Keys)
+	debugLog("MultiGet(%d keys)\n", len(args.Keys))
+	return awaitCommitted()
+}
+
+// MultiSet RPC call: sets a batch of key-values in the network
+func (kvs *KeyValService) MultiSet(args *api.MultiSetArgs, reply *api.MultiReply) error {
+	if err := beginClientWrite(); err != nil {
+		return err
+	}
+	defer endWrite()
+	reply.Entries = store.MultiSet(args.Entries)
+	debugLog("MultiSet(%d entries)\n", len(args.Entries))
+	return replicate()
+}
+
+// SetTTL RPC call: sets a key-value in the network that expires after a time-to-live
+func (kvs *KeyValService) SetTTL(args *api.SetTTLArgs, reply *api.ValReply) error {
+	if err := beginClientWrite(); err != nil {
+		return err
+	}
+	defer endWrite()
+	reply.Val = store.SetWithTTL(args.Key, args.Val, args.TTL)
+	debugLog("SetTTL(%s,%s,%s) -> %s\n", args.Key, args.Val, args.TTL, reply.Val)
+	return replicate()
 }
 
 // TestSet RPC call: test-sets a key-value in the network
 func (kvs *KeyValService) TestSet(args *api.TestSetArgs, reply *api.ValReply) error {
+	if err := beginClientWrite(); err != nil {
+		return err
+	}
+	defer endWrite()
 	reply.Val = store.TestSet(args.Key, args.TestVal, args.NewVal)
 	debugLog("TestSet(%s,%s,%s) -> %s\n", args.Key, args.TestVal, args.NewVal, reply.Val)
-	go nodeChain.TestSet(args, reply) // Propagate change to subsequent nodes
+	return replicate()
+}
+
+// CompareAndSwap RPC call: sets a key-value in the network if its version matches
+func (kvs *KeyValService) CompareAndSwap(args *api.CompareAndSwapArgs, reply *api.CompareAndSwapReply) error {
+	if err := beginClientWrite(); err != nil {
+		return err
+	}
+	defer endWrite()
+	var err error
+	reply.Version, err = store.CompareAndSwap(args.Key, args.ExpectedVersion, args.NewVal)
+	reply.Swapped = err == nil
+	debugLog("CompareAndSwap(%s,%d,%s) -> %d, %t\n", args.Key, args.ExpectedVersion, args.NewVal, reply.Version, reply.Swapped)
+	return replicate()
+}
+
+// Scan RPC call: lists key-values in a key range
+func (kvs *KeyValService) Scan(args *api.ScanArgs, reply *api.ScanReply) error {
+	waitForStateTransfer()
+	reply.Entries, reply.NextKey = store.Scan(args.StartKey, args.EndKey, args.Limit)
+	debugLog("Scan(%s,%s,%d) -> %d entries\n", args.StartKey, args.EndKey, args.Limit, len(reply.Entries))
+	return awaitCommitted()
+}
+
+// Watch RPC call: waits for changes to key-values
+func (kvs *KeyValService) Watch(args *api.WatchArgs, reply *api.WatchReply) error {
+	waitForStateTransfer()
+	var err error
+	reply.Events, reply.NextVersion, err = watcher.Wait(args.Key, args.IsPrefix, args.SinceVersion, args.Timeout)
+	reply.Compacted = err == kvstore.ErrHistoryCompacted
+	debugLog("Watch(%s,%t,%d) -> %d events\n", args.Key, args.IsPrefix, args.SinceVersion, len(reply.Events))
+	return awaitCommitted()
+}
+
+// Txn RPC call: executes a multi-key transaction in the network
+func (kvs *KeyValService) Txn(args *api.TxnArgs, reply *api.TxnReply) error {
+	if err := beginClientWrite(); err != nil {
+		return err
+	}
+	defer endWrite()
+	result, err := store.Txn(kvstore.Txn(*args))
+	if err != nil {
+		return err
+	}
+	*reply = api.TxnReply(result)
+	debugLog("Txn(%v) -> %v\n", *args, *reply)
+	return replicate()
+}
+
+// Delete RPC call: removes a key-value from the network
+func (kvs *KeyValService) Delete(args *api.DeleteArgs, reply *api.ValReply) error {
+	if err := beginClientWrite(); err != nil {
+		return err
+	}
+	defer endWrite()
+	reply.Found = store.Delete(args.Key)
+	debugLog("Delete(%s) -> %t\n", args.Key, reply.Found)
+	return replicate()
+}
+
+// GetVersioned RPC call: retrieves the latest change to each key, including
+// removals, for a quorum front-end comparing replicas
+func (kvs *KeyValService) GetVersioned(args *api.MultiGetArgs, reply *api.VersionedReply) error {
+	for _, key := range args.Keys {
+		reply.Mutations = append(reply.Mutations, store.Latest(key))
+	}
+	debugLog("GetVersioned(%d keys)\n", len(args.Keys))
 	return nil
 }
 
-// Join RPC call: add a new back-end node to the network
-func (kvs *KeyValService) Join(args *api.JoinArgs, reply *api.ValReply) error {
-	return nodeChain.Join(args, reply)
+// ApplyVersioned RPC call: applies writes versioned by a quorum front-end,
+// keeping the latest version of each key
+func (kvs *KeyValService) ApplyVersioned(args *api.VersionedArgs, reply *api.VersionedReply) error {
+	beginWrite()
+	defer endWrite()
+	reply.Applied = store.ApplyNewer(args.Mutations...)
+	debugLog("ApplyVersioned(%d writes) -> %d applied\n", len(args.Mutations), reply.Applied)
+	return nil
 }
 
-// GetNextNodes RPC call: returns ip:port addresses of next nodes in chain
-func (kvs *KeyValService) GetNextNodes(_ int, reply *api.GetNextNodesReply) error {
-	return nodeChain.GetNextNodes(reply)
+// DiscardVersioned RPC call: removes copies of writes this node held for
+// another of a quorum front-end's nodes, once they have been handed off to it
+// Keys which have been written since keep their values.
+func (kvs *KeyValService) DiscardVersioned(args *api.VersionedArgs, reply *api.VersionedReply) error {
+	beginWrite()
+	defer endWrite()
+	reply.Applied = store.DiscardVersions(args.Mutations...)
+	debugLog("DiscardVersioned(%d writes) -> %d removed\n", len(args.Mutations), reply.Applied)
+	return nil
+}
+
+// Replicate RPC call: applies the changes made by writes, passed on by the
+// previous node in the chain, then passes them on to the next node
+// Changes keep the sequence numbers given by the head, so every node holds
+// the same versions.  Changes are applied strictly in order: ones already
+// applied, such as those sent again after a failure or copied during state
+// transfer, are skipped, and if any changes are missing before the ones sent,
+// none are applied and the gap is reported so the sender can send them again.
+// Writes sent with an older membership than this node's are rejected, so
+// that the sender can adopt the newer membership and send them to the right node.
+func (kvs *KeyValService) Replicate(args *api.ReplicateArgs, reply *api.ReplicateReply) error {
+	if !nodeChain.AcceptEpoch(args.Epoch, reply) {
+		debugLog("Replicate: rejected changes from epoch %d\n", args.Epoch)
+		return nil
+	}
+	if len(args.Mutations) == 0 {
+		return errors.New("Replicate: expected changes, received none")
+	}
+	beginWrite()
+	defer endWrite()
+
+	first, last := args.Mutations[0].Seq, args.Mutations[len(args.Mutations)-1].Seq
+	applyLock.Lock()
+	applied := store.Seq()
+	if first > applied+1 {
+		applyLock.Unlock()
+		debugLog("Replicate(%d-%d): missing changes after %d\n", first, last, applied)
+		reply.Gap, reply.Seq = true, applied
+		return nil
+	}
+	unapplied := args.Mutations
+	for len(unapplied) > 0 && unapplied[0].Seq <= applied {
+		unapplied = unapplied[1:]
+	}
+	store.Apply(unapplied...)
+	applyLock.Unlock()
+
+	debugLog("Replicate(%d-%d) -> applied %d changes\n", first, last, len(unapplied))
+	return replicationQueue.Wait(last)
+}
+
+// UpdateMembership RPC call: adopt the chain's membership after a change
+func (kvs *KeyValService) UpdateMembership(args *api.Membership, reply *api.ValReply) error {
+	debugLog("UpdateMembership(epoch %d: %v)\n", args.Epoch, args.Members)
+	return nodeChain.UpdateMembership(args, reply)
+}
+
+// GetSnapshot RPC call: returns a copy of all key-values, for a node joining after this one
+func (kvs *KeyValService) GetSnapshot(_ int, reply *api.SnapshotReply) error {
+	beginWrite()
+	defer endWrite()
+	reply.Entries, reply.Seq = store.Snapshot()
+	debugLog("GetSnapshot() -> %d entries\n", len(reply.Entries))
+	return nil
+}
+
+// CatchUp RPC call: returns the changes missed by the next node while it was
+// removed from the chain, if they are still in the replication log
+func (kvs *KeyValService) CatchUp(args *api.CatchUpArgs, reply *api.CatchUpReply) error {
+	waitForStateTransfer()
+	reply.Mutations, reply.Found = replicationQueue.Since(args.Seq, args.Last)
+	debugLog("CatchUp(%d) -> %d changes, found %t\n", args.Seq, len(reply.Mutations), reply.Found)
+	return nil
+}
+
+// CompareTree RPC call: reports which of the previous node's hash tree nodes
+// differ from this node's
+func (kvs *KeyValService) CompareTree(args *api.CompareTreeArgs, reply *api.CompareTreeReply) error {
+	waitForStateTransfer()
+	return antiEntropy.CompareTree(args, reply)
+}
+
+// Repair RPC call: adopts the previous node's key-values where they differ
+// from this node's
+func (kvs *KeyValService) Repair(args *api.RepairArgs, reply *api.RepairReply) error {
+	beginWrite()
+	defer endWrite()
+	err := antiEntropy.Repair(args, reply)
+	debugLog("Repair(%d buckets at seq %d) -> %d repaired, stale %t\n", len(args.Buckets), args.Seq, reply.Repaired, reply.Stale)
+	return err
+}
+
+// GetMembership RPC call: returns this node's view of the chain's membership
+func (kvs *KeyValService) GetMembership(_ string, reply *api.Membership) error {
+	return nodeChain.GetMembership(reply)
 }
 
 func main() {
-	ip_port, frontend_ip_port := parseRuntimeParams()
+	ip_port, frontend_ip_ports, detectorOpts := parseRuntimeParams()
 
 	// Setup key-value store and register service.
 	store = kvstore.New()
+	watcher = kvstore.NewWatcher(store, watchHistorySize)
 	kvservice := new(KeyValService)
 	rpc.Register(kvservice)
 
-	// Contact front-end server to join the network
-	nodeChain = nodechain.New()
-	joinNetwork(ip_port, frontend_ip_port)
+	// Listen for connections, then contact front-end server to join the network
+	nodeChain = nodechain.NewMember(ip_port, frontend_ip_ports)
+	nodeChain.StartFailureDetector(detectorOpts)
+	go rpc_util.ServeRpc(ip_port)
+	predecessorIpPort := joinNetwork(ip_port, frontend_ip_ports)
+
+	// Copy existing key-values, then start passing on changes and serving reads
+	if predecessorIpPort != "" {
+		transferState(predecessorIpPort)
+	}
+	replicationQueue = nodechain.NewReplicationQueue(nodeChain, replicationLogSize, debugLog)
+	replicationQueue.Start(store.OnMutation(replicationQueue.Push))
+	hashTree = kvstore.NewHashTree()
+	hashTree.Reset(store.Snapshot())
+	store.OnMutation(hashTree.Update)
+	antiEntropy = nodechain.NewAntiEntropy(nodeChain, store, hashTree)
+	close(stateTransferred)
+	go reapWhileHead(time.Second)
+	err := tryFrontEnds(frontend_ip_ports, func(frontend_ip_port string) error {
+		_, err := api.ActivateByIpPort(frontend_ip_port, ip_port)
+		return err
+	})
+	checkUnrecoverable(err, "Error activating node:")
+	if antiEntropyInterval > 0 {
+		antiEntropy.Start(antiEntropyInterval)
+	}
+	go watchMembership(ip_port, frontend_ip_ports, detectorOpts.Interval)
+
+	// Leave the network cleanly when asked to shut down
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM, os.Interrupt)
+	<-shutdown
+	leaveNetwork(ip_port, frontend_ip_ports)
+}
 
-	// Listen for client connections
-	rpc_util.ServeRpc(ip_port)
+// Wait for the changes made by the current write to reach subsequent nodes,
+// returning once the tail has applied them so that the write is only
+// acknowledged after it is fully replicated
+// Changes are queued as they are made, so this also waits for any later
+// changes made by concurrent writes.
+func replicate() error {
+	return replicationQueue.Wait(store.Seq())
 }
 
-// Contact the front-end server to join the network
-func joinNetwork(ip_port, frontend_ip_port string) {
-	nextNodeIpPort := frontend_ip_port
+// Evict expired keys every interval while this node is the head of the
+// chain, so that their removals are passed down the chain like any other
+// change.  Other nodes apply those removals rather than evicting keys
+// themselves, which would give their changes sequence numbers of their own.
+func reapWhileHead(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		joinResult, err := api.JoinNetworkByIpPort(nextNodeIpPort, ip_port)
-		checkUnrecoverable(err, "Error joining network:")
+		select {
+		case <-leaving:
+			return
+		case <-ticker.C:
+			if nodeChain.IsHead() {
+				beginWrite()
+				store.Reap()
+				endWrite()
+			}
+		}
+	}
+}
 
-		if joinResult == "success" {
-			debugLog("Successfully joined network\n")
+// Contact a front-end server to join the end of the chain
+// Returns the ip:port of the node before this one, or "" if this node is the head
+func joinNetwork(ip_port string, frontend_ip_ports []string) string {
+	var membership api.Membership
+	err := tryFrontEnds(frontend_ip_ports, func(frontend_ip_port string) error {
+		var err error
+		membership, err = api.JoinNetworkByIpPort(frontend_ip_port, ip_port, shard)
+		return err
+	})
+	checkUnrecoverable(err, "Error joining network:")
+	nodeChain.UpdateMembership(&membership, &api.ValReply{})
+	debugLog("Successfully joined network in epoch %d\n", membership.Epoch)
+	return nodeChain.Predecessor()
+}
+
+// Copy all key-values from the predecessor node
+// Writes forwarded by the predecessor wait for the copy to complete and are
+// then applied on top of it, so writes made during the transfer are not lost.
+func transferState(predecessorIpPort string) {
+	entries, seq, err := api.GetSnapshotByIpPort(predecessorIpPort)
+	checkUnrecoverable(err, "Error copying key-values from predecessor:")
+	store.Restore(entries, seq)
+	watcher.Restored(seq)
+	debugLog("Copied %d key-values from %s\n", len(entries), predecessorIpPort)
+}
+
+// Check whether this node is still in the chain every interval, rejoining
+// after its last known predecessor if it has been removed
+func watchMembership(ip_port string, frontend_ip_ports []string, interval time.Duration) {
+	predecessorIpPort := nodeChain.Predecessor()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-leaving:
 			return
+		case <-ticker.C:
+		}
+		nodeChain.Refresh()
+		if nodeChain.IsMember() {
+			predecessorIpPort = nodeChain.Predecessor()
+			continue
+		}
+		fmt.Printf("Removed from the chain, rejoining after %s\n", predecessorIpPort)
+		if err := rejoinNetwork(ip_port, frontend_ip_ports, predecessorIpPort); err != nil {
+			fmt.Printf("Error rejoining network, retrying: %s\n", err.Error())
+			continue
 		}
-		nextNodeIpPort = joinResult
+		predecessorIpPort = nodeChain.Predecessor()
 	}
 }
 
-// Returns ip:port to listen on, and ip:port of front-end server
-func parseRuntimeParams() (string, string) {
-	usage := fmt.Sprintf("Usage: %s [ip:port] [frontend ip:port] [--debug]\n\nOPTIONS\n"+
-		"   --debug : Enable activity logging to standard output\n", os.Args[0])
-	if len(os.Args) < 3 || len(os.Args) > 4 {
-		log.Fatal(usage)
+// Rejoin the chain directly after predecessorIpPort, then apply the changes
+// made since this node was removed, from the predecessor's replication log
+// If the predecessor has left or no longer holds the changes, rejoins at the
+// end of the chain and copies every key-value from the new predecessor.
+// Changes passed on by the new predecessor wait until the node has caught up.
+func rejoinNetwork(ip_port string, frontend_ip_ports []string, predecessorIpPort string) error {
+	applyLock.Lock()
+	defer applyLock.Unlock()
+
+	var membership api.Membership
+	err := tryFrontEnds(frontend_ip_ports, func(frontend_ip_port string) error {
+		var err error
+		membership, err = api.RejoinNetworkByIpPort(frontend_ip_port, ip_port, shard, predecessorIpPort)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	nodeChain.UpdateMembership(&membership, &api.ValReply{})
+
+	caughtUp := false
+	if predecessorIpPort != "" && nodeChain.Predecessor() == predecessorIpPort {
+		mutations, found, err := api.CatchUpByIpPort(predecessorIpPort, store.Seq(), replicationQueue.Last())
+		if err == nil && found {
+			store.Apply(mutations...)
+			caughtUp = true
+			fmt.Printf("Caught up on %d changes from %s\n", len(mutations), predecessorIpPort)
+		}
+	}
+	if !caughtUp {
+		err = tryFrontEnds(frontend_ip_ports, func(frontend_ip_port string) error {
+			var err error
+			membership, err = api.JoinNetworkByIpPort(frontend_ip_port, ip_port, shard)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		nodeChain.UpdateMembership(&membership, &api.ValReply{})
+		if predecessorIpPort = nodeChain.Predecessor(); predecessorIpPort != "" {
+			entries, seq, err := api.GetSnapshotByIpPort(predecessorIpPort)
+			if err != nil {
+				return err
+			}
+			store.Restore(entries, seq)
+			watcher.Restored(seq)
+			hashTree.Reset(entries, seq)
+			replicationQueue.Reset(seq)
+			fmt.Printf("Copied %d key-values from %s\n", len(entries), predecessorIpPort)
+		}
 	}
-	checkDebugFlag(usage)
-	return os.Args[1], os.Args[2]
+
+	return tryFrontEnds(frontend_ip_ports, func(frontend_ip_port string) error {
+		_, err := api.ActivateByIpPort(frontend_ip_port, ip_port)
+		return err
+	})
+}
+
+// Block until the node has copied the key-values of its predecessor
+func waitForStateTransfer() {
+	<-stateTransferred
 }
 
-func checkDebugFlag(usage string) {
-	if len(os.Args) == 4 {
-		if os.Args[3] != "--debug" {
-			log.Fatal(usage)
+// Wait until every change applied before a read was served has been applied
+// by every later node, including a new tail still joining the chain, so that
+// the read returns only committed changes
+func awaitCommitted() error {
+	if nodeChain.IsLast() {
+		return nil
+	}
+	return replicationQueue.Wait(store.Seq())
+}
+
+// Wait until the node can accept writes, and track the write until endWrite
+func beginWrite() {
+	waitForStateTransfer()
+	inFlightWrites.Add(1)
+}
+
+// Wait as beginWrite does for a write sent by a client, which only the head
+// performs.  Returns an error without starting the write if this node is not
+// the head, so that the front-end adopts the later membership and sends the
+// write to the head instead.
+func beginClientWrite() error {
+	beginWrite()
+	if err := nodeChain.CheckHead(); err != nil {
+		endWrite()
+		return err
+	}
+	return nil
+}
+
+// Mark a write started by beginWrite as applied and propagated
+func endWrite() {
+	inFlightWrites.Done()
+}
+
+// Ask the network to link around this node, then wait for writes already
+// sent to this node to reach its successors before exiting
+func leaveNetwork(ip_port string, frontend_ip_ports []string) {
+	debugLog("Leaving network...\n")
+	close(leaving)
+	err := tryFrontEnds(frontend_ip_ports, func(frontend_ip_port string) error {
+		_, err := api.LeaveNetworkByIpPort(frontend_ip_port, ip_port)
+		return err
+	})
+	checkUnrecoverable(err, "Error leaving network:")
+	inFlightWrites.Wait()
+	debugLog("Left network\n")
+	os.Exit(0)
+}
+
+// Make a call to each front-end server in turn until one succeeds
+func tryFrontEnds(frontend_ip_ports []string, call func(frontend_ip_port string) error) error {
+	var err error
+	for _, frontend_ip_port := range frontend_ip_ports {
+		if err = call(frontend_ip_port); err == nil {
+			return nil
 		}
-		debugMode = true
+		debugLog("Front-end %s failed: %s\n", frontend_ip_port, err.Error())
+	}
+	return err
+}
+
+// Returns ip:port to listen on, ip:ports of front-end servers, and the
+// failure detector configuration
+func parseRuntimeParams() (string, []string, nodechain.DetectorOptions) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.BoolVar(&debugMode, "debug", false, "Enable activity logging to standard output")
+	flags.StringVar(&shard, "shard", "", "name of the shard whose chain to join, if the front-end is sharded")
+	flags.IntVar(&replicationLogSize, "replication-log-size", 10000, "number of recent changes kept for a next node catching up after rejoining the chain")
+	flags.DurationVar(&antiEntropyInterval, "anti-entropy-interval", 10*time.Second, "time between comparisons of key-values with the next node in the chain, or 0 to never compare")
+	detectorOpts := nodechain.DetectorFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [ip:port] [frontend ip:port,...] [--debug] [--shard name] [--anti-entropy-interval 10s] [--replication-log-size 10000] [failure detector options]\n\nOPTIONS\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if len(os.Args) < 3 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	flags.Parse(os.Args[3:])
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
 	}
+	return os.Args[1], strings.Split(os.Args[2], ","), *detectorOpts
 }
 
 func checkUnrecoverable(err error, msgIfFail string) {
@@ -0,0 +1,200 @@
+package nodechain
+
+import (
+	"encoding/json"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/util/raft"
+	"log"
+	"time"
+)
+
+// Time to wait for a proposed membership change to be agreed before giving up
+const proposalTimeout = 5 * time.Second
+
+// Number of agreed changes after which the membership is snapshotted
+const agreementSnapshotThreshold = 1000
+
+// A change to the chain's membership, appended to the front-ends' log
+// Exactly one field is set.
+type membershipChange struct {
+	Join     *api.JoinArgs // adds a node, as in Join
+	Leave    string        // removes a node
+	Activate string        // records that a joining node can serve reads
+}
+
+// Raft group of every front-end, which agree on each membership change
+// before any front-end makes it
+type agreement struct {
+	raft      *raft.Raft
+	agreed    api.Membership  // membership after every change applied from the log, guarded by the chain's lock
+	proposals *raft.Proposals // changes proposed by this front-end, waiting to be applied
+}
+
+// Agrees on every membership change with the other front-ends through a Raft
+// group of all front-ends, so that only the front-end elected by a majority
+// changes the membership, and every front-end applies the same changes in the
+// same order and numbers them with the same epochs.
+// Must be called before serving requests.  The returned Raft node must be
+// registered with the front-end's back-end rpc.Server under the name "Raft".
+// Also returns a function which stops it.
+func (chain *NodeChain) StartAgreement(opts raft.Options) (*raft.Raft, func(), error) {
+	applyCh := make(chan raft.ApplyMsg)
+	raftNode, err := raft.New(chain.SelfIpPort, chain.FrontEnds, opts, applyCh)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain.lock.Lock()
+	chain.agreement = &agreement{raft: raftNode, proposals: raft.NewProposals()}
+	chain.lock.Unlock()
+
+	stop := make(chan bool)
+	go chain.applyAgreed(applyCh, stop)
+	return raftNode, func() {
+		raftNode.Stop()
+		close(stop)
+	}, nil
+}
+
+// Make a membership change as the leading front-end, and push the resulting
+// membership to every member
+// Front-ends agreeing on changes first append the change to their log, and
+// every front-end applies it once a majority have stored it.  Returns false
+// if this front-end is not leading, in which case the change must be passed
+// on to the leader.
+func (chain *NodeChain) change(change membershipChange) (api.Membership, bool, error) {
+	var membership api.Membership
+	if chain.agreement == nil {
+		chain.lock.Lock()
+		if !chain.isLeader() {
+			chain.lock.Unlock()
+			return api.Membership{}, false, nil
+		}
+		membership = chain.apply(change)
+		chain.lock.Unlock()
+	} else {
+		var leading bool
+		var err error
+		membership, leading, err = chain.agreement.propose(change)
+		if !leading || err != nil {
+			return api.Membership{}, leading, err
+		}
+	}
+	chain.push(membership)
+	return membership, true, nil
+}
+
+// Append a change to the front-ends' log and wait for it to be applied
+// Returns the resulting membership, and false if this front-end is not leading.
+func (agreement *agreement) propose(change membershipChange) (api.Membership, bool, error) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return api.Membership{}, true, err
+	}
+	result, leading, err := agreement.proposals.Submit(agreement.raft, data, proposalTimeout)
+	if !leading || err != nil {
+		return api.Membership{}, leading, err
+	}
+	return result.(api.Membership), true, nil
+}
+
+// Apply agreed changes and snapshots to the membership in log order, replying
+// to the proposals this front-end made, until stop is closed
+func (chain *NodeChain) applyAgreed(applyCh <-chan raft.ApplyMsg, stop <-chan bool) {
+	agreement := chain.agreement
+	for {
+		var msg raft.ApplyMsg
+		select {
+		case <-stop:
+			return
+		case msg = <-applyCh:
+		}
+
+		if msg.Snapshot != nil {
+			var membership api.Membership
+			if err := json.Unmarshal(msg.Snapshot, &membership); err != nil {
+				log.Fatal("Error decoding membership snapshot:", err)
+			}
+			chain.lock.Lock()
+			agreement.agreed = membership
+			if membership.Epoch >= chain.Epoch {
+				chain.replace(membership)
+			}
+			chain.lock.Unlock()
+			agreement.proposals.Finish(msg.Index, msg.Term, nil)
+			continue
+		}
+
+		var result interface{}
+		if msg.Command != nil {
+			var change membershipChange
+			if err := json.Unmarshal(msg.Command, &change); err != nil {
+				log.Fatal("Error decoding membership change:", err)
+			}
+			chain.lock.Lock()
+			membership := chain.apply(change)
+			chain.lock.Unlock()
+			result = membership
+		}
+		agreement.proposals.Finish(msg.Index, msg.Term, result)
+
+		if agreement.raft.LogLength() >= agreementSnapshotThreshold {
+			chain.lock.RLock()
+			data, err := json.Marshal(agreement.agreed)
+			chain.lock.RUnlock()
+			if err != nil {
+				log.Fatal("Error encoding membership snapshot:", err)
+			}
+			agreement.raft.Snapshot(msg.Index, data)
+		}
+	}
+}
+
+// Apply a change to the membership, adopting the result unless a later
+// membership has already been adopted, and return the result
+// Front-ends agreeing on changes apply each to the membership agreed through
+// the log, rather than one in which they linked around failed nodes, so that
+// every front-end reaches the same membership in each epoch.
+// Caller must hold the chain's lock
+func (chain *NodeChain) apply(change membershipChange) api.Membership {
+	base := chain.membership()
+	if chain.agreement != nil {
+		base = chain.agreement.agreed
+	}
+	membership := change.applyTo(base)
+	if chain.agreement != nil {
+		chain.agreement.agreed = membership
+	}
+	if membership.Epoch >= chain.Epoch {
+		chain.replace(membership)
+	}
+	return membership
+}
+
+// Returns membership with the change made and its epoch incremented, or
+// unchanged if the change removes a node which is not a member
+func (change membershipChange) applyTo(membership api.Membership) api.Membership {
+	members, joining := membership.Members, membership.Joining
+	switch {
+	case change.Join != nil:
+		// A node rejoining without naming a position has lost its key-values,
+		// so rejoins at the end of the chain
+		members = without(members, change.Join.IpPort)
+		position := len(members)
+		for i, member := range members {
+			if change.Join.After != "" && member == change.Join.After {
+				position = i + 1
+			}
+		}
+		members = append(members[:position], append([]string{change.Join.IpPort}, members[position:]...)...)
+		joining = append(without(joining, change.Join.IpPort), change.Join.IpPort)
+	case change.Leave != "":
+		if !contains(members, change.Leave) {
+			return membership
+		}
+		members = without(members, change.Leave)
+		joining = without(joining, change.Leave)
+	case change.Activate != "":
+		joining = without(joining, change.Activate)
+	}
+	return api.Membership{Epoch: membership.Epoch + 1, Members: members, Joining: joining}
+}
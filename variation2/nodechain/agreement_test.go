@@ -0,0 +1,137 @@
+package nodechain
+
+import (
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/util/memnet"
+	"github.com/msayson/kvservice/util/raft"
+	"github.com/msayson/kvservice/util/rpc_util"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Raft configuration for front-ends in tests, electing leaders quickly
+func testRaftOptions() raft.Options {
+	return raft.Options{
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+	}
+}
+
+// Start n front-ends agreeing on membership changes, on an in-memory network
+// which carries every RPC connection until the test finishes
+// Returns the network and each front-end.
+func startAgreeingFrontEnds(t *testing.T, n int) (*memnet.Network, []*fakeNode) {
+	network := memnet.New(1)
+	previous := rpc_util.SetTransport(network)
+	t.Cleanup(func() { rpc_util.SetTransport(previous) })
+
+	ipPorts := []string{}
+	for i := 0; i < n; i++ {
+		ipPorts = append(ipPorts, fmt.Sprintf("%s/frontend%d:1", t.Name(), i))
+	}
+	frontEnds := []*fakeNode{}
+	for _, ipPort := range ipPorts {
+		listener, err := network.Listen(ipPort)
+		if err != nil {
+			t.Fatalf("Error starting front-end: %s", err.Error())
+		}
+		chain := NewFrontEnd(ipPort, ipPorts)
+		_, stop, err := chain.StartAgreement(testRaftOptions())
+		if err != nil {
+			t.Fatalf("Error starting agreement: %s", err.Error())
+		}
+		t.Cleanup(stop)
+		frontEnds = append(frontEnds, serveFakeNode(t, listener, chain))
+	}
+	return network, frontEnds
+}
+
+// Wait for one of the front-ends to lead and the others to know it,
+// returning its position
+func waitForLeader(t *testing.T, frontEnds []*fakeNode) int {
+	leader := -1
+	waitFor(t, "a front-end to be elected", func() bool {
+		leader = -1
+		for i, frontEnd := range frontEnds {
+			if frontEnd.isLeading() {
+				leader = i
+			}
+		}
+		for _, frontEnd := range frontEnds {
+			if leader < 0 || frontEnd.chain.leader() != frontEnds[leader].chain.SelfIpPort {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+// Returns whether the node's chain is the leading front-end's view
+func (node *fakeNode) isLeading() bool {
+	return node.chain.isLeader()
+}
+
+// Returns the front-ends other than the one at position i
+func allExcept(frontEnds []*fakeNode, i int) []*fakeNode {
+	return append(append([]*fakeNode{}, frontEnds[:i]...), frontEnds[i+1:]...)
+}
+
+func TestAgreement_NewLeaderAfterLeaderFails(t *testing.T) {
+	network, frontEnds := startAgreeingFrontEnds(t, 3)
+	leader := waitForLeader(t, frontEnds)
+	survivors := allExcept(frontEnds, leader)
+	if err := survivors[0].chain.Join(&api.JoinArgs{IpPort: unreachable(0)}, &api.Membership{}); err != nil {
+		t.Fatalf("Join on follower returned unexpected error: %s", err.Error())
+	}
+
+	network.Crash(frontEnds[leader].chain.SelfIpPort)
+	newLeader := survivors[waitForLeader(t, survivors)]
+	membership := api.Membership{}
+	if err := newLeader.chain.Join(&api.JoinArgs{IpPort: unreachable(1)}, &membership); err != nil {
+		t.Fatalf("Join after the leader failed returned unexpected error: %s", err.Error())
+	}
+	if membership.Epoch != 2 || len(membership.Members) != 2 {
+		t.Errorf("Join after the leader failed returned %v, expected 2 members in epoch 2", membership)
+	}
+	for _, frontEnd := range survivors {
+		waitForMembers(t, frontEnd.chain, unreachable(0), unreachable(1))
+	}
+}
+
+func TestAgreement_MinorityCannotChangeMembership(t *testing.T) {
+	network, frontEnds := startAgreeingFrontEnds(t, 3)
+	leader := waitForLeader(t, frontEnds)
+	oldLeader, majority := frontEnds[leader], allExcept(frontEnds, leader)
+	network.Partition([]string{oldLeader.chain.SelfIpPort}, []string{majority[0].chain.SelfIpPort, majority[1].chain.SelfIpPort})
+
+	// The partitioned leader still believes it leads, but cannot have its
+	// change agreed, while the majority elect a leader which can
+	minorityErr := make(chan error, 1)
+	go func() {
+		minorityErr <- oldLeader.chain.Join(&api.JoinArgs{IpPort: unreachable(0)}, &api.Membership{})
+	}()
+	newLeader := majority[waitForLeader(t, majority)]
+	if err := newLeader.chain.Join(&api.JoinArgs{IpPort: unreachable(1)}, &api.Membership{}); err != nil {
+		t.Fatalf("Join on the majority's leader returned unexpected error: %s", err.Error())
+	}
+	if membership := (api.Membership{}); oldLeader.chain.GetMembership(&membership) == nil && membership.Epoch != 0 {
+		t.Errorf("Partitioned leader held membership %v, expected no change without a majority", membership)
+	}
+
+	network.Heal()
+	if err := <-minorityErr; err == nil {
+		t.Errorf("Join on the partitioned leader succeeded, expected it to be lost")
+	}
+	expected := api.Membership{}
+	newLeader.chain.GetMembership(&expected)
+	for _, frontEnd := range frontEnds {
+		waitFor(t, "every front-end to hold the majority's membership", func() bool {
+			membership := api.Membership{}
+			frontEnd.chain.GetMembership(&membership)
+			return reflect.DeepEqual(membership, expected)
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package nodechain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"net/rpc"
+	"time"
+)
+
+// Finds and repairs differences between a node's key-values and its
+// successor's, which should never arise but would otherwise go unnoticed
+// Each node periodically compares its hash tree with its successor's,
+// descending only into subtrees whose hashes differ, then sends its
+// key-values in the differing leaves for the successor to adopt.  A node
+// holds every change its successor holds, so the node's values are taken as
+// correct.  Trees are only compared while both nodes have applied the same
+// changes, so changes still being passed down the chain are not mistaken
+// for differences.
+type AntiEntropy struct {
+	chain *NodeChain
+	store *kvstore.KVStore
+	tree  *kvstore.HashTree // kept up to date with every mutation of store
+}
+
+// Returns an anti-entropy job for the node holding store and tree, in chain
+func NewAntiEntropy(chain *NodeChain, store *kvstore.KVStore, tree *kvstore.HashTree) *AntiEntropy {
+	return &AntiEntropy{chain, store, tree}
+}
+
+// Compares key-values with the successor every interval, repairing any
+// differences.  Returns a function which stops the job.
+func (antiEntropy *AntiEntropy) Start(interval time.Duration) func() {
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				repaired, err := antiEntropy.Sync()
+				if err != nil {
+					fmt.Printf("Error comparing key-values with successor: %s\n", err.Error())
+				} else if repaired > 0 {
+					fmt.Printf("Repaired %d key-values on successor\n", repaired)
+				}
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// Compares key-values with the successor once, repairing any differences
+// Returns the number of key-values written or removed on the successor,
+// which is 0 if there are no differences, no successor, or either node
+// applied changes during the comparison.
+func (antiEntropy *AntiEntropy) Sync() (int, error) {
+	if len(antiEntropy.chain.successors()) == 0 {
+		return 0, nil
+	}
+	rpcClient, err := antiEntropy.chain.connectToSuccessor()
+	if err != nil {
+		return 0, err
+	}
+	defer rpcClient.Close()
+
+	buckets, seq, err := antiEntropy.differingBuckets(rpcClient)
+	if err != nil || len(buckets) == 0 {
+		return 0, err
+	}
+
+	// Send every key-value in the differing leaves, as of the compared trees
+	snapshot, snapshotSeq := antiEntropy.store.Snapshot()
+	if snapshotSeq != seq {
+		return 0, nil
+	}
+	inBuckets := map[int]bool{}
+	for _, bucket := range buckets {
+		inBuckets[bucket] = true
+	}
+	args := api.RepairArgs{Seq: seq, Buckets: buckets}
+	for _, entry := range snapshot {
+		if inBuckets[kvstore.HashTreeBucket(entry.Key)] {
+			args.Entries = append(args.Entries, entry)
+		}
+	}
+	reply := api.RepairReply{}
+	if err := rpcClient.Call("KeyValService.Repair", &args, &reply); err != nil {
+		return 0, err
+	}
+	return reply.Repaired, nil
+}
+
+// CompareTree RPC call: reports which of the sender's hash tree nodes differ
+// from this node's
+func (antiEntropy *AntiEntropy) CompareTree(args *api.CompareTreeArgs, reply *api.CompareTreeReply) error {
+	levels, seq := antiEntropy.tree.Levels()
+	if seq != args.Seq {
+		reply.Stale = true
+		return nil
+	}
+	if args.Level < 0 || args.Level >= len(levels) || len(args.Indices) != len(args.Hashes) {
+		return errors.New(fmt.Sprintf("CompareTree: invalid nodes at level %d", args.Level))
+	}
+	for i, index := range args.Indices {
+		if index < 0 || index >= len(levels[args.Level]) {
+			return errors.New(fmt.Sprintf("CompareTree: no node %d at level %d", index, args.Level))
+		}
+		if levels[args.Level][index] != args.Hashes[i] {
+			reply.Differ = append(reply.Differ, index)
+		}
+	}
+	return nil
+}
+
+// Repair RPC call: replaces this node's key-values in some leaves of its
+// hash tree with the sender's, keeping their versions
+// Nothing is changed if this node has applied different changes to the sender.
+func (antiEntropy *AntiEntropy) Repair(args *api.RepairArgs, reply *api.RepairReply) error {
+	sent := map[string]bool{}
+	mutations := []kvstore.Mutation{}
+	for _, entry := range args.Entries {
+		sent[entry.Key] = true
+		mutations = append(mutations, entry)
+	}
+	for _, key := range antiEntropy.tree.Keys(args.Buckets) {
+		if !sent[key] {
+			mutations = append(mutations, kvstore.Mutation{Seq: args.Seq, Key: key, Deleted: true})
+		}
+	}
+	if !antiEntropy.store.ApplyAt(args.Seq, mutations...) {
+		reply.Stale = true
+		return nil
+	}
+	reply.Repaired = len(mutations)
+	return nil
+}
+
+// Descend the hash trees of this node and the successor connected to by
+// rpcClient, from the root, into the subtrees whose hashes differ
+// Returns the leaves which differ, and the sequence number of the compared
+// trees, or no leaves if the successor has applied different changes.
+func (antiEntropy *AntiEntropy) differingBuckets(rpcClient *rpc.Client) ([]int, uint64, error) {
+	levels, seq := antiEntropy.tree.Levels()
+	indices := []int{0}
+	for level := 0; ; level++ {
+		args := api.CompareTreeArgs{Seq: seq, Level: level, Indices: indices}
+		for _, index := range indices {
+			args.Hashes = append(args.Hashes, levels[level][index])
+		}
+		reply := api.CompareTreeReply{}
+		if err := rpcClient.Call("KeyValService.CompareTree", &args, &reply); err != nil {
+			return nil, seq, err
+		}
+		if reply.Stale || len(reply.Differ) == 0 {
+			return nil, seq, nil
+		}
+		if level == len(levels)-1 {
+			return reply.Differ, seq, nil
+		}
+		indices = []int{}
+		for _, index := range reply.Differ {
+			indices = append(indices, 2*index, 2*index+1)
+		}
+	}
+}
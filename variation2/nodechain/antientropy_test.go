@@ -0,0 +1,87 @@
+package nodechain
+
+import (
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Returns an anti-entropy job over a new store holding the given changes
+func newRepairer(chain *NodeChain, mutations []kvstore.Mutation) (*AntiEntropy, *kvstore.KVStore) {
+	store := kvstore.New()
+	store.Apply(mutations...)
+	tree := kvstore.NewHashTree()
+	tree.Reset(store.Snapshot())
+	store.OnMutation(tree.Update)
+	return NewAntiEntropy(chain, store, tree), store
+}
+
+// Start this node and its successor, each holding the given changes
+// Returns the anti-entropy job of this node and the successor's store.
+func startRepairers(t *testing.T, mutations []kvstore.Mutation) (*AntiEntropy, *kvstore.KVStore) {
+	next, nextIpPort := startFakeNode(t, false)
+	var nextStore *kvstore.KVStore
+	next.repairer, nextStore = newRepairer(next.chain, mutations)
+
+	chain := NewMember("self", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{"self", nextIpPort}}, &api.ValReply{})
+	repairer, _ := newRepairer(chain, mutations)
+	return repairer, nextStore
+}
+
+// Returns the store's key-values, sorted by key
+func sortedSnapshot(store *kvstore.KVStore) []kvstore.Mutation {
+	entries, _ := store.Snapshot()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+func TestAntiEntropy_RepairsDifferingKeys(t *testing.T) {
+	mutations := []kvstore.Mutation{}
+	for i, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		mutations = append(mutations, kvstore.Mutation{Seq: uint64(i + 1), Key: key, Value: key})
+	}
+	repairer, nextStore := startRepairers(t, mutations)
+	nextStore.ApplyAt(6,
+		kvstore.Mutation{Seq: 2, Key: "b", Value: "wrong"},
+		kvstore.Mutation{Seq: 6, Key: "d", Deleted: true},
+		kvstore.Mutation{Seq: 5, Key: "extra", Value: "x"},
+	)
+
+	repaired, err := repairer.Sync()
+	if err != nil {
+		t.Fatalf("Sync returned unexpected error: %s", err.Error())
+	}
+	if repaired == 0 || repaired > 6 {
+		t.Errorf("Sync repaired %d key-values, expected between 3 and 6", repaired)
+	}
+	if expected, actual := sortedSnapshot(repairer.store), sortedSnapshot(nextStore); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Successor held %v after Sync, expected %v", actual, expected)
+	}
+	if repaired, _ = repairer.Sync(); repaired != 0 {
+		t.Errorf("Second Sync repaired %d key-values, expected 0", repaired)
+	}
+}
+
+func TestAntiEntropy_SkipsSuccessorWithOtherChanges(t *testing.T) {
+	repairer, nextStore := startRepairers(t, []kvstore.Mutation{{Seq: 1, Key: "a", Value: "1"}})
+	nextStore.Set("a", "2") // not yet applied by this node
+
+	if repaired, err := repairer.Sync(); repaired != 0 || err != nil {
+		t.Errorf("Sync with a successor at a later sequence number returned %d, %v, expected 0, nil", repaired, err)
+	}
+	if val := nextStore.Get("a"); val != "2" {
+		t.Errorf("Successor held %s for a after Sync, expected its own value 2", val)
+	}
+}
+
+func TestAntiEntropy_NoSuccessor(t *testing.T) {
+	chain := NewMember("tail", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{"head", "tail"}}, &api.ValReply{})
+	repairer, _ := newRepairer(chain, nil)
+	if repaired, err := repairer.Sync(); repaired != 0 || err != nil {
+		t.Errorf("Sync on the tail returned %d, %v, expected 0, nil", repaired, err)
+	}
+}
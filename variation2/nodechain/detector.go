@@ -0,0 +1,165 @@
+package nodechain
+
+import (
+	"flag"
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"sync"
+	"time"
+)
+
+// Health of a node, as seen by a failure detector
+const (
+	nodeAlive     = "alive"     // replied to a heartbeat within SuspectTimeout
+	nodeSuspected = "suspected" // has not replied within SuspectTimeout
+	nodeDead      = "dead"      // has not replied within DeadTimeout
+)
+
+// Configuration for a chain's failure detector
+type DetectorOptions struct {
+	Interval       time.Duration // time between heartbeats, and the time allowed for each reply
+	SuspectTimeout time.Duration // time without a reply before a node is suspected
+	DeadTimeout    time.Duration // time without a reply before a node is removed from the chain
+}
+
+// Returns the failure detector configuration used if none is given
+func DefaultDetectorOptions() DetectorOptions {
+	return DetectorOptions{
+		Interval:       time.Second,
+		SuspectTimeout: 3 * time.Second,
+		DeadTimeout:    5 * time.Second,
+	}
+}
+
+// Defines command-line flags for configuring a failure detector, and returns
+// the options they will be parsed into
+func DetectorFlags(flags *flag.FlagSet) *DetectorOptions {
+	opts := DefaultDetectorOptions()
+	flags.DurationVar(&opts.Interval, "heartbeat-interval", opts.Interval, "time between heartbeats to other nodes in the chain")
+	flags.DurationVar(&opts.SuspectTimeout, "suspect-timeout", opts.SuspectTimeout, "time without a heartbeat reply before a node is suspected")
+	flags.DurationVar(&opts.DeadTimeout, "dead-timeout", opts.DeadTimeout, "time without a heartbeat reply before a node is removed from the chain")
+	return &opts
+}
+
+// Tracks the health of the nodes a chain heartbeats
+type failureDetector struct {
+	chain     *NodeChain
+	opts      DetectorOptions
+	lastHeard map[string]time.Time // time of each node's last heartbeat reply
+	health    map[string]string    // last reported health of each node
+}
+
+// Heartbeats nodes in the chain every opts.Interval, removing nodes which
+// stop replying before clients notice.  Each front-end heartbeats every
+// member, and each node heartbeats its successor.
+// Returns a function which stops the failure detector.
+func (chain *NodeChain) StartFailureDetector(opts DetectorOptions) func() {
+	detector := newFailureDetector(chain, opts)
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				detector.heartbeat()
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func newFailureDetector(chain *NodeChain, opts DetectorOptions) *failureDetector {
+	return &failureDetector{
+		chain:     chain,
+		opts:      opts,
+		lastHeard: map[string]time.Time{},
+		health:    map[string]string{},
+	}
+}
+
+// Heartbeat each monitored node, adopting any later membership they report,
+// and removing nodes that are dead
+func (detector *failureDetector) heartbeat() {
+	chain := detector.chain
+	targets := chain.successors()
+	if !chain.IsFrontEnd && len(targets) > 1 {
+		targets = targets[:1]
+	}
+	detector.forgetAllExcept(targets...)
+
+	replies := make([]api.Membership, len(targets))
+	replied := make([]bool, len(targets))
+	probed := sync.WaitGroup{}
+	for i, ipPort := range targets {
+		probed.Add(1)
+		go func(i int, ipPort string) {
+			defer probed.Done()
+			replies[i], replied[i] = detector.probe(ipPort)
+		}(i, ipPort)
+	}
+	probed.Wait()
+
+	for i, ipPort := range targets {
+		if replied[i] {
+			chain.adopt(replies[i])
+		}
+		health := detector.observe(ipPort, replied[i], time.Now())
+		if health == nodeDead {
+			chain.removeMember(ipPort)
+		}
+	}
+}
+
+// Send a heartbeat to a node, returning its view of the membership and
+// whether it replied within the heartbeat interval
+func (detector *failureDetector) probe(ipPort string) (api.Membership, bool) {
+	rpcClient, err := detector.chain.dial(ipPort, detector.opts.Interval)
+	if err != nil {
+		return api.Membership{}, false
+	}
+	defer rpcClient.Close()
+	reply := api.Membership{}
+	call := rpcClient.Go("KeyValService.GetMembership", detector.chain.SelfIpPort, &reply, nil)
+	select {
+	case <-call.Done:
+		return reply, call.Error == nil
+	case <-time.After(detector.opts.Interval):
+		return api.Membership{}, false
+	}
+}
+
+// Record the result of a heartbeat to a node at time now, returning its health
+// A node is considered to have last replied when it was first heartbeated.
+func (detector *failureDetector) observe(ipPort string, replied bool, now time.Time) string {
+	lastHeard, known := detector.lastHeard[ipPort]
+	if replied || !known {
+		detector.lastHeard[ipPort] = now
+		lastHeard = now
+	}
+
+	health := nodeAlive
+	if silence := now.Sub(lastHeard); silence >= detector.opts.DeadTimeout {
+		health = nodeDead
+	} else if silence >= detector.opts.SuspectTimeout {
+		health = nodeSuspected
+	}
+	if previous, reported := detector.health[ipPort]; health != previous && (reported || health != nodeAlive) {
+		fmt.Printf("Node %s is %s\n", ipPort, health)
+	}
+	detector.health[ipPort] = health
+	return health
+}
+
+// Discard the history of nodes which are no longer monitored, so that
+// a node which rejoins later is not immediately considered dead
+func (detector *failureDetector) forgetAllExcept(ipPorts ...string) {
+	for ipPort := range detector.lastHeard {
+		if !contains(ipPorts, ipPort) {
+			delete(detector.lastHeard, ipPort)
+			delete(detector.health, ipPort)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package nodechain
+
+import (
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Back-end node or front-end which only manages membership and records writes
+type fakeNode struct {
+	chain    *NodeChain
+	listener net.Listener
+	left     []string           // ip:port of each node reported to this front-end
+	applied  int                // number of replicated writes accepted
+	received []kvstore.Mutation // changes accepted, in the order received
+	gaps     int                // number of further calls to reply to with a gap
+	reads    int                // number of Get calls served
+	repairer *AntiEntropy       // serves anti-entropy calls, if set
+	lock     *sync.Mutex
+}
+
+func (node *fakeNode) GetMembership(_ string, reply *api.Membership) error {
+	return node.chain.GetMembership(reply)
+}
+
+func (node *fakeNode) CompareTree(args *api.CompareTreeArgs, reply *api.CompareTreeReply) error {
+	return node.repairer.CompareTree(args, reply)
+}
+
+func (node *fakeNode) Repair(args *api.RepairArgs, reply *api.RepairReply) error {
+	return node.repairer.Repair(args, reply)
+}
+
+func (node *fakeNode) UpdateMembership(args *api.Membership, reply *api.ValReply) error {
+	return node.chain.UpdateMembership(args, reply)
+}
+
+func (node *fakeNode) Join(args *api.JoinArgs, reply *api.Membership) error {
+	return node.chain.Join(args, reply)
+}
+
+func (node *fakeNode) Activate(args *api.JoinArgs, reply *api.ValReply) error {
+	return node.chain.Activate(args, reply)
+}
+
+func (node *fakeNode) Leave(args *api.LeaveArgs, reply *api.ValReply) error {
+	node.lock.Lock()
+	node.left = append(node.left, args.IpPort)
+	node.lock.Unlock()
+	return node.chain.Leave(args, reply)
+}
+
+func (node *fakeNode) Get(args *api.GetArgs, reply *api.ValReply) error {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	node.reads++
+	reply.Val, reply.Found = node.chain.SelfIpPort, true
+	return nil
+}
+
+func (node *fakeNode) Replicate(args *api.ReplicateArgs, reply *api.ReplicateReply) error {
+	if node.chain.AcceptEpoch(args.Epoch, reply) {
+		node.lock.Lock()
+		defer node.lock.Unlock()
+		if node.gaps > 0 {
+			node.gaps--
+			reply.Gap = true
+			return nil
+		}
+		node.applied++
+		node.received = append(node.received, args.Mutations...)
+	}
+	return nil
+}
+
+// Start a fake front-end with no replicas, or back-end node if frontEnd is
+// false, listening on a free port.  Returns the node and its ip:port.
+func startFakeNode(t *testing.T, frontEnd bool) (*fakeNode, string) {
+	listener, ipPort := listen(t)
+	chain := New()
+	if !frontEnd {
+		chain = NewMember(ipPort, nil)
+	}
+	return serveFakeNode(t, listener, chain), ipPort
+}
+
+// Listen on a free port, returning the listener and its ip:port
+func listen(t *testing.T) (net.Listener, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake node: %s", err.Error())
+	}
+	return listener, listener.Addr().String()
+}
+
+// Serve RPC calls on listener with a fake node holding chain
+func serveFakeNode(t *testing.T, listener net.Listener, chain *NodeChain) *fakeNode {
+	node := &fakeNode{chain: chain, listener: listener, lock: &sync.Mutex{}}
+	server := rpc.NewServer()
+	server.RegisterName("KeyValService", node)
+	if chain.agreement != nil {
+		server.RegisterName("Raft", chain.agreement.raft)
+	}
+	go server.Accept(listener)
+	t.Cleanup(node.stop)
+	return node
+}
+
+// Stop accepting connections, as if the node had failed
+func (node *fakeNode) stop() {
+	node.listener.Close()
+}
+
+// Returns the ip:port of each node reported to this front-end
+func (node *fakeNode) reported() []string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return append([]string{}, node.left...)
+}
+
+func testDetectorOptions() DetectorOptions {
+	return DetectorOptions{
+		Interval:       10 * time.Millisecond,
+		SuspectTimeout: 30 * time.Millisecond,
+		DeadTimeout:    60 * time.Millisecond,
+	}
+}
+
+// Wait up to a second for the chain to hold the given members
+func waitForMembers(t *testing.T, chain *NodeChain, members ...string) {
+	deadline := time.Now().Add(time.Second)
+	reply := api.Membership{}
+	for time.Now().Before(deadline) {
+		chain.GetMembership(&reply)
+		if reflect.DeepEqual(reply.Members, members) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("Chain members were %v, expected %v", reply.Members, members)
+}
+
+func TestFailureDetector_FrontEndRemovesAdjacentFailures(t *testing.T) {
+	nodes := make([]*fakeNode, 4)
+	ipPorts := make([]string, 4)
+	frontEnd := New()
+	for i := range nodes {
+		nodes[i], ipPorts[i] = startFakeNode(t, false)
+		frontEnd.Join(&api.JoinArgs{IpPort: ipPorts[i]}, &api.Membership{})
+	}
+	stop := frontEnd.StartFailureDetector(testDetectorOptions())
+	defer stop()
+
+	nodes[1].stop()
+	nodes[2].stop()
+	waitForMembers(t, frontEnd, ipPorts[0], ipPorts[3])
+	waitForMembers(t, nodes[0].chain, ipPorts[0], ipPorts[3])
+	waitForMembers(t, nodes[3].chain, ipPorts[0], ipPorts[3])
+	membership := api.Membership{}
+	frontEnd.GetMembership(&membership)
+	if membership.Epoch != 6 {
+		t.Errorf("Epoch after 4 joins and 2 failures was %d, expected 6", membership.Epoch)
+	}
+}
+
+func TestFailureDetector_NodeReportsFailedSuccessor(t *testing.T) {
+	frontEnd, frontEndIpPort := startFakeNode(t, true)
+	_, selfIpPort := startFakeNode(t, false)
+	next, nextIpPort := startFakeNode(t, false)
+	_, tailIpPort := startFakeNode(t, false)
+	membership := api.Membership{}
+	for _, ipPort := range []string{selfIpPort, nextIpPort, tailIpPort} {
+		frontEnd.chain.Join(&api.JoinArgs{IpPort: ipPort}, &membership)
+	}
+	chain := NewMember(selfIpPort, []string{frontEndIpPort})
+	chain.UpdateMembership(&membership, &api.ValReply{})
+	stop := chain.StartFailureDetector(testDetectorOptions())
+	defer stop()
+
+	next.stop()
+	waitForMembers(t, chain, selfIpPort, tailIpPort)
+	waitForMembers(t, frontEnd.chain, selfIpPort, tailIpPort)
+	if reported := frontEnd.reported(); !reflect.DeepEqual(reported, []string{nextIpPort}) {
+		t.Errorf("Front-end was told of failures %v, expected [%s]", reported, nextIpPort)
+	}
+}
+
+func TestFailureDetector_AdoptsLaterMembership(t *testing.T) {
+	next, nextIpPort := startFakeNode(t, false)
+	chain := NewMember("self", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{"self", nextIpPort}}, &api.ValReply{})
+	next.chain.UpdateMembership(&api.Membership{Epoch: 2, Members: []string{"self", nextIpPort, "tail"}}, &api.ValReply{})
+	stop := chain.StartFailureDetector(testDetectorOptions())
+	defer stop()
+
+	waitForMembers(t, chain, "self", nextIpPort, "tail")
+}
+
+func TestFailureDetector_SuspectsBeforeRemoving(t *testing.T) {
+	detector := newFailureDetector(New(), testDetectorOptions())
+	start := time.Now()
+	if health := detector.observe("a", false, start); health != nodeAlive {
+		t.Errorf("Health after first failed heartbeat was %s, expected %s", health, nodeAlive)
+	}
+	if health := detector.observe("a", false, start.Add(40*time.Millisecond)); health != nodeSuspected {
+		t.Errorf("Health after 40ms without reply was %s, expected %s", health, nodeSuspected)
+	}
+	if health := detector.observe("a", true, start.Add(50*time.Millisecond)); health != nodeAlive {
+		t.Errorf("Health after reply was %s, expected %s", health, nodeAlive)
+	}
+	if health := detector.observe("a", false, start.Add(110*time.Millisecond)); health != nodeDead {
+		t.Errorf("Health after 60ms without reply was %s, expected %s", health, nodeDead)
+	}
+}
@@ -0,0 +1,299 @@
+package nodechain
+
+import (
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"github.com/msayson/kvservice/util/memnet"
+	"github.com/msayson/kvservice/util/rpc_util"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Failure detector configuration for chains on an in-memory network,
+// removing crashed nodes quickly
+var faultDetectorOpts = DetectorOptions{
+	Interval:       20 * time.Millisecond,
+	SuspectTimeout: 60 * time.Millisecond,
+	DeadTimeout:    100 * time.Millisecond,
+}
+
+// Back-end node replicating writes as variation2's nodes do: the head
+// performs each write, and every node applies the changes it is passed in
+// order and passes them on with a ReplicationQueue
+type chainNode struct {
+	chain     *NodeChain
+	store     *kvstore.KVStore
+	queue     *ReplicationQueue
+	applyLock *sync.Mutex
+}
+
+func (node *chainNode) GetMembership(_ string, reply *api.Membership) error {
+	return node.chain.GetMembership(reply)
+}
+
+func (node *chainNode) UpdateMembership(args *api.Membership, reply *api.ValReply) error {
+	return node.chain.UpdateMembership(args, reply)
+}
+
+func (node *chainNode) Set(args *api.SetArgs, reply *api.ValReply) error {
+	if err := node.chain.CheckHead(); err != nil {
+		return err
+	}
+	reply.Val = node.store.Set(args.Key, args.Val)
+	return node.queue.Wait(node.store.Seq())
+}
+
+func (node *chainNode) Get(args *api.GetArgs, reply *api.ValReply) error {
+	reply.Val, reply.Version, reply.Found = node.store.LookupVersion(args.Key)
+	if node.queue.Dirty(args.Key) {
+		if !node.chain.IsTail() {
+			*reply = api.ValReply{}
+			return node.chain.GetCommitted(args, reply)
+		}
+		if !node.chain.IsLast() {
+			return node.queue.Wait(node.store.Seq())
+		}
+	}
+	return nil
+}
+
+func (node *chainNode) GetCommitted(args *api.GetArgs, reply *api.ValReply) error {
+	reply.Val, reply.Version, reply.Found = node.store.LookupVersion(args.Key)
+	return nil
+}
+
+func (node *chainNode) Replicate(args *api.ReplicateArgs, reply *api.ReplicateReply) error {
+	if !node.chain.AcceptEpoch(args.Epoch, reply) {
+		return nil
+	}
+	last := args.Mutations[len(args.Mutations)-1].Seq
+	node.applyLock.Lock()
+	applied := node.store.Seq()
+	if args.Mutations[0].Seq > applied+1 {
+		node.applyLock.Unlock()
+		reply.Gap, reply.Seq = true, applied
+		return nil
+	}
+	unapplied := args.Mutations
+	for len(unapplied) > 0 && unapplied[0].Seq <= applied {
+		unapplied = unapplied[1:]
+	}
+	node.store.Apply(unapplied...)
+	node.applyLock.Unlock()
+	return node.queue.Wait(last)
+}
+
+// Start a front-end and a chain of n nodes on an in-memory network seeded by
+// seed, which carries every RPC connection until the test finishes
+// Nodes are named after the test, so that calls still in flight from an
+// earlier test's nodes cannot reach them.
+// Returns the network, the front-end's view of the chain, and each node from
+// head to tail.
+func startFaultyChain(t *testing.T, seed int64, n int) (*memnet.Network, *NodeChain, []*chainNode) {
+	network := memnet.New(seed)
+	previous := rpc_util.SetTransport(network)
+	t.Cleanup(func() { rpc_util.SetTransport(previous) })
+
+	frontEndIpPort := t.Name() + "/frontend:1"
+	listener, err := network.Listen(frontEndIpPort)
+	if err != nil {
+		t.Fatalf("Error starting front-end: %s", err.Error())
+	}
+	frontEnd := serveFakeNode(t, listener, NewFrontEnd(frontEndIpPort, nil)).chain
+	t.Cleanup(frontEnd.StartFailureDetector(faultDetectorOpts))
+
+	nodes := []*chainNode{}
+	for i := 0; i < n; i++ {
+		ipPort := fmt.Sprintf("%s/node%d:1", t.Name(), i)
+		listener, err := network.Listen(ipPort)
+		if err != nil {
+			t.Fatalf("Error starting node: %s", err.Error())
+		}
+		t.Cleanup(func() { listener.Close() })
+		node := &chainNode{chain: NewMember(ipPort, []string{frontEndIpPort}), store: kvstore.New(), applyLock: &sync.Mutex{}}
+		server := rpc.NewServer()
+		server.RegisterName("KeyValService", node)
+		go server.Accept(listener)
+
+		membership := api.Membership{}
+		frontEnd.Join(&api.JoinArgs{IpPort: ipPort}, &membership)
+		node.chain.UpdateMembership(&membership, &api.ValReply{})
+		node.queue = NewReplicationQueue(node.chain, 1000, nil)
+		node.queue.Start(node.store.OnMutation(node.queue.Push))
+		t.Cleanup(node.queue.Stop)
+		frontEnd.Activate(&api.JoinArgs{IpPort: ipPort}, &api.ValReply{})
+		t.Cleanup(node.chain.StartFailureDetector(faultDetectorOpts))
+		nodes = append(nodes, node)
+	}
+	return network, frontEnd, nodes
+}
+
+// Set key to val through the front-end, retrying until the write is
+// acknowledged
+func setUntilAcknowledged(t *testing.T, frontEnd *NodeChain, key string, val string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := frontEnd.Set(&api.SetArgs{Key: key, Val: val}, &api.ValReply{})
+		if err == nil {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Set(%s,%s) was not acknowledged: %s", key, val, err.Error())
+		}
+	}
+}
+
+// Check that the chain has exactly the expected members, whose key-values are
+// identical and include every acknowledged write, and that reads through the
+// front-end return every acknowledged write
+func checkChain(t *testing.T, frontEnd *NodeChain, members []*chainNode, acknowledged map[string]string) {
+	expected := []string{}
+	for _, node := range members {
+		expected = append(expected, node.chain.SelfIpPort)
+	}
+	waitFor(t, "the chain's membership to settle", func() bool {
+		membership := api.Membership{}
+		frontEnd.GetMembership(&membership)
+		return reflect.DeepEqual(membership.Members, expected)
+	})
+	waitFor(t, "every member to apply every change", func() bool {
+		for _, node := range members {
+			if node.store.Seq() != members[0].store.Seq() {
+				return false
+			}
+		}
+		return true
+	})
+	head := contents(members[0].store)
+	for _, node := range members[1:] {
+		if !reflect.DeepEqual(contents(node.store), head) {
+			t.Errorf("Key-values of %s differ from the head's", node.chain.SelfIpPort)
+		}
+	}
+	for key, val := range acknowledged {
+		reply := api.ValReply{}
+		if err := frontEnd.Get(&api.GetArgs{Key: key}, &reply); err != nil || reply.Val != val {
+			t.Errorf("Get(%s) returned %s, error %v, expected %s", key, reply.Val, err, val)
+		}
+	}
+}
+
+// Returns every key-value in store, by key
+func contents(store *kvstore.KVStore) map[string]kvstore.Mutation {
+	entries, _ := store.Snapshot()
+	byKey := map[string]kvstore.Mutation{}
+	for _, m := range entries {
+		byKey[m.Key] = m
+	}
+	return byKey
+}
+
+// Wait up to 10 seconds for ready to return true, failing the test otherwise
+func waitFor(t *testing.T, what string, ready func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFaults_TwoAdjacentNodesCrash(t *testing.T) {
+	network, frontEnd, nodes := startFaultyChain(t, 1, 5)
+	acknowledged := map[string]string{}
+	for i := 0; i < 20; i++ {
+		setUntilAcknowledged(t, frontEnd, fmt.Sprint("key", i), "before")
+		acknowledged[fmt.Sprint("key", i)] = "before"
+	}
+
+	network.Crash(nodes[1].chain.SelfIpPort)
+	network.Crash(nodes[2].chain.SelfIpPort)
+	for i := 10; i < 30; i++ {
+		setUntilAcknowledged(t, frontEnd, fmt.Sprint("key", i), "after")
+		acknowledged[fmt.Sprint("key", i)] = "after"
+	}
+	checkChain(t, frontEnd, []*chainNode{nodes[0], nodes[3], nodes[4]}, acknowledged)
+}
+
+func TestFaults_CrashesDuringConcurrentWrites(t *testing.T) {
+	network, frontEnd, nodes := startFaultyChain(t, 2, 5)
+	acknowledged := map[string]string{}
+	lock := sync.Mutex{}
+	writers := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 25; i++ {
+				key, val := fmt.Sprintf("key%d.%d", w, i), fmt.Sprint(i)
+				setUntilAcknowledged(t, frontEnd, key, val)
+				lock.Lock()
+				acknowledged[key] = val
+				lock.Unlock()
+			}
+		}(w)
+	}
+	time.Sleep(20 * time.Millisecond)
+	network.Crash(nodes[3].chain.SelfIpPort)
+	network.Crash(nodes[4].chain.SelfIpPort)
+	writers.Wait()
+	checkChain(t, frontEnd, nodes[:3], acknowledged)
+}
+
+func TestFaults_LostAndDelayedMessages(t *testing.T) {
+	network, frontEnd, nodes := startFaultyChain(t, 3, 3)
+	network.SetFaults(memnet.Faults{DropRate: 0.01, MaxDelay: 2 * time.Millisecond})
+	acknowledged := map[string]string{}
+	lock := sync.Mutex{}
+	writers := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 25; i++ {
+				key, val := fmt.Sprint("key", i%5), fmt.Sprintf("%d.%d", w, i)
+				setUntilAcknowledged(t, frontEnd, key, val)
+				lock.Lock()
+				acknowledged[key] = val
+				lock.Unlock()
+			}
+		}(w)
+	}
+	writers.Wait()
+	network.SetFaults(memnet.Faults{})
+
+	// Concurrent writers race on each key, so only the replicas are compared
+	checkChain(t, frontEnd, nodes, nil)
+}
+
+func TestFaults_PartitionedTailIsRemoved(t *testing.T) {
+	network, frontEnd, nodes := startFaultyChain(t, 4, 3)
+	setUntilAcknowledged(t, frontEnd, "a", "1")
+	network.Partition([]string{frontEnd.SelfIpPort, nodes[0].chain.SelfIpPort, nodes[1].chain.SelfIpPort}, []string{nodes[2].chain.SelfIpPort})
+	setUntilAcknowledged(t, frontEnd, "a", "2")
+	checkChain(t, frontEnd, nodes[:2], map[string]string{"a": "2"})
+	if val, _ := nodes[2].store.Lookup("a"); val != "1" {
+		t.Errorf("Partitioned tail held %s for a, expected 1", val)
+	}
+}
+
+func TestFaults_OnlyHeadPerformsWrites(t *testing.T) {
+	_, frontEnd, nodes := startFaultyChain(t, 5, 3)
+	setUntilAcknowledged(t, frontEnd, "a", "1")
+	if err := nodes[1].Set(&api.SetArgs{Key: "a", Val: "2"}, &api.ValReply{}); err != ErrNotHead {
+		t.Errorf("Set on a middle node returned %v, expected %v", err, ErrNotHead)
+	}
+
+	// A front-end which missed the head joining sends writes to the next
+	// node, which refuses them until the front-end adopts its membership
+	stale := NewFrontEnd(t.Name()+"/stale:1", nil)
+	stale.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{nodes[1].chain.SelfIpPort, nodes[2].chain.SelfIpPort}}, &api.ValReply{})
+	if err := stale.Set(&api.SetArgs{Key: "a", Val: "3"}, &api.ValReply{}); err != nil {
+		t.Fatalf("Set through a front-end with an old membership returned unexpected error: %s", err.Error())
+	}
+	checkChain(t, frontEnd, nodes, map[string]string{"a": "3"})
+}
@@ -0,0 +1,55 @@
+package nodechain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Returns the back-end ip:port of the front-end which decides the chain's
+// membership: the leader elected by the front-ends if they agree on changes,
+// otherwise the first front-end.  Returns "" if no leader is known.
+func (chain *NodeChain) leader() string {
+	if chain.agreement != nil {
+		_, _, leader := chain.agreement.raft.State()
+		return leader
+	}
+	if len(chain.FrontEnds) > 0 {
+		return chain.FrontEnds[0]
+	}
+	return chain.SelfIpPort
+}
+
+// Returns whether this is the view of the leading front-end
+func (chain *NodeChain) isLeader() bool {
+	if !chain.IsFrontEnd {
+		return false
+	} else if chain.agreement != nil {
+		_, leading, _ := chain.agreement.raft.State()
+		return leading
+	}
+	return chain.leader() == chain.SelfIpPort
+}
+
+// Returns the back-end ip:port of each front-end other than this one
+func (chain *NodeChain) otherFrontEnds() []string {
+	return without(chain.FrontEnds, chain.SelfIpPort)
+}
+
+// Pass a membership change on to the leading front-end
+func (chain *NodeChain) callLeader(serviceMethod string, args interface{}, reply interface{}) error {
+	leader := chain.leader()
+	if leader == "" || leader == chain.SelfIpPort {
+		return errors.New(fmt.Sprintf("%s: no front-end is leading, try again", serviceMethod))
+	}
+	return chain.callFrontEnd(leader, serviceMethod, args, reply)
+}
+
+// Send an RPC call to the front-end at ipPort, usually the leader
+func (chain *NodeChain) callFrontEnd(ipPort, serviceMethod string, args interface{}, reply interface{}) error {
+	rpcClient, err := chain.dial(ipPort, dialTimeout)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: front-end %s is unavailable: %s", serviceMethod, ipPort, err.Error()))
+	}
+	defer rpcClient.Close()
+	return rpcClient.Call(serviceMethod, args, reply)
+}
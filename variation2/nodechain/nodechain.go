@@ -7,26 +7,66 @@ import (
 	"github.com/msayson/kvservice/util/rpc_util"
 	"net/rpc"
 	"sync"
+	"time"
 )
 
-// First two back-end nodes
+// Time allowed to connect to a node before treating it as unresponsive
+const dialTimeout = time.Second
+
+// Maximum number of times to forward a write rejected for a stale epoch
+const maxForwardAttempts = 3
+
+// Error returned by a node sent a write which it cannot perform, as it is
+// not the head of the chain
+var ErrNotHead = errors.New("write sent to a node which is not the head of the chain")
+
+// Ordered membership of the chain of back-end nodes, as seen by a front-end
+// or by one of the nodes.  The leading front-end decides the membership and
+// pushes it to every node and other front-end whenever it changes.
 type NodeChain struct {
-	HeadIpPort string
-	NextIpPort string
-	lock       *sync.RWMutex // read/write mutex for safe concurrent access
+	SelfIpPort string          // ip:port of this node, or back-end ip:port of this front-end
+	IsFrontEnd bool            // whether this is a front-end's view of the chain
+	FrontEnds  []string        // back-end ip:port of each front-end
+	Members    []string        // ip:port of each back-end node, from head to tail
+	Epoch      uint64          // incremented by the leading front-end on every change
+	joining    map[string]bool // members not yet serving reads
+	agreement  *agreement      // front-end only: Raft group agreeing on changes with the other front-ends, or nil
+	nextReader int             // front-end only: position of the member to send the next read to
+	lock       *sync.RWMutex   // read/write mutex for safe concurrent access
 }
 
+// Returns the view of an empty chain held by a front-end with no replicas
 func New() *NodeChain {
+	return NewFrontEnd("", nil)
+}
+
+// Returns the view of an empty chain held by the front-end listening for
+// back-end nodes at selfIpPort, one of the front-ends in frontEndIpPorts.
+// The first front-end in frontEndIpPorts leads, unless the front-ends elect
+// a leader with StartAgreement.
+func NewFrontEnd(selfIpPort string, frontEndIpPorts []string) *NodeChain {
+	chain := NewMember(selfIpPort, frontEndIpPorts)
+	chain.IsFrontEnd = true
+	return chain
+}
+
+// Returns the view of the chain held by the node at selfIpPort, which learns
+// the chain's membership from the front-ends at frontEndIpPorts
+func NewMember(selfIpPort string, frontEndIpPorts []string) *NodeChain {
 	var chain NodeChain
-	chain.HeadIpPort = "" // Initialize node ip:port values
-	chain.NextIpPort = ""
+	chain.SelfIpPort = selfIpPort
+	chain.FrontEnds = frontEndIpPorts
+	chain.joining = map[string]bool{}
 	chain.lock = &sync.RWMutex{} // Initialize read/write mutex
 	return &chain
 }
 
 // Retrieves key-value from the network
+// Reads are spread across every member serving reads.  A member holding
+// changes to the key which the tail has not yet applied asks the tail for
+// the committed value, so reads stay strongly consistent.
 func (chain *NodeChain) Get(args *api.GetArgs, reply *api.ValReply) error {
-	rpcClient, err := chain.connectToFirstLiveNode()
+	rpcClient, err := chain.connectToReader()
 	if err != nil {
 		return err
 	}
@@ -34,125 +74,485 @@ func (chain *NodeChain) Get(args *api.GetArgs, reply *api.ValReply) error {
 	return rpcClient.Call("KeyValService.Get", args, reply)
 }
 
+// Retrieves the committed key-value from the tail, for a node holding
+// changes to the key which the tail has not yet applied
+func (chain *NodeChain) GetCommitted(args *api.GetArgs, reply *api.ValReply) error {
+	return chain.callTail("KeyValService.GetCommitted", args, reply)
+}
+
+// Retrieves a batch of key-values from the network
+func (chain *NodeChain) MultiGet(args *api.MultiGetArgs, reply *api.MultiReply) error {
+	return chain.callTail("KeyValService.MultiGet", args, reply)
+}
+
+// Lists key-values in a key range from the network
+func (chain *NodeChain) Scan(args *api.ScanArgs, reply *api.ScanReply) error {
+	return chain.callTail("KeyValService.Scan", args, reply)
+}
+
+// Waits for changes to key-values in the network
+func (chain *NodeChain) Watch(args *api.WatchArgs, reply *api.WatchReply) error {
+	return chain.callTail("KeyValService.Watch", args, reply)
+}
+
 // Sets key-value in the network
 func (chain *NodeChain) Set(args *api.SetArgs, reply *api.ValReply) error {
-	rpcClient, err := chain.connectToFirstLiveNode()
-	if err != nil {
-		return err
-	}
-	defer rpcClient.Close()
-	return rpcClient.Call("KeyValService.Set", args, reply)
+	return chain.callHead("KeyValService.Set", args, reply)
+}
+
+// Sets a batch of key-values in the network
+func (chain *NodeChain) MultiSet(args *api.MultiSetArgs, reply *api.MultiReply) error {
+	return chain.callHead("KeyValService.MultiSet", args, reply)
+}
+
+// Sets key-value with a time-to-live in the network
+func (chain *NodeChain) SetTTL(args *api.SetTTLArgs, reply *api.ValReply) error {
+	return chain.callHead("KeyValService.SetTTL", args, reply)
 }
 
 // Test-sets key-value in the network
 func (chain *NodeChain) TestSet(args *api.TestSetArgs, reply *api.ValReply) error {
-	rpcClient, err := chain.connectToFirstLiveNode()
+	return chain.callHead("KeyValService.TestSet", args, reply)
+}
+
+// Compare-and-swaps key-value in the network
+func (chain *NodeChain) CompareAndSwap(args *api.CompareAndSwapArgs, reply *api.CompareAndSwapReply) error {
+	return chain.callHead("KeyValService.CompareAndSwap", args, reply)
+}
+
+// Executes a multi-key transaction in the network
+func (chain *NodeChain) Txn(args *api.TxnArgs, reply *api.TxnReply) error {
+	return chain.callHead("KeyValService.Txn", args, reply)
+}
+
+// Removes key-value from the network
+func (chain *NodeChain) Delete(args *api.DeleteArgs, reply *api.ValReply) error {
+	return chain.callHead("KeyValService.Delete", args, reply)
+}
+
+// Copies all key-values from the network, with their expiry times
+func (chain *NodeChain) GetSnapshot(reply *api.SnapshotReply) error {
+	return chain.callTail("KeyValService.GetSnapshot", 0, reply)
+}
+
+// Sends an RPC call to the first live node in the chain
+// Writes enter the chain at its head.  If the node refuses the write because
+// it is not the head, this view or the node's is out of date, so the later
+// membership is adopted by both and the write is sent again.
+func (chain *NodeChain) callHead(serviceMethod string, args interface{}, reply interface{}) error {
+	for attempt := 0; ; attempt++ {
+		rpcClient, err := chain.connectToSuccessor()
+		if err != nil {
+			return err
+		}
+		err = rpcClient.Call(serviceMethod, args, reply)
+		if err == nil || err.Error() != ErrNotHead.Error() || attempt == maxForwardAttempts-1 {
+			rpcClient.Close()
+			return err
+		}
+		chain.syncMembership(rpcClient)
+		rpcClient.Close()
+	}
+}
+
+// Exchange memberships with the node connected to by rpcClient, adopting
+// its membership if it is later, or otherwise sending it this view's
+func (chain *NodeChain) syncMembership(rpcClient *rpc.Client) {
+	membership := api.Membership{}
+	if err := rpcClient.Call("KeyValService.GetMembership", chain.SelfIpPort, &membership); err != nil {
+		return
+	}
+	if !chain.adopt(membership) {
+		chain.lock.RLock()
+		membership = chain.membership()
+		chain.lock.RUnlock()
+		rpcClient.Call("KeyValService.UpdateMembership", membership, &api.ValReply{})
+	}
+}
+
+// Sends an RPC call to the last node in the chain
+// Reads are served by the tail, which only holds writes that every node has applied.
+func (chain *NodeChain) callTail(serviceMethod string, args interface{}, reply interface{}) error {
+	rpcClient, err := chain.connectToTail()
 	if err != nil {
 		return err
 	}
 	defer rpcClient.Close()
-	return rpcClient.Call("KeyValService.TestSet", args, reply)
+	return rpcClient.Call(serviceMethod, args, reply)
+}
+
+// Forwards changes to the next live node in the chain, tagged with this
+// node's epoch, and waits for its reply, which arrives once every subsequent
+// node has applied the changes, or the next node reports a gap before them.
+// If the next node rejects the changes because it has a later membership,
+// adopts that membership and forwards the changes again.
+// Returns nil without forwarding if there are no subsequent nodes.
+func (chain *NodeChain) Forward(args *api.ReplicateArgs, reply *api.ReplicateReply) error {
+	for attempt := 0; ; attempt++ {
+		if len(chain.successors()) == 0 {
+			return nil
+		}
+		chain.lock.RLock()
+		args.Epoch = chain.Epoch
+		chain.lock.RUnlock()
+
+		*reply = api.ReplicateReply{}
+		err := chain.callHead("KeyValService.Replicate", args, reply)
+		if err != nil && len(chain.successors()) == 0 {
+			return nil // All subsequent nodes have failed, so this node is now the tail
+		} else if err != nil || !reply.Rejected {
+			return err
+		}
+		if !chain.adopt(reply.Membership) || attempt == maxForwardAttempts-1 {
+			return errors.New(fmt.Sprintf("Forward: changes rejected by next node in epoch %d", reply.Membership.Epoch))
+		}
+	}
+}
+
+// Checks the epoch of a write forwarded by the previous node in the chain
+// Returns false, with this node's membership in reply, if the sender's
+// membership is older than this node's.  If the sender's membership is
+// newer, first fetches it from the front-ends.
+func (chain *NodeChain) AcceptEpoch(epoch uint64, reply *api.ReplicateReply) bool {
+	chain.lock.RLock()
+	current := chain.Epoch
+	chain.lock.RUnlock()
+	if epoch > current {
+		chain.Refresh()
+	} else if epoch < current {
+		reply.Rejected = true
+		chain.GetMembership(&reply.Membership)
+		return false
+	}
+	return true
 }
 
-// Adds a new back-end node to the network
-// Returns "success" if the node has been added to the end of the chain, or
-//   the ip:port of the next node if there are more nodes to visit
-func (chain *NodeChain) Join(args *api.JoinArgs, reply *api.ValReply) error {
+// Adds a new back-end node to the end of the chain, or a node rejoining
+// after being removed directly after args.After, if it is still a member
+// Returns the new membership, which is also pushed to every other node.
+func (chain *NodeChain) Join(args *api.JoinArgs, reply *api.Membership) error {
 	if args.IpPort == "" {
 		return errors.New("Join: expected an ip:port, received empty string")
 	}
 
-	chain.lock.Lock()
-	if chain.HeadIpPort == "" {
-		chain.HeadIpPort = args.IpPort
-		reply.Val = "success"
-	} else if chain.NextIpPort == "" {
-		chain.NextIpPort = args.IpPort
-		reply.Val = chain.HeadIpPort
-	} else {
-		// Forward node to head instead of next so that each node
-		// is aware of the next two in the chain
-		reply.Val = chain.HeadIpPort
+	membership, leading, err := chain.change(membershipChange{Join: args})
+	if !leading {
+		err := chain.callLeader("KeyValService.Join", args, reply)
+		if err == nil {
+			chain.adopt(*reply)
+		}
+		return err
 	}
-	chain.lock.Unlock()
+	*reply = membership
+	return err
+}
+
+// Removes a leaving or failed back-end node from the chain
+// The new membership is pushed to every remaining node.
+// A front-end which is not leading links around the node and tells the leader.
+func (chain *NodeChain) Leave(args *api.LeaveArgs, reply *api.ValReply) error {
+	if args.IpPort == "" {
+		return errors.New("Leave: expected an ip:port, received empty string")
+	}
+	chain.removeMember(args.IpPort)
+	reply.Val = "success"
+	return nil
+}
+
+// Records that a node which has joined the end of the chain can serve reads
+func (chain *NodeChain) Activate(args *api.JoinArgs, reply *api.ValReply) error {
+	if args.IpPort == "" {
+		return errors.New("Activate: expected an ip:port, received empty string")
+	}
+	_, leading, err := chain.change(membershipChange{Activate: args.IpPort})
+	if !leading {
+		return chain.callLeader("KeyValService.Activate", args, reply)
+	} else if err != nil {
+		return err
+	}
+	reply.Val = "success"
 	return nil
 }
 
-// GetNextNodes RPC call: returns ip:port addresses of next nodes in chain
-func (chain *NodeChain) GetNextNodes(reply *api.GetNextNodesReply) error {
+// GetMembership RPC call: returns the members of the chain and their epoch
+func (chain *NodeChain) GetMembership(reply *api.Membership) error {
 	chain.lock.RLock()
-	reply.HeadIpPort = chain.HeadIpPort
-	reply.NextIpPort = chain.NextIpPort
+	*reply = chain.membership()
 	chain.lock.RUnlock()
 	return nil
 }
 
+// UpdateMembership RPC call: adopts a membership pushed by the leading front-end,
+// unless a later one has already been adopted
+func (chain *NodeChain) UpdateMembership(args *api.Membership, reply *api.ValReply) error {
+	chain.adopt(*args)
+	reply.Val = "success"
+	return nil
+}
+
+// Returns the ip:port of the node before this one in the chain,
+// or "" if this node is the head
+func (chain *NodeChain) Predecessor() string {
+	chain.lock.RLock()
+	defer chain.lock.RUnlock()
+	for i, member := range chain.Members {
+		if member == chain.SelfIpPort && i > 0 {
+			return chain.Members[i-1]
+		}
+	}
+	return ""
+}
+
 // Print contents of chain for debugging purposes
 func (chain *NodeChain) Print(prefix string) {
-	fmt.Printf("%sNodeChain{%s, %s}\n", prefix, chain.HeadIpPort, chain.NextIpPort)
+	chain.lock.RLock()
+	defer chain.lock.RUnlock()
+	fmt.Printf("%sNodeChain{epoch %d: %v, joining %v}\n", prefix, chain.Epoch, chain.Members, chain.joining)
 }
 
-// Connect to the first live node in the chain,
-// removing unresponsive nodes as they are encountered
-func (chain *NodeChain) connectToFirstLiveNode() (*rpc.Client, error) {
-	var rpcClient *rpc.Client
+// Returns a copy of the chain's membership
+// Caller must hold the chain's lock
+func (chain *NodeChain) membership() api.Membership {
+	membership := api.Membership{Epoch: chain.Epoch, Members: append([]string{}, chain.Members...)}
+	for _, member := range chain.Members {
+		if chain.joining[member] {
+			membership.Joining = append(membership.Joining, member)
+		}
+	}
+	return membership
+}
+
+// Replace the chain's membership if the given one is more recent
+// Returns whether it was replaced.
+func (chain *NodeChain) adopt(membership api.Membership) bool {
 	chain.lock.Lock()
 	defer chain.lock.Unlock()
+	if membership.Epoch <= chain.Epoch {
+		return false
+	}
+	chain.replace(membership)
+	return true
+}
 
-	if chain.HeadIpPort == "" {
-		return rpcClient, storeUnavailableError()
+// Replace the chain's membership
+// Caller must hold the chain's lock
+func (chain *NodeChain) replace(membership api.Membership) {
+	chain.Epoch = membership.Epoch
+	chain.Members = append([]string{}, membership.Members...)
+	chain.joining = map[string]bool{}
+	for _, member := range membership.Joining {
+		chain.joining[member] = true
 	}
-	rpcClient, err := rpc_util.Connect(chain.HeadIpPort)
-	if err != nil && chain.NextIpPort != "" {
-		chain.HeadIpPort = chain.NextIpPort
-		chain.NextIpPort = ""
-		rpcClient, err = rpc_util.Connect(chain.HeadIpPort)
+}
+
+// Fetch the memberships held by the other front-ends, adopting the most recent
+func (chain *NodeChain) Refresh() {
+	for _, ipPort := range chain.otherFrontEnds() {
+		rpcClient, err := chain.dial(ipPort, dialTimeout)
+		if err != nil {
+			continue
+		}
+		membership := api.Membership{}
+		err = rpcClient.Call("KeyValService.GetMembership", chain.SelfIpPort, &membership)
+		rpcClient.Close()
+		if err == nil {
+			chain.adopt(membership)
+		}
 	}
-	go chain.updateEndOfChain()
-	return rpcClient, err
 }
 
-// Connect to the last node in the chain that is live,
-// removing unresponsive tail nodes as they are encountered
-func (chain *NodeChain) connectToLastInChain() (*rpc.Client, error) {
-	chain.lock.Lock()
-	defer chain.lock.Unlock()
-	rpcClient, err := rpc_util.Connect(chain.NextIpPort)
-	if err == nil {
-		return rpcClient, err
+// Returns whether this node is a member of the chain
+func (chain *NodeChain) IsMember() bool {
+	chain.lock.RLock()
+	defer chain.lock.RUnlock()
+	return contains(chain.Members, chain.SelfIpPort)
+}
+
+// Returns whether this node is the first member, which performs every write
+func (chain *NodeChain) IsHead() bool {
+	chain.lock.RLock()
+	defer chain.lock.RUnlock()
+	return len(chain.Members) > 0 && chain.Members[0] == chain.SelfIpPort
+}
+
+// Returns ErrNotHead unless this node is the head, so that a write sent by a
+// front-end with an out of date membership is not given a sequence number
+// which the head gives to a different change
+func (chain *NodeChain) CheckHead() error {
+	if !chain.IsHead() {
+		return ErrNotHead
 	}
-	chain.NextIpPort = "" // Next is unresponsive, remove from chain
-	rpcClient, err = rpc_util.Connect(chain.HeadIpPort)
-	if err != nil {
-		chain.HeadIpPort = "" // Head is unresponsive, remove from chain
+	return nil
+}
+
+// Returns whether this node is the last member serving reads, which holds
+// only changes that every member serving reads has applied
+func (chain *NodeChain) IsTail() bool {
+	readers := chain.readers()
+	return len(readers) > 0 && readers[len(readers)-1] == chain.SelfIpPort
+}
+
+// Returns whether this node is the last member, including members still
+// joining, so that every change it has applied is committed
+func (chain *NodeChain) IsLast() bool {
+	chain.lock.RLock()
+	defer chain.lock.RUnlock()
+	return len(chain.Members) > 0 && chain.Members[len(chain.Members)-1] == chain.SelfIpPort
+}
+
+// Returns the members serving reads, from head to tail
+func (chain *NodeChain) readers() []string {
+	chain.lock.RLock()
+	defer chain.lock.RUnlock()
+	var readers []string
+	for _, member := range chain.Members {
+		if !chain.joining[member] {
+			readers = append(readers, member)
+		}
 	}
-	return rpcClient, err
+	return readers
 }
 
-// If chain is not full, contact the last known node
-// to obtain the addresses to any subsequent nodes
-func (chain *NodeChain) updateEndOfChain() {
-	connLastLive, err := chain.connectToLastInChain()
-	if err != nil {
-		fmt.Printf("Error updating chain: %s\n", err.Error())
+// Returns the members after this node in the chain, or every member on a
+// front-end.  Returns none if this node is no longer a member.
+func (chain *NodeChain) successors() []string {
+	chain.lock.RLock()
+	defer chain.lock.RUnlock()
+	if chain.IsFrontEnd {
+		return append([]string{}, chain.Members...)
+	}
+	for i, member := range chain.Members {
+		if member == chain.SelfIpPort {
+			return append([]string{}, chain.Members[i+1:]...)
+		}
+	}
+	return nil
+}
+
+// Remove an unresponsive or leaving node from the chain
+// The leading front-end pushes the new membership to every node, while other
+// front-ends and nodes link around it locally and report it to the leader.
+func (chain *NodeChain) removeMember(ipPort string) {
+	chain.lock.Lock()
+	if !contains(chain.Members, ipPort) {
+		chain.lock.Unlock()
 		return
 	}
-	defer connLastLive.Close()
-	reply := api.GetNextNodesReply{}
-	err = connLastLive.Call("KeyValService.GetNextNodes", 0, &reply)
+	if !chain.isLeader() {
+		chain.Members = without(chain.Members, ipPort)
+		delete(chain.joining, ipPort)
+	}
+	chain.lock.Unlock()
+
+	_, leading, err := chain.change(membershipChange{Leave: ipPort})
+	if !leading && chain.IsFrontEnd {
+		err = chain.callLeader("KeyValService.Leave", &api.LeaveArgs{IpPort: ipPort}, &api.ValReply{})
+	} else if !leading {
+		for _, frontEndIpPort := range chain.FrontEnds {
+			err = chain.callFrontEnd(frontEndIpPort, "KeyValService.Leave", &api.LeaveArgs{IpPort: ipPort}, &api.ValReply{})
+			if err == nil {
+				return
+			}
+		}
+	}
 	if err != nil {
-		fmt.Printf("Error calling KeyValService.GetNextNodes: %s\n", err.Error())
-	} else {
-		chain.appendToLocalChain(reply.HeadIpPort)
-		chain.appendToLocalChain(reply.NextIpPort)
+		fmt.Printf("Error reporting failure of %s: %s\n", ipPort, err.Error())
+	}
+}
+
+// Send a membership to every member and other front-end, waiting for each
+// to adopt it or fail
+// Unresponsive members are left to the failure detector.
+func (chain *NodeChain) push(membership api.Membership) {
+	pushed := sync.WaitGroup{}
+	for _, ipPort := range append(membership.Members, chain.otherFrontEnds()...) {
+		pushed.Add(1)
+		go func(ipPort string) {
+			defer pushed.Done()
+			rpcClient, err := chain.dial(ipPort, dialTimeout)
+			if err != nil {
+				return
+			}
+			defer rpcClient.Close()
+			rpcClient.Call("KeyValService.UpdateMembership", membership, &api.ValReply{})
+		}(ipPort)
+	}
+	pushed.Wait()
+}
+
+// Connect to the node or front-end at ipPort, giving up after timeout
+// Connections are made as this node, so that a test transport can cut off
+// nodes which have crashed or are partitioned.
+func (chain *NodeChain) dial(ipPort string, timeout time.Duration) (*rpc.Client, error) {
+	return rpc_util.DialFrom(chain.SelfIpPort, ipPort, timeout)
+}
+
+// Connect to the first live node after this one in the chain,
+// removing unresponsive nodes as they are encountered
+func (chain *NodeChain) connectToSuccessor() (*rpc.Client, error) {
+	for _, ipPort := range chain.successors() {
+		rpcClient, err := chain.dial(ipPort, dialTimeout)
+		if err == nil {
+			return rpcClient, err
+		}
+		chain.removeMember(ipPort)
+	}
+	return nil, storeUnavailableError()
+}
+
+// Connect to the last live node in the chain that is serving reads,
+// removing unresponsive nodes as they are encountered
+func (chain *NodeChain) connectToTail() (*rpc.Client, error) {
+	readers := chain.readers()
+	for i := len(readers) - 1; i >= 0; i-- {
+		rpcClient, err := chain.dial(readers[i], dialTimeout)
+		if err == nil {
+			return rpcClient, err
+		}
+		chain.removeMember(readers[i])
+	}
+	return nil, storeUnavailableError()
+}
+
+// Connect to a live node serving reads, taking each in turn so that reads
+// are spread across the chain, removing unresponsive nodes as they are encountered
+func (chain *NodeChain) connectToReader() (*rpc.Client, error) {
+	readers := chain.readers()
+	chain.lock.Lock()
+	start := chain.nextReader
+	chain.nextReader++
+	chain.lock.Unlock()
+
+	for i := range readers {
+		ipPort := readers[(start+i)%len(readers)]
+		rpcClient, err := chain.dial(ipPort, dialTimeout)
+		if err == nil {
+			return rpcClient, err
+		}
+		chain.removeMember(ipPort)
+	}
+	return nil, storeUnavailableError()
+}
+
+// Returns whether ipPorts includes ipPort
+func contains(ipPorts []string, ipPort string) bool {
+	for _, member := range ipPorts {
+		if member == ipPort {
+			return true
+		}
 	}
+	return false
 }
 
-// Add ip:port to end of current node's local chain
-func (chain *NodeChain) appendToLocalChain(ipPort string) {
-	if ipPort != "" {
-		chain.Join(&api.JoinArgs{ipPort}, &api.ValReply{})
+// Returns a copy of ipPorts without ipPort
+func without(ipPorts []string, ipPort string) []string {
+	remaining := []string{}
+	for _, member := range ipPorts {
+		if member != ipPort {
+			remaining = append(remaining, member)
+		}
 	}
+	return remaining
 }
 
 func storeUnavailableError() error {
@@ -0,0 +1,247 @@
+package nodechain
+
+import (
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// Address which refuses connections, for members which are never contacted
+func unreachable(i int) string {
+	return fmt.Sprintf("127.0.0.1:%d", 1+i)
+}
+
+func TestJoin_ConcurrentJoinsGetDistinctEpochs(t *testing.T) {
+	frontEnd := New()
+	replies := make([]api.Membership, 20)
+	joined := sync.WaitGroup{}
+	for i := range replies {
+		joined.Add(1)
+		go func(i int) {
+			defer joined.Done()
+			frontEnd.Join(&api.JoinArgs{IpPort: unreachable(i)}, &replies[i])
+		}(i)
+	}
+	joined.Wait()
+
+	epochs := map[uint64]bool{}
+	for i, reply := range replies {
+		epochs[reply.Epoch] = true
+		if last := reply.Members[len(reply.Members)-1]; last != unreachable(i) {
+			t.Errorf("Join(%s) returned members ending with %s", unreachable(i), last)
+		}
+		if len(reply.Members) != int(reply.Epoch) {
+			t.Errorf("Join(%s) returned %d members in epoch %d", unreachable(i), len(reply.Members), reply.Epoch)
+		}
+	}
+	if len(epochs) != len(replies) {
+		t.Errorf("%d joins returned %d distinct epochs", len(replies), len(epochs))
+	}
+	if len(frontEnd.Members) != len(replies) {
+		t.Errorf("Chain had %d members after %d joins", len(frontEnd.Members), len(replies))
+	}
+}
+
+func TestJoin_FollowerForwardsToLeader(t *testing.T) {
+	leaderListener, leaderIpPort := listen(t)
+	followerListener, followerIpPort := listen(t)
+	frontEnds := []string{leaderIpPort, followerIpPort}
+	leader := serveFakeNode(t, leaderListener, NewFrontEnd(leaderIpPort, frontEnds))
+	follower := serveFakeNode(t, followerListener, NewFrontEnd(followerIpPort, frontEnds))
+
+	reply := api.Membership{}
+	if err := follower.chain.Join(&api.JoinArgs{IpPort: unreachable(0)}, &reply); err != nil {
+		t.Fatalf("Join on follower returned unexpected error: %s", err.Error())
+	}
+	follower.chain.Activate(&api.JoinArgs{IpPort: unreachable(0)}, &api.ValReply{})
+	for _, frontEnd := range []*fakeNode{leader, follower} {
+		membership := api.Membership{}
+		frontEnd.chain.GetMembership(&membership)
+		if membership.Epoch != 2 || len(membership.Members) != 1 || len(membership.Joining) != 0 {
+			t.Errorf("Membership after join and activation was %v, expected 1 active member in epoch 2", membership)
+		}
+	}
+}
+
+func TestJoin_RejoinsAfterPredecessor(t *testing.T) {
+	frontEnd := New()
+	for i := 0; i < 3; i++ {
+		frontEnd.Join(&api.JoinArgs{IpPort: unreachable(i)}, &api.Membership{})
+	}
+	frontEnd.Leave(&api.LeaveArgs{IpPort: unreachable(1)}, &api.ValReply{})
+
+	reply := api.Membership{}
+	frontEnd.Join(&api.JoinArgs{IpPort: unreachable(1), After: unreachable(0)}, &reply)
+	if fmt.Sprint(reply.Members) != fmt.Sprint([]string{unreachable(0), unreachable(1), unreachable(2)}) {
+		t.Errorf("Members after rejoining after %s were %v, expected original order", unreachable(0), reply.Members)
+	}
+	frontEnd.Join(&api.JoinArgs{IpPort: unreachable(0), After: unreachable(5)}, &reply)
+	if last := reply.Members[len(reply.Members)-1]; last != unreachable(0) {
+		t.Errorf("Members after rejoining after a non-member were %v, expected %s last", reply.Members, unreachable(0))
+	}
+}
+
+func TestJoin_ConcurrentJoinsAndFailures(t *testing.T) {
+	head, headIpPort := startFakeNode(t, false)
+	frontEnd := New()
+	frontEnd.Join(&api.JoinArgs{IpPort: headIpPort}, &api.Membership{})
+	for i := 0; i < 10; i++ {
+		frontEnd.Join(&api.JoinArgs{IpPort: unreachable(i)}, &api.Membership{})
+	}
+
+	// Fail half of the joined nodes while as many new nodes join
+	expected := []string{headIpPort}
+	changed := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		changed.Add(1)
+		if i%2 == 0 {
+			go func(i int) {
+				defer changed.Done()
+				frontEnd.Leave(&api.LeaveArgs{IpPort: unreachable(i)}, &api.ValReply{})
+			}(i)
+		} else {
+			expected = append(expected, unreachable(i), unreachable(10+i))
+			go func(i int) {
+				defer changed.Done()
+				frontEnd.Join(&api.JoinArgs{IpPort: unreachable(10 + i)}, &api.Membership{})
+			}(i)
+		}
+	}
+	changed.Wait()
+
+	final := api.Membership{}
+	frontEnd.GetMembership(&final)
+	if final.Epoch != 21 {
+		t.Errorf("Epoch after 16 joins and 5 failures was %d, expected 21", final.Epoch)
+	}
+	members := append([]string{}, final.Members...)
+	sort.Strings(members)
+	sort.Strings(expected)
+	if fmt.Sprint(members) != fmt.Sprint(expected) {
+		t.Errorf("Members after joins and failures were %v, expected %v", final.Members, expected)
+	}
+	if final.Members[0] != headIpPort {
+		t.Errorf("Head after joins and failures was %s, expected %s", final.Members[0], headIpPort)
+	}
+
+	// Pushes may arrive out of order, but the head keeps the latest
+	pushed := api.Membership{}
+	head.chain.GetMembership(&pushed)
+	if fmt.Sprint(pushed) != fmt.Sprint(final) {
+		t.Errorf("Head's membership was %v, expected %v", pushed, final)
+	}
+}
+
+func TestUpdateMembership_IgnoresStaleEpoch(t *testing.T) {
+	chain := NewMember("a", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 3, Members: []string{"a", "c"}}, &api.ValReply{})
+	chain.UpdateMembership(&api.Membership{Epoch: 2, Members: []string{"a", "b", "c"}}, &api.ValReply{})
+	if fmt.Sprint(chain.Members) != "[a c]" || chain.Epoch != 3 {
+		t.Errorf("Membership after stale update was %v in epoch %d, expected [a c] in epoch 3", chain.Members, chain.Epoch)
+	}
+}
+
+func TestAcceptEpoch_RejectsOlderEpoch(t *testing.T) {
+	chain := NewMember("b", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 5, Members: []string{"a", "b"}}, &api.ValReply{})
+	reply := api.ReplicateReply{}
+	if chain.AcceptEpoch(4, &reply) {
+		t.Errorf("AcceptEpoch(4) in epoch 5 accepted a stale write")
+	}
+	if !reply.Rejected || reply.Membership.Epoch != 5 {
+		t.Errorf("AcceptEpoch(4) in epoch 5 replied %v, expected rejection with epoch 5", reply)
+	}
+	if reply = (api.ReplicateReply{}); !chain.AcceptEpoch(5, &reply) || reply.Rejected {
+		t.Errorf("AcceptEpoch(5) in epoch 5 rejected a current write")
+	}
+}
+
+func TestForward_RetriesAfterStaleEpoch(t *testing.T) {
+	next, nextIpPort := startFakeNode(t, false)
+	chain := NewMember("self", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{"self", nextIpPort}}, &api.ValReply{})
+	next.chain.UpdateMembership(&api.Membership{Epoch: 2, Members: []string{"self", nextIpPort, "tail"}}, &api.ValReply{})
+
+	if err := chain.Forward(&api.ReplicateArgs{Mutations: []kvstore.Mutation{{Seq: 1, Key: "a", Value: "1"}}}, &api.ReplicateReply{}); err != nil {
+		t.Fatalf("Forward returned unexpected error: %s", err.Error())
+	}
+	next.lock.Lock()
+	defer next.lock.Unlock()
+	if next.applied != 1 {
+		t.Errorf("Next node applied %d writes, expected 1", next.applied)
+	}
+	if chain.Epoch != 2 {
+		t.Errorf("Epoch after rejected write was %d, expected 2", chain.Epoch)
+	}
+}
+
+func TestForward_NoSuccessors(t *testing.T) {
+	chain := NewMember("tail", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{"head", "tail"}}, &api.ValReply{})
+	if err := chain.Forward(&api.ReplicateArgs{Mutations: []kvstore.Mutation{{Seq: 1, Key: "a", Deleted: true}}}, &api.ReplicateReply{}); err != nil {
+		t.Errorf("Forward from the tail returned unexpected error: %s", err.Error())
+	}
+}
+
+func TestGet_SpreadsReadsAcrossActiveMembers(t *testing.T) {
+	frontEnd := New()
+	nodes := []*fakeNode{}
+	for i := 0; i < 3; i++ {
+		node, ipPort := startFakeNode(t, false)
+		nodes = append(nodes, node)
+		frontEnd.Join(&api.JoinArgs{IpPort: ipPort}, &api.Membership{})
+		if i < 2 {
+			frontEnd.Activate(&api.JoinArgs{IpPort: ipPort}, &api.ValReply{})
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := frontEnd.Get(&api.GetArgs{Key: "a"}, &api.ValReply{}); err != nil {
+			t.Fatalf("Get returned unexpected error: %s", err.Error())
+		}
+	}
+	for i, node := range nodes {
+		expected := 5
+		if i == 2 {
+			expected = 0
+		}
+		if node.reads != expected {
+			t.Errorf("Member %d served %d reads, expected %d", i, node.reads, expected)
+		}
+	}
+
+	// Reads skip members which have failed
+	nodes[0].stop()
+	for i := 0; i < 2; i++ {
+		reply := api.ValReply{}
+		if err := frontEnd.Get(&api.GetArgs{Key: "a"}, &reply); err != nil || reply.Val != nodes[1].chain.SelfIpPort {
+			t.Errorf("Get after the head failed was served by %s, error %v, expected %s", reply.Val, err, nodes[1].chain.SelfIpPort)
+		}
+	}
+}
+
+func TestIsTail_IgnoresJoiningMembers(t *testing.T) {
+	chain := NewMember("b", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{"a", "b", "c"}, Joining: []string{"c"}}, &api.ValReply{})
+	if !chain.IsTail() {
+		t.Errorf("Last active member was not the tail while the next member was joining")
+	}
+	chain.UpdateMembership(&api.Membership{Epoch: 2, Members: []string{"a", "b", "c"}}, &api.ValReply{})
+	if chain.IsTail() {
+		t.Errorf("Member was still the tail after the next member was activated")
+	}
+}
+
+func TestIsLast_CountsJoiningMembers(t *testing.T) {
+	chain := NewMember("b", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{"a", "b", "c"}, Joining: []string{"c"}}, &api.ValReply{})
+	if chain.IsLast() {
+		t.Errorf("Tail was the last member while the next member was joining")
+	}
+	chain.UpdateMembership(&api.Membership{Epoch: 2, Members: []string{"a", "b"}}, &api.ValReply{})
+	if !chain.IsLast() {
+		t.Errorf("Tail was not the last member after the joining member was removed")
+	}
+}
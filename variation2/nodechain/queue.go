@@ -0,0 +1,308 @@
+package nodechain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maximum number of writes whose changes are passed on in one call
+const maxBatchWrites = 256
+
+// Time to wait before passing changes on again after a failed attempt,
+// doubling after each further failure up to maxRetryInterval
+const retryInterval = 50 * time.Millisecond
+const maxRetryInterval = 2 * time.Second
+
+// Time a write waits for the rest of the chain to apply its changes
+const ackTimeout = 5 * time.Second
+
+// Ordered queue of changes waiting to be passed on to the next live node in
+// the chain.  Changes are numbered by the sequence number given by the head,
+// and a single goroutine sends them in that order, several writes at a time.
+// Each change is kept until the next node acknowledges it, once every
+// subsequent node has applied it, so that it can be sent again if the next
+// node fails, is replaced, or reports a gap.
+// Acknowledged changes are then kept in a bounded replication log, so that a
+// node which missed them while briefly unreachable can catch up from the log.
+// Keys with unacknowledged changes are dirty: their value on this node may
+// not yet be applied by the tail, so reads of them are served by the tail.
+type ReplicationQueue struct {
+	chain    *NodeChain
+	debugLog func(msgPattern string, a ...interface{}) // prints failures to pass changes on, if not nil
+	log      [][]kvstore.Mutation                      // changes of recent acknowledged writes, in sequence order
+	logSize  int                                       // maximum number of changes in log
+	logged   int                                       // number of changes in log
+	pending  [][]kvstore.Mutation                      // changes of each write not yet acknowledged, in sequence order
+	acked    uint64                                    // sequence number of the last change acknowledged
+	dirty    map[string]uint64                         // sequence number of the last unacknowledged change to each key
+	last     kvstore.Mutation                          // last change pushed
+	stopped  bool
+	cond     *sync.Cond // signalled when changes are pushed or acknowledged, or the queue stops
+	lock     *sync.Mutex
+}
+
+// Returns an empty queue for passing changes on to the successors of chain,
+// keeping up to logSize acknowledged changes for nodes catching up
+// Failed attempts to pass changes on are printed with debugLog, which may be nil.
+func NewReplicationQueue(chain *NodeChain, logSize int, debugLog func(msgPattern string, a ...interface{})) *ReplicationQueue {
+	lock := &sync.Mutex{}
+	return &ReplicationQueue{chain: chain, debugLog: debugLog, logSize: logSize, dirty: map[string]uint64{}, cond: sync.NewCond(lock), lock: lock}
+}
+
+// Starts passing on pushed changes, treating every change up to sequence
+// number acked as already applied by the rest of the chain
+func (queue *ReplicationQueue) Start(acked uint64) {
+	queue.Reset(acked)
+	go queue.run()
+}
+
+// Discards every change, treating every change up to sequence number seq as
+// applied by the rest of the chain, such as after replacing the store's
+// contents with a snapshot taken at seq
+func (queue *ReplicationQueue) Reset(seq uint64) {
+	queue.lock.Lock()
+	queue.log, queue.logged, queue.pending = nil, 0, nil
+	queue.dirty = map[string]uint64{}
+	queue.acked, queue.last = seq, kvstore.Mutation{Seq: seq}
+	queue.lock.Unlock()
+	queue.cond.Broadcast()
+}
+
+// Stops passing on changes, failing writes waiting for acknowledgement
+func (queue *ReplicationQueue) Stop() {
+	queue.lock.Lock()
+	queue.stopped = true
+	queue.lock.Unlock()
+	queue.cond.Broadcast()
+}
+
+// Adds the changes made by a write to the end of the queue
+// Must be called in sequence order, such as from a kvstore.KVStore.OnMutation hook.
+// Changes numbered no later than ones already pushed, such as anti-entropy
+// repairs, are left out, since the next node is repaired separately.
+func (queue *ReplicationQueue) Push(mutations []kvstore.Mutation) {
+	queue.lock.Lock()
+	changes := []kvstore.Mutation{}
+	for _, m := range mutations {
+		if m.Seq > queue.last.Seq {
+			changes = append(changes, m)
+			queue.dirty[m.Key] = m.Seq
+			queue.last = m
+		}
+	}
+	if len(changes) == 0 {
+		queue.lock.Unlock()
+		return
+	}
+	queue.pending = append(queue.pending, changes)
+	queue.lock.Unlock()
+	queue.cond.Broadcast()
+}
+
+// Blocks until every change up to sequence number seq has been applied by
+// the rest of the chain
+func (queue *ReplicationQueue) Wait(seq uint64) error {
+	timer := time.AfterFunc(ackTimeout, queue.cond.Broadcast)
+	defer timer.Stop()
+	deadline := time.Now().Add(ackTimeout)
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for queue.acked < seq {
+		if queue.stopped {
+			return errors.New("Replication stopped before write was applied by every node")
+		} else if !time.Now().Before(deadline) {
+			return errors.New(fmt.Sprintf("Write %d was not applied by every node within %s", seq, ackTimeout))
+		}
+		queue.cond.Wait()
+	}
+	return nil
+}
+
+// Returns the sequence number of the last change acknowledged by the rest of the chain
+func (queue *ReplicationQueue) Acked() uint64 {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.acked
+}
+
+// Returns whether key has changes not yet acknowledged by the rest of the chain
+func (queue *ReplicationQueue) Dirty(key string) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	_, dirty := queue.dirty[key]
+	return dirty
+}
+
+// Returns the last change pushed, which has only its sequence number set
+// if the queue was reset since
+func (queue *ReplicationQueue) Last() kvstore.Mutation {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.last
+}
+
+// Returns every change after last, which had sequence number seq, for a node
+// catching up after missing them
+// Returns false if some of the changes are no longer in the log, or this
+// node's change numbered seq differs from last, such as when the catching up
+// node applied changes which were lost when the head failed.
+func (queue *ReplicationQueue) Since(seq uint64, last kvstore.Mutation) ([]kvstore.Mutation, bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if last.Seq != seq || seq > queue.last.Seq {
+		return nil, false
+	} else if seq == queue.last.Seq {
+		return []kvstore.Mutation{}, sameMutation(last, queue.last)
+	}
+	changes := []kvstore.Mutation{}
+	matched := seq == 0
+	for _, write := range queue.retained(0, len(queue.log)+len(queue.pending)) {
+		for _, m := range write {
+			if m.Seq == seq {
+				matched = sameMutation(m, last)
+			} else if m.Seq > seq {
+				changes = append(changes, m)
+			}
+		}
+	}
+	if !matched || len(changes) == 0 || changes[0].Seq != seq+1 {
+		return nil, false
+	}
+	return changes, true
+}
+
+// Send pending changes to the next live node, oldest first, until stopped
+// If the next node reports a gap, such as after rejoining the chain, sends
+// it the changes it is missing from the log.  Failed attempts are retried
+// after a delay which grows while they keep failing.
+func (queue *ReplicationQueue) run() {
+	resendFrom := uint64(0) // sequence number of the last change the next node reported applying
+	resending := false
+	backoff := retryInterval
+	for {
+		batch, ok := queue.nextBatch(resendFrom, resending)
+		if !ok {
+			return
+		}
+		reply := api.ReplicateReply{}
+		err := queue.chain.Forward(&api.ReplicateArgs{Mutations: batch}, &reply)
+		if err == nil && reply.Gap {
+			if queue.holds(reply.Seq) {
+				resendFrom, resending = reply.Seq, true
+				continue
+			}
+			err = errors.New(fmt.Sprintf("next node has only applied changes up to %d, which are no longer in the log", reply.Seq))
+		}
+		resending = false
+		if err != nil {
+			if queue.debugLog != nil {
+				queue.debugLog("Error passing on changes %d to %d, retrying in %s: %s\n", batch[0].Seq, batch[len(batch)-1].Seq, backoff, err.Error())
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxRetryInterval {
+				backoff = maxRetryInterval
+			}
+			continue
+		}
+		backoff = retryInterval
+		queue.acknowledge(batch[len(batch)-1].Seq)
+	}
+}
+
+// Wait for pending changes, then return the changes of the oldest writes,
+// or if resending, of the oldest retained writes after sequence number from
+// Returns false if the queue has stopped.
+func (queue *ReplicationQueue) nextBatch(from uint64, resending bool) ([]kvstore.Mutation, bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for !queue.stopped {
+		writes := queue.pending
+		if resending {
+			writes = queue.retained(from, maxBatchWrites)
+		}
+		if len(writes) > 0 {
+			batch := []kvstore.Mutation{}
+			for i := 0; i < len(writes) && i < maxBatchWrites; i++ {
+				batch = append(batch, writes[i]...)
+			}
+			return batch, true
+		}
+		queue.cond.Wait()
+	}
+	return nil, false
+}
+
+// Drop the changes up to sequence number seq, which the rest of the chain
+// has applied, from the pending changes into the log
+func (queue *ReplicationQueue) acknowledge(seq uint64) {
+	queue.lock.Lock()
+	for len(queue.pending) > 0 && queue.pending[0][len(queue.pending[0])-1].Seq <= seq {
+		for _, m := range queue.pending[0] {
+			if queue.dirty[m.Key] == m.Seq {
+				delete(queue.dirty, m.Key)
+			}
+		}
+		queue.log = append(queue.log, queue.pending[0])
+		queue.logged += len(queue.pending[0])
+		queue.pending = queue.pending[1:]
+	}
+	for len(queue.log) > 0 && queue.logged > queue.logSize {
+		queue.logged -= len(queue.log[0])
+		queue.log = queue.log[1:]
+	}
+	if seq > queue.acked {
+		queue.acked = seq
+	}
+	queue.lock.Unlock()
+	queue.cond.Broadcast()
+}
+
+// Returns whether the log and pending changes hold every change after
+// sequence number seq
+func (queue *ReplicationQueue) holds(seq uint64) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	writes := queue.retained(0, 1)
+	return seq >= queue.last.Seq || (len(writes) > 0 && writes[0][0].Seq <= seq+1)
+}
+
+// Returns up to limit of the writes in the log and pending changes with
+// changes after sequence number seq, in sequence order
+// The writes are only copied if they span both the log and pending changes,
+// so the result may share the queue's storage and must not be modified.
+// Caller must hold the queue's lock while using the result
+func (queue *ReplicationQueue) retained(seq uint64, limit int) [][]kvstore.Mutation {
+	logged, pending := writesAfter(queue.log, seq), writesAfter(queue.pending, seq)
+	if len(logged) >= limit {
+		return logged[:limit]
+	} else if len(pending) > limit-len(logged) {
+		pending = pending[:limit-len(logged)]
+	}
+	if len(logged) == 0 {
+		return pending
+	}
+	writes := make([][]kvstore.Mutation, 0, len(logged)+len(pending))
+	return append(append(writes, logged...), pending...)
+}
+
+// Returns the writes with changes after sequence number seq, given writes in
+// sequence order
+func writesAfter(writes [][]kvstore.Mutation, seq uint64) [][]kvstore.Mutation {
+	i := sort.Search(len(writes), func(i int) bool {
+		return writes[i][len(writes[i])-1].Seq > seq
+	})
+	return writes[i:]
+}
+
+// Returns whether a and b are the same change, including after being sent
+// between nodes
+func sameMutation(a kvstore.Mutation, b kvstore.Mutation) bool {
+	return a.Seq == b.Seq && a.Key == b.Key && a.Value == b.Value &&
+		a.ExpiresAt.Equal(b.ExpiresAt) && a.Deleted == b.Deleted
+}
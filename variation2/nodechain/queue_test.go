@@ -0,0 +1,253 @@
+package nodechain
+
+import (
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"sync"
+	"testing"
+)
+
+// Start a replication queue on a chain from this node to next, passing on
+// every change made to the returned store
+func startQueue(t *testing.T, nextIpPort string) (*ReplicationQueue, *kvstore.KVStore) {
+	chain := NewMember("self", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{"self", nextIpPort}}, &api.ValReply{})
+	store := kvstore.New()
+	queue := NewReplicationQueue(chain, 1000, nil)
+	queue.Start(store.OnMutation(queue.Push))
+	t.Cleanup(queue.Stop)
+	return queue, store
+}
+
+// Start a replication queue on a chain with only this node, keeping up to
+// logSize changes, passing on every change made to the returned store
+func startTailQueue(t *testing.T, logSize int) (*ReplicationQueue, *kvstore.KVStore) {
+	chain := NewMember("self", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{"self"}}, &api.ValReply{})
+	store := kvstore.New()
+	queue := NewReplicationQueue(chain, logSize, nil)
+	queue.Start(store.OnMutation(queue.Push))
+	t.Cleanup(queue.Stop)
+	return queue, store
+}
+
+// Check that changes were received exactly once each, in sequence order
+func checkInOrder(t *testing.T, received []kvstore.Mutation, count int) {
+	if len(received) != count {
+		t.Fatalf("Next node received %d changes, expected %d", len(received), count)
+	}
+	for i, m := range received {
+		if m.Seq != uint64(i+1) {
+			t.Fatalf("Change %d received had sequence number %d, expected %d", i, m.Seq, i+1)
+		}
+	}
+}
+
+func TestReplicationQueue_PassesOnConcurrentWritesInOrder(t *testing.T) {
+	next, nextIpPort := startFakeNode(t, false)
+	queue, store := startQueue(t, nextIpPort)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				store.Set("a", "1")
+				if err := queue.Wait(store.Seq()); err != nil {
+					t.Errorf("Wait returned unexpected error: %s", err.Error())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	next.lock.Lock()
+	defer next.lock.Unlock()
+	checkInOrder(t, next.received, 200)
+	if queue.Acked() != 200 {
+		t.Errorf("Acknowledged sequence number was %d, expected 200", queue.Acked())
+	}
+}
+
+func TestReplicationQueue_ResendsAfterGap(t *testing.T) {
+	next, nextIpPort := startFakeNode(t, false)
+	next.gaps = 2
+	queue, store := startQueue(t, nextIpPort)
+
+	store.Set("a", "1")
+	store.Delete("a")
+	if err := queue.Wait(store.Seq()); err != nil {
+		t.Fatalf("Wait returned unexpected error: %s", err.Error())
+	}
+	next.lock.Lock()
+	defer next.lock.Unlock()
+	checkInOrder(t, next.received, 2)
+}
+
+func TestReplicationQueue_ResendsLoggedChangesToRejoinedNode(t *testing.T) {
+	queue, store := startTailQueue(t, 1000)
+	store.Set("a", "1")
+	store.Set("b", "2")
+	if err := queue.Wait(store.Seq()); err != nil {
+		t.Fatalf("Wait on the tail returned unexpected error: %s", err.Error())
+	}
+
+	// The next node rejoins having applied none of the changes
+	next, nextIpPort := startFakeNode(t, false)
+	next.gaps = 1
+	queue.chain.UpdateMembership(&api.Membership{Epoch: 2, Members: []string{"self", nextIpPort}}, &api.ValReply{})
+	store.Set("c", "3")
+	if err := queue.Wait(store.Seq()); err != nil {
+		t.Fatalf("Wait returned unexpected error: %s", err.Error())
+	}
+	next.lock.Lock()
+	defer next.lock.Unlock()
+	checkInOrder(t, next.received, 3)
+}
+
+func TestReplicationQueue_KeysAreDirtyUntilAcknowledged(t *testing.T) {
+	next, nextIpPort := startFakeNode(t, false)
+	next.gaps = 1 << 30 // never acknowledges
+	queue, store := startQueue(t, nextIpPort)
+	store.Set("a", "1")
+	if !queue.Dirty("a") || queue.Dirty("b") {
+		t.Errorf("Dirty(a), Dirty(b) were %t, %t before acknowledgement, expected true, false", queue.Dirty("a"), queue.Dirty("b"))
+	}
+
+	next.lock.Lock()
+	next.gaps = 0
+	next.lock.Unlock()
+	if err := queue.Wait(store.Seq()); err != nil {
+		t.Fatalf("Wait returned unexpected error: %s", err.Error())
+	}
+	if queue.Dirty("a") {
+		t.Errorf("Dirty(a) was true after acknowledgement, expected false")
+	}
+}
+
+func TestReplicationQueue_SinceReturnsMissedChanges(t *testing.T) {
+	queue, store := startTailQueue(t, 1000)
+	var first kvstore.Mutation
+	store.OnMutation(func(mutations []kvstore.Mutation) {
+		if first.Seq == 0 {
+			first = mutations[0]
+		}
+	})
+	for i := 0; i < 5; i++ {
+		store.Set("a", fmt.Sprint(i))
+	}
+	if err := queue.Wait(store.Seq()); err != nil {
+		t.Fatalf("Wait returned unexpected error: %s", err.Error())
+	}
+
+	if changes, found := queue.Since(1, first); !found || len(changes) != 4 || changes[0].Seq != 2 {
+		t.Errorf("Since(1) returned %v, %t, expected changes 2 to 5", changes, found)
+	}
+	if changes, found := queue.Since(5, queue.Last()); !found || len(changes) != 0 {
+		t.Errorf("Since(5) returned %v, %t, expected no changes", changes, found)
+	}
+	if _, found := queue.Since(0, kvstore.Mutation{}); !found {
+		t.Errorf("Since(0) found no changes, expected every change")
+	}
+	different := first
+	different.Value = "lost"
+	if _, found := queue.Since(1, different); found {
+		t.Errorf("Since(1) with a different change 1 found changes, expected none")
+	}
+}
+
+func TestReplicationQueue_LogIsBounded(t *testing.T) {
+	queue, store := startTailQueue(t, 3)
+	for i := 0; i < 5; i++ {
+		store.Set("a", fmt.Sprint(i))
+		if err := queue.Wait(store.Seq()); err != nil {
+			t.Fatalf("Wait returned unexpected error: %s", err.Error())
+		}
+	}
+	if _, found := queue.Since(0, kvstore.Mutation{}); found {
+		t.Errorf("Since(0) found changes after the log was trimmed, expected none")
+	}
+	if changes, found := queue.Since(3, kvstore.Mutation{Seq: 3, Key: "a", Value: "2"}); !found || len(changes) != 2 {
+		t.Errorf("Since(3) returned %v, %t, expected the last 2 changes", changes, found)
+	}
+}
+
+func TestReplicationQueue_KeepsTransactionsWhole(t *testing.T) {
+	next, nextIpPort := startFakeNode(t, false)
+	queue, store := startQueue(t, nextIpPort)
+
+	ops := []kvstore.Op{}
+	for i := 0; i < maxBatchWrites+1; i++ {
+		ops = append(ops, kvstore.Op{Kind: kvstore.OpSet, Key: "a", Value: "1"})
+	}
+	store.Txn(kvstore.Txn{Success: ops})
+	if err := queue.Wait(store.Seq()); err != nil {
+		t.Fatalf("Wait returned unexpected error: %s", err.Error())
+	}
+	next.lock.Lock()
+	defer next.lock.Unlock()
+	if next.applied != 1 {
+		t.Errorf("Transaction was passed on in %d calls, expected 1", next.applied)
+	}
+	checkInOrder(t, next.received, maxBatchWrites+1)
+}
+
+func TestReplicationQueue_TailAcknowledgesImmediately(t *testing.T) {
+	chain := NewMember("tail", nil)
+	chain.UpdateMembership(&api.Membership{Epoch: 1, Members: []string{"head", "tail"}}, &api.ValReply{})
+	store := kvstore.New()
+	queue := NewReplicationQueue(chain, 1000, nil)
+	queue.Start(store.OnMutation(queue.Push))
+	defer queue.Stop()
+
+	store.Set("a", "1")
+	if err := queue.Wait(store.Seq()); err != nil {
+		t.Errorf("Wait on the tail returned unexpected error: %s", err.Error())
+	}
+}
+
+func TestReplicationQueue_StopFailsWaitingWrites(t *testing.T) {
+	next, nextIpPort := startFakeNode(t, false)
+	next.gaps = 1 << 30 // never acknowledges
+	queue, store := startQueue(t, nextIpPort)
+	store.Set("a", "1")
+	done := make(chan error)
+	go func() { done <- queue.Wait(store.Seq()) }()
+	queue.Stop()
+	if err := <-done; err == nil {
+		t.Errorf("Wait after Stop succeeded, expected an error")
+	}
+}
+
+func TestReplicationQueue_RetainedIsBounded(t *testing.T) {
+	queue := NewReplicationQueue(nil, 1000, nil)
+	for seq := uint64(1); seq <= 6; seq++ {
+		write := []kvstore.Mutation{{Seq: seq, Key: "a"}}
+		if seq <= 4 {
+			queue.log = append(queue.log, write)
+		} else {
+			queue.pending = append(queue.pending, write)
+		}
+	}
+	tests := []struct {
+		seq   uint64
+		limit int
+		first uint64 // sequence number of the first write returned
+		count int
+	}{
+		{0, 1, 1, 1},
+		{1, 2, 2, 2},
+		{2, 10, 3, 4},
+		{4, 10, 5, 2},
+		{5, 10, 6, 1},
+		{6, 10, 0, 0},
+	}
+	for _, test := range tests {
+		writes := queue.retained(test.seq, test.limit)
+		if len(writes) != test.count || (test.count > 0 && writes[0][0].Seq != test.first) {
+			t.Errorf("retained(%d, %d) returned %v, expected %d writes from %d", test.seq, test.limit, writes, test.count, test.first)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package quorum
+
+import (
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"time"
+)
+
+// Every interval, sends each node which is down the writes held for it,
+// marking it up again once it has applied them, and removes the copies
+// applied to substitute nodes in its place.  Returns a function which stops
+// handing off writes.
+func (network *QuorumNetwork) StartHandoff(interval time.Duration) func() {
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				network.handoff()
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// Try once to send every node which is down, or has writes held for it, the
+// writes held for it.  Nodes with no writes held are sent none, to check
+// whether they are up.  Then try once to remove the copies of handed off
+// writes from the substitute nodes which applied them.
+// Returns the number of writes handed off.
+func (network *QuorumNetwork) handoff() int {
+	handedOff := 0
+	for ipPort, hints := range network.waiting() {
+		if err := network.apply(ipPort, hints); err != nil {
+			continue
+		}
+		if wasDown := network.handedOff(ipPort, hints); wasDown {
+			fmt.Printf("Node %s is up, handed off %d writes\n", ipPort, len(hints))
+		}
+		handedOff += len(hints)
+	}
+	for ipPort, copies := range network.discarding() {
+		err := network.call(ipPort, "KeyValService.DiscardVersioned", &api.VersionedArgs{Mutations: copies}, &api.VersionedReply{})
+		if err == nil {
+			network.discarded(ipPort, copies)
+		}
+	}
+	return handedOff
+}
+
+// Record that the node at ipPort has applied the writes in hints, no longer
+// holding them for it, and mark it up again
+// Substitute nodes' copies of writes no longer held for any node are queued
+// for removal, unless the substitute has since become one of the key's nodes.
+// Writes are matched by version, since while they were being handed off the
+// node may have left, or writes may have been added or dropped for it.
+// Returns whether the node was down.
+func (network *QuorumNetwork) handedOff(ipPort string, hints []kvstore.Mutation) bool {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	applied := map[uint64]bool{}
+	for _, m := range hints {
+		applied[m.Seq] = true
+	}
+	network.hints[ipPort] = withoutVersions(network.hints[ipPort], applied)
+	if len(network.hints[ipPort]) == 0 {
+		delete(network.hints, ipPort)
+	}
+
+	// A write meant for several nodes which were down stays on its substitutes
+	// until it has been handed off to all of them
+	for _, held := range network.hints {
+		for _, m := range held {
+			delete(applied, m.Seq)
+		}
+	}
+	for substitute, copies := range network.substituted {
+		for _, m := range copies {
+			if applied[m.Seq] && !network.isHome(substitute, m.Key) {
+				network.discards[substitute] = append(network.discards[substitute], m)
+			}
+		}
+		if excess := len(network.discards[substitute]) - maxHints; excess > 0 {
+			network.discards[substitute] = network.discards[substitute][excess:]
+		}
+		network.substituted[substitute] = withoutVersions(copies, applied)
+		if len(network.substituted[substitute]) == 0 {
+			delete(network.substituted, substitute)
+		}
+	}
+
+	wasDown := network.down[ipPort]
+	delete(network.down, ipPort)
+	return wasDown
+}
+
+// Record that the node at ipPort has removed its copies of handed off writes
+func (network *QuorumNetwork) discarded(ipPort string, copies []kvstore.Mutation) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	removed := map[uint64]bool{}
+	for _, m := range copies {
+		removed[m.Seq] = true
+	}
+	network.discards[ipPort] = withoutVersions(network.discards[ipPort], removed)
+	if len(network.discards[ipPort]) == 0 {
+		delete(network.discards, ipPort)
+	}
+}
+
+// Returns the mutations whose versions are not in versions, in order
+func withoutVersions(mutations []kvstore.Mutation, versions map[uint64]bool) []kvstore.Mutation {
+	remaining := []kvstore.Mutation{}
+	for _, m := range mutations {
+		if !versions[m.Seq] {
+			remaining = append(remaining, m)
+		}
+	}
+	return remaining
+}
+
+// Returns a copy of the writes held for each node which is down or has
+// writes held for it
+func (network *QuorumNetwork) waiting() map[string][]kvstore.Mutation {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	waiting := map[string][]kvstore.Mutation{}
+	for ipPort := range network.down {
+		waiting[ipPort] = []kvstore.Mutation{}
+	}
+	for ipPort, hints := range network.hints {
+		waiting[ipPort] = append([]kvstore.Mutation{}, hints...)
+	}
+	return waiting
+}
+
+// Returns a copy of the handed off writes to remove from each substitute node
+func (network *QuorumNetwork) discarding() map[string][]kvstore.Mutation {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	discarding := map[string][]kvstore.Mutation{}
+	for ipPort, copies := range network.discards {
+		discarding[ipPort] = append([]kvstore.Mutation{}, copies...)
+	}
+	return discarding
+}
+
+// Record that the node at ipPort applied write m, if it did so in place of one
+// of the key's nodes which was down, so that its copy can be removed once the
+// write has been handed off, dropping the oldest record if there are too many
+func (network *QuorumNetwork) recordSubstitute(ipPort string, m kvstore.Mutation) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if !network.ring.Contains(ipPort) || network.isHome(ipPort, m.Key) {
+		return
+	}
+	network.substituted[ipPort] = append(network.substituted[ipPort], m)
+	if len(network.substituted[ipPort]) > maxHints {
+		network.substituted[ipPort] = network.substituted[ipPort][1:]
+	}
+}
+
+// Hold write m for the node at ipPort until it can be handed off, dropping
+// the oldest write held for the node if there are too many
+func (network *QuorumNetwork) addHint(ipPort string, m kvstore.Mutation) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if !network.ring.Contains(ipPort) {
+		return
+	}
+	network.hints[ipPort] = append(network.hints[ipPort], m)
+	if len(network.hints[ipPort]) > maxHints {
+		network.hints[ipPort] = network.hints[ipPort][1:]
+	}
+}
+
+// Record that the node at ipPort has stopped replying, so that requests
+// use substitute nodes until it replies to a handoff
+func (network *QuorumNetwork) setDown(ipPort string) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if network.ring.Contains(ipPort) && !network.down[ipPort] {
+		network.down[ipPort] = true
+		fmt.Printf("Node %s is down\n", ipPort)
+	}
+}
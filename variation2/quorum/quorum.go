@@ -0,0 +1,486 @@
+// Package quorum replicates each key on N back-end nodes chosen by a
+// consistent-hash ring, as in Dynamo, as an alternative to chain replication
+// for latency-sensitive workloads.  Writes return once W of the key's nodes
+// have applied them and reads once R have replied, so with R + W > N every
+// read overlaps the latest acknowledged write.  The front-end versions each
+// write with a timestamp and nodes keep the latest version of each key (last
+// writer wins).  Reads repair nodes which replied with older versions, and
+// writes meant for a node which is down are applied to the next node on the
+// ring instead and held by the front-end until they can be handed off, after
+// which the substitute node's copy is removed.
+package quorum
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"github.com/msayson/kvservice/util/rpc_util"
+	"github.com/msayson/kvservice/variation2/sharding"
+	"sync"
+	"time"
+)
+
+// Maximum number of writes held for a node which is down, and of writes
+// recorded as applied to a node in place of one which is down
+// Older writes are dropped once there are more, leaving read repair to
+// bring the node up to date, or the substitute node holding the copy.
+const maxHints = 10000
+
+// Configuration for quorum replication
+type Options struct {
+	Replicas    int           // number of nodes holding each key (N)
+	ReadQuorum  int           // number of replies a read waits for (R)
+	WriteQuorum int           // number of nodes a write waits to apply it (W)
+	Timeout     time.Duration // time allowed for each node's reply
+}
+
+// Returns the quorum configuration used if none is given
+func DefaultOptions() Options {
+	return Options{
+		Replicas:    3,
+		ReadQuorum:  2,
+		WriteQuorum: 2,
+		Timeout:     time.Second,
+	}
+}
+
+// Defines command-line flags for configuring quorum replication, and returns
+// the options they will be parsed into
+func Flags(flags *flag.FlagSet) *Options {
+	opts := DefaultOptions()
+	flags.IntVar(&opts.Replicas, "replicas", opts.Replicas, "quorum only: number of nodes holding each key (N)")
+	flags.IntVar(&opts.ReadQuorum, "read-quorum", opts.ReadQuorum, "quorum only: number of nodes each read waits for (R)")
+	flags.IntVar(&opts.WriteQuorum, "write-quorum", opts.WriteQuorum, "quorum only: number of nodes each write waits for (W)")
+	flags.DurationVar(&opts.Timeout, "replica-timeout", opts.Timeout, "quorum only: time allowed for each node's reply")
+	return &opts
+}
+
+// Returns an error if the options cannot be used
+func (opts Options) Validate() error {
+	if opts.Replicas < 1 || opts.ReadQuorum < 1 || opts.WriteQuorum < 1 {
+		return errors.New("replicas, read quorum and write quorum must be at least 1")
+	} else if opts.ReadQuorum > opts.Replicas || opts.WriteQuorum > opts.Replicas {
+		return errors.New(fmt.Sprintf("read quorum %d and write quorum %d cannot exceed %d replicas", opts.ReadQuorum, opts.WriteQuorum, opts.Replicas))
+	} else if opts.Timeout <= 0 {
+		return errors.New("replica timeout must be positive")
+	}
+	return nil
+}
+
+// Front-end view of back-end nodes replicating keys by quorum
+// Each node joins as a chain of one, so nodes never pass writes on to each
+// other: the front-end sends each write to every one of the key's nodes.
+type QuorumNetwork struct {
+	opts        Options
+	ring        *sharding.Ring                // nodes holding keys, one shard per node
+	epoch       uint64                        // incremented on every membership change
+	down        map[string]bool               // nodes which stopped replying, skipped until they reply again
+	hints       map[string][]kvstore.Mutation // writes meant for each node while it was down, oldest first
+	substituted map[string][]kvstore.Mutation // writes each node applied in place of a node which was down, until handed off
+	discards    map[string][]kvstore.Mutation // handed off writes to remove from each node which applied them in place of another
+	lastVersion uint64                        // version of the last write
+	lock        *sync.Mutex
+}
+
+// Reply from one of a key's nodes
+type nodeReply struct {
+	ipPort string
+	latest kvstore.Mutation // latest change to the key held by the node
+	err    error
+}
+
+// Returns a quorum front-end with no nodes
+func New(opts Options) *QuorumNetwork {
+	return &QuorumNetwork{
+		opts:        opts,
+		ring:        sharding.NewRing(),
+		down:        map[string]bool{},
+		hints:       map[string][]kvstore.Mutation{},
+		substituted: map[string][]kvstore.Mutation{},
+		discards:    map[string][]kvstore.Mutation{},
+		lock:        &sync.Mutex{},
+	}
+}
+
+// Retrieves the latest version of a key-value held by R of its nodes
+func (network *QuorumNetwork) Get(args *api.GetArgs, reply *api.ValReply) error {
+	latest, err := network.read(args.Key)
+	if err != nil {
+		return err
+	}
+	reply.Val, reply.Found = latest.Value, !latest.Deleted
+	if reply.Found {
+		reply.Version = latest.Seq
+	}
+	return nil
+}
+
+// Sets key-value on W of its nodes
+func (network *QuorumNetwork) Set(args *api.SetArgs, reply *api.ValReply) error {
+	_, err := network.write(kvstore.Mutation{Key: args.Key, Value: args.Val})
+	reply.Val = args.Val
+	return err
+}
+
+// Sets key-value with a time-to-live on W of its nodes
+func (network *QuorumNetwork) SetTTL(args *api.SetTTLArgs, reply *api.ValReply) error {
+	_, err := network.write(kvstore.Mutation{Key: args.Key, Value: args.Val, ExpiresAt: time.Now().Add(args.TTL)})
+	reply.Val = args.Val
+	return err
+}
+
+// Removes key-value from W of its nodes, reporting whether a read of R nodes found it
+func (network *QuorumNetwork) Delete(args *api.DeleteArgs, reply *api.ValReply) error {
+	latest, err := network.read(args.Key)
+	if err != nil {
+		return err
+	}
+	reply.Found = !latest.Deleted
+	_, err = network.write(kvstore.Mutation{Key: args.Key, Deleted: true})
+	return err
+}
+
+// Retrieves the latest version of each of a batch of key-values
+func (network *QuorumNetwork) MultiGet(args *api.MultiGetArgs, reply *api.MultiReply) error {
+	reply.Entries = make([]kvstore.KeyValue, len(args.Keys))
+	for i, key := range args.Keys {
+		latest, err := network.read(key)
+		if err != nil {
+			return err
+		}
+		reply.Entries[i].Key = key
+		if !latest.Deleted {
+			reply.Entries[i].Value, reply.Entries[i].Version = latest.Value, latest.Seq
+		}
+	}
+	return nil
+}
+
+// Sets a batch of key-values, each on W of its nodes
+// The batch is not atomic: entries before a failed write remain set.
+func (network *QuorumNetwork) MultiSet(args *api.MultiSetArgs, reply *api.MultiReply) error {
+	reply.Entries = make([]kvstore.KeyValue, len(args.Entries))
+	for i, entry := range args.Entries {
+		version, err := network.write(kvstore.Mutation{Key: entry.Key, Value: entry.Value})
+		if err != nil {
+			return err
+		}
+		reply.Entries[i] = kvstore.KeyValue{Key: entry.Key, Value: entry.Value, Version: version}
+	}
+	return nil
+}
+
+// Not supported: nodes may briefly disagree on a key's value, so there is no
+// single value to test against
+func (network *QuorumNetwork) TestSet(args *api.TestSetArgs, reply *api.ValReply) error {
+	return unsupportedError("TestSet")
+}
+
+// Not supported: nodes may briefly disagree on a key's version
+func (network *QuorumNetwork) CompareAndSwap(args *api.CompareAndSwapArgs, reply *api.CompareAndSwapReply) error {
+	return unsupportedError("CompareAndSwap")
+}
+
+// Not supported: each node holds only some keys, and may hold stale values
+func (network *QuorumNetwork) Scan(args *api.ScanArgs, reply *api.ScanReply) error {
+	return unsupportedError("Scan")
+}
+
+// Not supported: nodes apply writes in different orders
+func (network *QuorumNetwork) Watch(args *api.WatchArgs, reply *api.WatchReply) error {
+	return unsupportedError("Watch")
+}
+
+// Not supported: writes to different nodes cannot be made atomic
+func (network *QuorumNetwork) Txn(args *api.TxnArgs, reply *api.TxnReply) error {
+	return unsupportedError("Txn")
+}
+
+// Adds a back-end node to the ring, making it one of the nodes of the keys
+// it now owns a replica of.  The node joins as a chain of one, and receives
+// those keys' values as they are written or repaired by reads.
+func (network *QuorumNetwork) Join(args *api.JoinArgs, reply *api.Membership) error {
+	if args.IpPort == "" {
+		return errors.New("Join: expected an ip:port, received empty string")
+	}
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.ring = network.ring.With(args.IpPort)
+	network.epoch++
+	*reply = api.Membership{Epoch: network.epoch, Members: []string{args.IpPort}}
+	return nil
+}
+
+// Removes a back-end node from the ring, discarding writes held for it and
+// records of the copies it holds for other nodes
+func (network *QuorumNetwork) Leave(args *api.LeaveArgs, reply *api.ValReply) error {
+	if args.IpPort == "" {
+		return errors.New("Leave: expected an ip:port, received empty string")
+	}
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.ring = network.ring.Without(args.IpPort)
+	delete(network.down, args.IpPort)
+	delete(network.hints, args.IpPort)
+	delete(network.substituted, args.IpPort)
+	delete(network.discards, args.IpPort)
+	network.epoch++
+	reply.Val = "success"
+	return nil
+}
+
+// Nodes serve reads as soon as they join, so there is nothing to record
+func (network *QuorumNetwork) Activate(args *api.JoinArgs, reply *api.ValReply) error {
+	if args.IpPort == "" {
+		return errors.New("Activate: expected an ip:port, received empty string")
+	}
+	reply.Val = "success"
+	return nil
+}
+
+// Returns the membership of the node at callerIpPort, a chain of one, or an
+// empty membership if it has not joined
+func (network *QuorumNetwork) GetMembership(callerIpPort string, reply *api.Membership) error {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	*reply = api.Membership{}
+	if network.ring.Contains(callerIpPort) {
+		*reply = api.Membership{Epoch: network.epoch, Members: []string{callerIpPort}}
+	}
+	return nil
+}
+
+// Read key from its nodes, returning the latest version once R have replied
+// Nodes which replied with an older version, including ones which reply
+// after the read returns, are repaired in the background.
+func (network *QuorumNetwork) read(key string) (kvstore.Mutation, error) {
+	nodes, _ := network.nodesFor(key)
+	replies := make(chan nodeReply, len(nodes))
+	for _, ipPort := range nodes {
+		go func(ipPort string) {
+			reply := api.VersionedReply{}
+			err := network.call(ipPort, "KeyValService.GetVersioned", &api.MultiGetArgs{Keys: []string{key}}, &reply)
+			if err == nil && len(reply.Mutations) != 1 {
+				err = errors.New(fmt.Sprintf("GetVersioned: node %s returned %d changes, expected 1", ipPort, len(reply.Mutations)))
+			}
+			result := nodeReply{ipPort: ipPort, err: err}
+			if err == nil {
+				result.latest = reply.Mutations[0]
+			}
+			replies <- result
+		}(ipPort)
+	}
+
+	received := []nodeReply{}
+	succeeded := 0
+	for len(received) < len(nodes) && succeeded < network.opts.ReadQuorum {
+		reply := <-replies
+		received = append(received, reply)
+		if reply.err == nil {
+			succeeded++
+		} else {
+			network.setDown(reply.ipPort)
+		}
+	}
+	latest := newest(key, received)
+	go network.repair(key, received, replies, len(nodes)-len(received))
+	if succeeded < network.opts.ReadQuorum {
+		return latest, quorumError("read", key, succeeded, network.opts.ReadQuorum)
+	}
+	return latest, nil
+}
+
+// Wait for the remaining replies to a read of key, then apply the latest
+// version to every node which replied with an older one
+func (network *QuorumNetwork) repair(key string, received []nodeReply, replies chan nodeReply, remaining int) {
+	for i := 0; i < remaining; i++ {
+		reply := <-replies
+		if reply.err != nil {
+			network.setDown(reply.ipPort)
+		}
+		received = append(received, reply)
+	}
+	latest := newest(key, received)
+	for _, reply := range received {
+		if reply.err != nil || reply.latest.Seq >= latest.Seq {
+			continue
+		}
+		if err := network.apply(reply.ipPort, []kvstore.Mutation{latest}); err != nil {
+			fmt.Printf("Error repairing %s on node %s: %s\n", key, reply.ipPort, err.Error())
+		}
+	}
+}
+
+// Write m to its key's nodes with a new version, returning the version once
+// W nodes have applied it
+// Writes meant for nodes which are down are applied to substitute nodes
+// instead, and held for handoff, recording the substitutes which applied them
+// so that their copies can be removed once handed off.  If fewer than W nodes
+// apply the write, it is sent once more, with substitutes for the nodes which
+// failed.
+func (network *QuorumNetwork) write(m kvstore.Mutation) (uint64, error) {
+	m.Seq = network.nextVersion()
+	applied := map[string]bool{}
+	hinted := map[string]bool{}
+	for attempt := 0; attempt < 2; attempt++ {
+		nodes, down := network.nodesFor(m.Key)
+		for _, ipPort := range down {
+			if !hinted[ipPort] {
+				hinted[ipPort] = true
+				network.addHint(ipPort, m)
+			}
+		}
+
+		acks := make(chan nodeReply, len(nodes))
+		sent := 0
+		for _, ipPort := range nodes {
+			if !applied[ipPort] {
+				sent++
+				go func(ipPort string) {
+					acks <- nodeReply{ipPort: ipPort, err: network.apply(ipPort, []kvstore.Mutation{m})}
+				}(ipPort)
+			}
+		}
+		received := 0
+		for ; received < sent && len(applied) < network.opts.WriteQuorum; received++ {
+			ack := <-acks
+			if ack.err == nil {
+				applied[ack.ipPort] = true
+				network.recordSubstitute(ack.ipPort, m)
+			} else {
+				network.failed(ack.ipPort, m, hinted)
+			}
+		}
+		if len(applied) >= network.opts.WriteQuorum {
+			go network.finishWrite(m, acks, sent-received, applied, hinted)
+			return m.Seq, nil
+		}
+	}
+	return m.Seq, quorumError("write", m.Key, len(applied), network.opts.WriteQuorum)
+}
+
+// Wait for the remaining nodes to apply write m after W have, then apply it
+// to substitutes for any nodes which failed, so that N nodes still hold it
+func (network *QuorumNetwork) finishWrite(m kvstore.Mutation, acks chan nodeReply, remaining int, applied map[string]bool, hinted map[string]bool) {
+	for i := 0; i < remaining; i++ {
+		if ack := <-acks; ack.err == nil {
+			applied[ack.ipPort] = true
+			network.recordSubstitute(ack.ipPort, m)
+		} else {
+			network.failed(ack.ipPort, m, hinted)
+		}
+	}
+	nodes, _ := network.nodesFor(m.Key)
+	for _, ipPort := range nodes {
+		if applied[ipPort] {
+			continue
+		}
+		if err := network.apply(ipPort, []kvstore.Mutation{m}); err != nil {
+			network.failed(ipPort, m, hinted)
+		} else {
+			network.recordSubstitute(ipPort, m)
+		}
+	}
+}
+
+// Record that the node at ipPort failed to apply write m, holding the write
+// for handoff if the node is one of its key's nodes and does not already
+// have the write held for it
+func (network *QuorumNetwork) failed(ipPort string, m kvstore.Mutation, hinted map[string]bool) {
+	network.setDown(ipPort)
+	network.lock.Lock()
+	home := network.isHome(ipPort, m.Key)
+	network.lock.Unlock()
+	if home && !hinted[ipPort] {
+		hinted[ipPort] = true
+		network.addHint(ipPort, m)
+	}
+}
+
+// Returns whether the node at ipPort is one of the first N nodes on the ring
+// from key's position, which hold key whether or not they are up
+// Caller must hold the network's lock
+func (network *QuorumNetwork) isHome(ipPort string, key string) bool {
+	for _, node := range network.ring.Successors(key, network.opts.Replicas) {
+		if node == ipPort {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the nodes to send requests about key to, which are the first N
+// nodes on the ring from key's position which are up, and the nodes among
+// the first N on the ring which are down, whose writes are held for handoff
+func (network *QuorumNetwork) nodesFor(key string) ([]string, []string) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	nodes, down := []string{}, []string{}
+	all := network.ring.Successors(key, len(network.ring.Shards()))
+	for i, ipPort := range all {
+		if network.down[ipPort] {
+			if i < network.opts.Replicas {
+				down = append(down, ipPort)
+			}
+		} else if len(nodes) < network.opts.Replicas {
+			nodes = append(nodes, ipPort)
+		}
+	}
+	return nodes, down
+}
+
+// Returns a version later than every previous write's, based on the current
+// time so that versions keep increasing if the front-end restarts
+func (network *QuorumNetwork) nextVersion() uint64 {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	version := uint64(time.Now().UnixNano())
+	if version <= network.lastVersion {
+		version = network.lastVersion + 1
+	}
+	network.lastVersion = version
+	return version
+}
+
+// Apply versioned writes to the node at ipPort
+func (network *QuorumNetwork) apply(ipPort string, mutations []kvstore.Mutation) error {
+	return network.call(ipPort, "KeyValService.ApplyVersioned", &api.VersionedArgs{Mutations: mutations}, &api.VersionedReply{})
+}
+
+// Send an RPC call to the node at ipPort, failing if it does not reply in time
+func (network *QuorumNetwork) call(ipPort, serviceMethod string, args interface{}, reply interface{}) error {
+	rpcClient, err := rpc_util.DialTimeout(ipPort, network.opts.Timeout)
+	if err != nil {
+		return err
+	}
+	defer rpcClient.Close()
+	call := rpcClient.Go(serviceMethod, args, reply, nil)
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(network.opts.Timeout):
+		return errors.New(fmt.Sprintf("%s: node %s did not reply within %s", serviceMethod, ipPort, network.opts.Timeout))
+	}
+}
+
+// Returns the latest change among the nodes' replies, or a removal at
+// version 0 if none of them hold key
+func newest(key string, replies []nodeReply) kvstore.Mutation {
+	latest := kvstore.Mutation{Key: key, Deleted: true}
+	for _, reply := range replies {
+		if reply.err == nil && reply.latest.Seq > latest.Seq {
+			latest = reply.latest
+		}
+	}
+	return latest
+}
+
+func quorumError(operation string, key string, replied int, needed int) error {
+	return errors.New(fmt.Sprintf("Quorum %s of %s failed: only %d of the %d nodes needed replied", operation, key, replied, needed))
+}
+
+func unsupportedError(serviceMethod string) error {
+	return errors.New(fmt.Sprintf("%s: not supported with quorum replication, restart the front-end without --quorum", serviceMethod))
+}
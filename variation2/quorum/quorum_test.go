@@ -0,0 +1,288 @@
+package quorum
+
+import (
+	"errors"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Back-end node serving versioned reads and writes from its own store,
+// which fails every call while down
+type fakeNode struct {
+	store *kvstore.KVStore
+	down  bool
+	lock  *sync.Mutex
+}
+
+func (node *fakeNode) GetVersioned(args *api.MultiGetArgs, reply *api.VersionedReply) error {
+	if node.isDown() {
+		return errors.New("node is down")
+	}
+	for _, key := range args.Keys {
+		reply.Mutations = append(reply.Mutations, node.store.Latest(key))
+	}
+	return nil
+}
+
+func (node *fakeNode) ApplyVersioned(args *api.VersionedArgs, reply *api.VersionedReply) error {
+	if node.isDown() {
+		return errors.New("node is down")
+	}
+	reply.Applied = node.store.ApplyNewer(args.Mutations...)
+	return nil
+}
+
+func (node *fakeNode) DiscardVersioned(args *api.VersionedArgs, reply *api.VersionedReply) error {
+	if node.isDown() {
+		return errors.New("node is down")
+	}
+	reply.Applied = node.store.DiscardVersions(args.Mutations...)
+	return nil
+}
+
+func (node *fakeNode) isDown() bool {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return node.down
+}
+
+func (node *fakeNode) setDown(down bool) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	node.down = down
+}
+
+// Start a quorum front-end with n fake nodes, each listening on a free port
+// Returns the front-end and each node by ip:port.
+func startNetwork(t *testing.T, opts Options, n int) (*QuorumNetwork, map[string]*fakeNode) {
+	network := New(opts)
+	nodes := map[string]*fakeNode{}
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error starting fake node: %s", err.Error())
+		}
+		node := &fakeNode{store: kvstore.New(), lock: &sync.Mutex{}}
+		server := rpc.NewServer()
+		server.RegisterName("KeyValService", node)
+		go server.Accept(listener)
+		t.Cleanup(func() { listener.Close() })
+		ipPort := listener.Addr().String()
+		nodes[ipPort] = node
+		network.Join(&api.JoinArgs{IpPort: ipPort}, &api.Membership{})
+	}
+	return network, nodes
+}
+
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.Timeout = 200 * time.Millisecond
+	return opts
+}
+
+// Returns the number of nodes holding value for key
+func holding(nodes map[string]*fakeNode, key string, value string) int {
+	count := 0
+	for _, node := range nodes {
+		if val, found := node.store.Lookup(key); found && val == value {
+			count++
+		}
+	}
+	return count
+}
+
+// Wait up to a second for count nodes to hold value for key
+func waitForHolding(t *testing.T, nodes map[string]*fakeNode, key string, value string, count int) {
+	deadline := time.Now().Add(time.Second)
+	for holding(nodes, key, value) < count && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if held := holding(nodes, key, value); held != count {
+		t.Fatalf("%d nodes held %s for %s, expected %d", held, value, key, count)
+	}
+}
+
+func TestQuorum_WritesToReplicasAndReadsLatest(t *testing.T) {
+	network, nodes := startNetwork(t, testOptions(), 5)
+	network.Set(&api.SetArgs{Key: "a", Val: "1"}, &api.ValReply{})
+	network.Set(&api.SetArgs{Key: "a", Val: "2"}, &api.ValReply{})
+	waitForHolding(t, nodes, "a", "2", 3)
+
+	reply := api.ValReply{}
+	if err := network.Get(&api.GetArgs{Key: "a"}, &reply); err != nil || reply.Val != "2" || !reply.Found {
+		t.Errorf("Get(a) returned %s, found %t, error %v, expected 2", reply.Val, reply.Found, err)
+	}
+	network.Delete(&api.DeleteArgs{Key: "a"}, &reply)
+	if !reply.Found {
+		t.Errorf("Delete(a) reported a missing key, expected it found")
+	}
+	network.Get(&api.GetArgs{Key: "a"}, &reply)
+	if reply.Found {
+		t.Errorf("Get(a) after Delete found %s, expected it missing", reply.Val)
+	}
+}
+
+func TestQuorum_ReadRepairsStaleReplica(t *testing.T) {
+	network, nodes := startNetwork(t, testOptions(), 3)
+	network.Set(&api.SetArgs{Key: "a", Val: "1"}, &api.ValReply{})
+	waitForHolding(t, nodes, "a", "1", 3)
+
+	// One replica misses a newer write
+	var stale *fakeNode
+	for _, node := range nodes {
+		stale = node
+		break
+	}
+	for _, node := range nodes {
+		if node != stale {
+			node.store.ApplyNewer(kvstore.Mutation{Seq: network.nextVersion(), Key: "a", Value: "2"})
+		}
+	}
+	reply := api.ValReply{}
+	if err := network.Get(&api.GetArgs{Key: "a"}, &reply); err != nil {
+		t.Fatalf("Get(a) returned unexpected error: %s", err.Error())
+	}
+	waitForHolding(t, nodes, "a", "2", 3)
+}
+
+func TestQuorum_HandsOffWritesToReturningNode(t *testing.T) {
+	network, nodes := startNetwork(t, testOptions(), 4)
+	home, _ := network.nodesFor("a")
+	nodes[home[0]].setDown(true)
+
+	if err := network.Set(&api.SetArgs{Key: "a", Val: "1"}, &api.ValReply{}); err != nil {
+		t.Fatalf("Set(a) with a node down returned unexpected error: %s", err.Error())
+	}
+	waitForHolding(t, nodes, "a", "1", 3)
+	if network.handoff() != 0 {
+		t.Errorf("Handed off writes to a node which is still down")
+	}
+
+	nodes[home[0]].setDown(false)
+	if handedOff := network.handoff(); handedOff != 1 {
+		t.Errorf("Handed off %d writes, expected 1", handedOff)
+	}
+	if val, _ := nodes[home[0]].store.Lookup("a"); val != "1" {
+		t.Errorf("Returning node held %s for a, expected 1", val)
+	}
+	if nodes, down := network.nodesFor("a"); len(down) != 0 || nodes[0] != home[0] {
+		t.Errorf("Nodes for a after handoff were %v with %v down, expected %s first and none down", nodes, down, home[0])
+	}
+	if held := holding(nodes, "a", "1"); held != 3 {
+		t.Errorf("%d nodes held a after handoff, expected the substitute's copy removed leaving 3", held)
+	}
+}
+
+func TestQuorum_HandoffKeepsSubstituteCopyOfLaterWrite(t *testing.T) {
+	network, nodes := startNetwork(t, testOptions(), 4)
+	home, _ := network.nodesFor("a")
+	nodes[home[0]].setDown(true)
+	network.Set(&api.SetArgs{Key: "a", Val: "1"}, &api.ValReply{})
+	waitForHolding(t, nodes, "a", "1", 3)
+
+	// The substitute's copy is overwritten before it is removed
+	substitute := map[string]*fakeNode{}
+	for ipPort, node := range nodes {
+		substitute[ipPort] = node
+	}
+	for _, ipPort := range home {
+		delete(substitute, ipPort)
+	}
+	for _, node := range substitute {
+		node.store.ApplyNewer(kvstore.Mutation{Seq: network.nextVersion(), Key: "a", Value: "2"})
+	}
+	nodes[home[0]].setDown(false)
+	network.handoff()
+	if held := holding(substitute, "a", "2"); held != 1 {
+		t.Errorf("Substitute did not hold 2 for a after handoff, expected its later write kept")
+	}
+}
+
+func TestQuorum_HandoffKeepsWritesChangedWhileSending(t *testing.T) {
+	network, nodes := startNetwork(t, testOptions(), 3)
+	var ipPort string
+	for ipPort = range nodes {
+		break
+	}
+	for i := uint64(1); i <= 3; i++ {
+		network.addHint(ipPort, kvstore.Mutation{Seq: i, Key: "a"})
+	}
+	sent := network.waiting()[ipPort]
+
+	// While sent is handed off, the oldest write is dropped and another held
+	network.lock.Lock()
+	network.hints[ipPort] = network.hints[ipPort][1:]
+	network.lock.Unlock()
+	network.addHint(ipPort, kvstore.Mutation{Seq: 4, Key: "a"})
+	network.handedOff(ipPort, sent)
+	if held := network.waiting()[ipPort]; len(held) != 1 || held[0].Seq != 4 {
+		t.Errorf("Held %v after handoff, expected only the write added while sending", held)
+	}
+
+	// While sent is handed off, the node leaves
+	sent = network.waiting()[ipPort]
+	network.Leave(&api.LeaveArgs{IpPort: ipPort}, &api.ValReply{})
+	network.handedOff(ipPort, sent)
+	if held, waiting := network.waiting()[ipPort]; waiting {
+		t.Errorf("Held %v for a node which left, expected nothing", held)
+	}
+}
+
+func TestQuorum_FailsWithoutWriteQuorum(t *testing.T) {
+	network, nodes := startNetwork(t, testOptions(), 3)
+	i := 0
+	for _, node := range nodes {
+		if i < 2 {
+			node.setDown(true)
+		}
+		i++
+	}
+	if err := network.Set(&api.SetArgs{Key: "a", Val: "1"}, &api.ValReply{}); err == nil {
+		t.Errorf("Set(a) with 2 of 3 nodes down succeeded, expected an error")
+	}
+	if err := network.Get(&api.GetArgs{Key: "a"}, &api.ValReply{}); err == nil {
+		t.Errorf("Get(a) with 2 of 3 nodes down succeeded, expected an error")
+	}
+}
+
+func TestQuorum_RejectsOperationsNeedingOneOrder(t *testing.T) {
+	network, _ := startNetwork(t, testOptions(), 3)
+	if err := network.TestSet(&api.TestSetArgs{Key: "a"}, &api.ValReply{}); err == nil {
+		t.Errorf("TestSet succeeded, expected it to be unsupported")
+	}
+	if err := network.Txn(&api.TxnArgs{}, &api.TxnReply{}); err == nil {
+		t.Errorf("Txn succeeded, expected it to be unsupported")
+	}
+}
+
+func TestQuorum_NodesJoinAsChainsOfOne(t *testing.T) {
+	network, nodes := startNetwork(t, testOptions(), 2)
+	for ipPort := range nodes {
+		membership := api.Membership{}
+		network.GetMembership(ipPort, &membership)
+		if len(membership.Members) != 1 || membership.Members[0] != ipPort {
+			t.Errorf("Membership of %s was %v, expected only itself", ipPort, membership.Members)
+		}
+	}
+	membership := api.Membership{}
+	network.GetMembership("127.0.0.1:1", &membership)
+	if len(membership.Members) != 0 {
+		t.Errorf("Membership of a node which has not joined was %v, expected none", membership.Members)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := DefaultOptions().Validate(); err != nil {
+		t.Errorf("Default options were invalid: %s", err.Error())
+	}
+	opts := DefaultOptions()
+	opts.WriteQuorum = opts.Replicas + 1
+	if err := opts.Validate(); err == nil {
+		t.Errorf("Write quorum larger than the number of replicas was valid")
+	}
+}
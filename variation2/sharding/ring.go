@@ -0,0 +1,128 @@
+// Package sharding spreads keys across several independent chains of
+// back-end nodes, each holding one shard of the keys, using a
+// consistent-hash ring so that adding or removing a shard only moves the
+// keys it gains or loses.
+package sharding
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Number of points each shard has on the ring
+// More points spread each shard's keys more evenly, at the cost of a larger ring.
+const virtualNodes = 64
+
+// A point on the ring, owning the keys which hash to at most its position
+// and after the previous point
+type ringPoint struct {
+	hash  uint32
+	shard string
+}
+
+// Consistent-hash ring assigning each key to a shard
+// Rings are immutable, so a new ring can be prepared while the current one is in use.
+type Ring struct {
+	points []ringPoint // sorted by hash
+}
+
+// Returns a ring holding the given shards
+func NewRing(shards ...string) *Ring {
+	ring := &Ring{}
+	for _, shard := range shards {
+		ring = ring.With(shard)
+	}
+	return ring
+}
+
+// Returns a copy of the ring with shard added
+func (ring *Ring) With(shard string) *Ring {
+	if ring.Contains(shard) {
+		return ring
+	}
+	points := append([]ringPoint{}, ring.points...)
+	for i := 0; i < virtualNodes; i++ {
+		points = append(points, ringPoint{hash(fmt.Sprintf("%s#%d", shard, i)), shard})
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].shard < points[j].shard
+		}
+		return points[i].hash < points[j].hash
+	})
+	return &Ring{points}
+}
+
+// Returns a copy of the ring with shard removed
+func (ring *Ring) Without(shard string) *Ring {
+	points := []ringPoint{}
+	for _, point := range ring.points {
+		if point.shard != shard {
+			points = append(points, point)
+		}
+	}
+	return &Ring{points}
+}
+
+// Returns the shard which owns key, or "" if the ring is empty
+func (ring *Ring) Owner(key string) string {
+	if owners := ring.Successors(key, 1); len(owners) > 0 {
+		return owners[0]
+	}
+	return ""
+}
+
+// Returns up to n distinct shards, starting with the owner of key and
+// continuing around the ring, such as the nodes which replicate key
+func (ring *Ring) Successors(key string, n int) []string {
+	shards := []string{}
+	if len(ring.points) == 0 {
+		return shards
+	}
+	keyHash := hash(key)
+	start := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= keyHash
+	})
+	seen := map[string]bool{}
+	for i := 0; i < len(ring.points) && len(shards) < n; i++ {
+		shard := ring.points[(start+i)%len(ring.points)].shard
+		if !seen[shard] {
+			seen[shard] = true
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+// Returns whether shard is on the ring
+func (ring *Ring) Contains(shard string) bool {
+	for _, point := range ring.points {
+		if point.shard == shard {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the shards on the ring, in sorted order
+func (ring *Ring) Shards() []string {
+	seen := map[string]bool{}
+	shards := []string{}
+	for _, point := range ring.points {
+		if !seen[point.shard] {
+			seen[point.shard] = true
+			shards = append(shards, point.shard)
+		}
+	}
+	sort.Strings(shards)
+	return shards
+}
+
+// Position of s on the ring
+// md5 is used for its even spread over similar strings, not for security.
+func hash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,93 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Returns keys "key_0" to "key_<n-1>"
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key_%d", i)
+	}
+	return keys
+}
+
+func TestOwner_EmptyRing(t *testing.T) {
+	if owner := NewRing().Owner("a"); owner != "" {
+		t.Errorf("Owner(a) on an empty ring returned %s, expected empty string", owner)
+	}
+}
+
+func TestOwner_SpreadsKeysEvenly(t *testing.T) {
+	ring := NewRing("a", "b", "c", "d")
+	counts := map[string]int{}
+	keys := testKeys(10000)
+	for _, key := range keys {
+		counts[ring.Owner(key)]++
+	}
+	for _, shard := range ring.Shards() {
+		if counts[shard] < len(keys)/8 || counts[shard] > len(keys)*3/8 {
+			t.Errorf("Shard %s owned %d of %d keys, expected about a quarter", shard, counts[shard], len(keys))
+		}
+	}
+}
+
+func TestSuccessors_StartsWithOwner(t *testing.T) {
+	ring := NewRing("a", "b", "c", "d")
+	for _, key := range testKeys(100) {
+		successors := ring.Successors(key, 3)
+		distinct := map[string]bool{}
+		for _, shard := range successors {
+			distinct[shard] = true
+		}
+		if len(successors) != 3 || len(distinct) != 3 || successors[0] != ring.Owner(key) {
+			t.Fatalf("Successors(%s, 3) returned %v, expected 3 distinct shards starting with %s", key, successors, ring.Owner(key))
+		}
+	}
+	if successors := ring.Successors("a", 10); len(successors) != 4 {
+		t.Errorf("Successors(a, 10) on a ring of 4 shards returned %v, expected all 4", successors)
+	}
+}
+
+func TestWith_OnlyMovesKeysToNewShard(t *testing.T) {
+	before := NewRing("a", "b", "c")
+	after := before.With("d")
+	moved := 0
+	for _, key := range testKeys(10000) {
+		if owner := after.Owner(key); owner != before.Owner(key) {
+			moved++
+			if owner != "d" {
+				t.Fatalf("Adding shard d moved %s from %s to %s", key, before.Owner(key), owner)
+			}
+		}
+	}
+	if moved == 0 || moved > 10000/2 {
+		t.Errorf("Adding a fourth shard moved %d of 10000 keys, expected about a quarter", moved)
+	}
+}
+
+func TestWithout_OnlyMovesKeysFromRemovedShard(t *testing.T) {
+	before := NewRing("a", "b", "c")
+	after := before.Without("b")
+	for _, key := range testKeys(10000) {
+		if owner := before.Owner(key); owner != "b" && after.Owner(key) != owner {
+			t.Fatalf("Removing shard b moved %s from %s to %s", key, owner, after.Owner(key))
+		}
+		if after.Owner(key) == "b" {
+			t.Fatalf("Removed shard b still owned %s", key)
+		}
+	}
+	if shards := fmt.Sprint(after.Shards()); shards != "[a c]" {
+		t.Errorf("Shards after removing b were %s, expected [a c]", shards)
+	}
+}
+
+func TestWith_DoesNotChangeOriginal(t *testing.T) {
+	ring := NewRing("a")
+	ring.With("b")
+	if shards := fmt.Sprint(ring.Shards()); shards != "[a]" {
+		t.Errorf("Shards of the original ring after With(b) were %s, expected [a]", shards)
+	}
+}
@@ -0,0 +1,516 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"github.com/msayson/kvservice/variation2/nodechain"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Front-end view of several independent chains of back-end nodes, each
+// holding the keys which the ring assigns to its shard.  Nodes join the chain
+// of the shard they name, which only receives keys once it is on the ring.
+type ShardedChain struct {
+	SelfIpPort   string                          // back-end ip:port of this front-end
+	ring         *Ring                           // shards holding keys, replaced when keys migrate
+	chains       map[string]*nodechain.NodeChain // chain of each shard, on the ring or not
+	shardOf      map[string]string               // shard joined by each back-end node
+	detectorOpts *nodechain.DetectorOptions      // set once failure detection starts, for chains created later
+	stopDetector []func()                        // stops the failure detector of each chain
+	ringLock     *sync.RWMutex                   // held for reading while requests are routed, and for writing while keys migrate
+	lock         *sync.Mutex                     // protects chains, shardOf and the failure detectors
+}
+
+// Returns an empty sharded view held by the front-end listening for
+// back-end nodes at selfIpPort
+func New(selfIpPort string) *ShardedChain {
+	return &ShardedChain{
+		SelfIpPort: selfIpPort,
+		ring:       NewRing(),
+		chains:     map[string]*nodechain.NodeChain{},
+		shardOf:    map[string]string{},
+		ringLock:   &sync.RWMutex{},
+		lock:       &sync.Mutex{},
+	}
+}
+
+// Retrieves key-value from the shard which owns it
+func (sharded *ShardedChain) Get(args *api.GetArgs, reply *api.ValReply) error {
+	sharded.ringLock.RLock()
+	defer sharded.ringLock.RUnlock()
+	chain, err := sharded.owner(args.Key)
+	if err != nil {
+		return err
+	}
+	return chain.Get(args, reply)
+}
+
+// Sets key-value in the shard which owns it
+func (sharded *ShardedChain) Set(args *api.SetArgs, reply *api.ValReply) error {
+	sharded.ringLock.RLock()
+	defer sharded.ringLock.RUnlock()
+	chain, err := sharded.owner(args.Key)
+	if err != nil {
+		return err
+	}
+	return chain.Set(args, reply)
+}
+
+// Sets key-value with a time-to-live in the shard which owns it
+func (sharded *ShardedChain) SetTTL(args *api.SetTTLArgs, reply *api.ValReply) error {
+	sharded.ringLock.RLock()
+	defer sharded.ringLock.RUnlock()
+	chain, err := sharded.owner(args.Key)
+	if err != nil {
+		return err
+	}
+	return chain.SetTTL(args, reply)
+}
+
+// Test-sets key-value in the shard which owns it
+func (sharded *ShardedChain) TestSet(args *api.TestSetArgs, reply *api.ValReply) error {
+	sharded.ringLock.RLock()
+	defer sharded.ringLock.RUnlock()
+	chain, err := sharded.owner(args.Key)
+	if err != nil {
+		return err
+	}
+	return chain.TestSet(args, reply)
+}
+
+// Compare-and-swaps key-value in the shard which owns it
+func (sharded *ShardedChain) CompareAndSwap(args *api.CompareAndSwapArgs, reply *api.CompareAndSwapReply) error {
+	sharded.ringLock.RLock()
+	defer sharded.ringLock.RUnlock()
+	chain, err := sharded.owner(args.Key)
+	if err != nil {
+		return err
+	}
+	return chain.CompareAndSwap(args, reply)
+}
+
+// Removes key-value from the shard which owns it
+func (sharded *ShardedChain) Delete(args *api.DeleteArgs, reply *api.ValReply) error {
+	sharded.ringLock.RLock()
+	defer sharded.ringLock.RUnlock()
+	chain, err := sharded.owner(args.Key)
+	if err != nil {
+		return err
+	}
+	return chain.Delete(args, reply)
+}
+
+// Retrieves a batch of key-values, with one call to each shard owning any of them
+func (sharded *ShardedChain) MultiGet(args *api.MultiGetArgs, reply *api.MultiReply) error {
+	sharded.ringLock.RLock()
+	defer sharded.ringLock.RUnlock()
+	reply.Entries = make([]kvstore.KeyValue, len(args.Keys))
+	return sharded.forEachShard(args.Keys, func(chain *nodechain.NodeChain, indices []int) error {
+		shardArgs := api.MultiGetArgs{}
+		for _, i := range indices {
+			shardArgs.Keys = append(shardArgs.Keys, args.Keys[i])
+		}
+		shardReply := api.MultiReply{}
+		err := chain.MultiGet(&shardArgs, &shardReply)
+		for j, entry := range shardReply.Entries {
+			reply.Entries[indices[j]] = entry
+		}
+		return err
+	})
+}
+
+// Sets a batch of key-values, with one call to each shard owning any of them
+// Each shard's key-values are set atomically, but the batch as a whole is not.
+func (sharded *ShardedChain) MultiSet(args *api.MultiSetArgs, reply *api.MultiReply) error {
+	sharded.ringLock.RLock()
+	defer sharded.ringLock.RUnlock()
+	keys := make([]string, len(args.Entries))
+	for i, entry := range args.Entries {
+		keys[i] = entry.Key
+	}
+	reply.Entries = make([]kvstore.KeyValue, len(args.Entries))
+	return sharded.forEachShard(keys, func(chain *nodechain.NodeChain, indices []int) error {
+		shardArgs := api.MultiSetArgs{}
+		for _, i := range indices {
+			shardArgs.Entries = append(shardArgs.Entries, args.Entries[i])
+		}
+		shardReply := api.MultiReply{}
+		err := chain.MultiSet(&shardArgs, &shardReply)
+		for j, entry := range shardReply.Entries {
+			reply.Entries[indices[j]] = entry
+		}
+		return err
+	})
+}
+
+// Lists key-values in a key range from every shard, merged in key order
+func (sharded *ShardedChain) Scan(args *api.ScanArgs, reply *api.ScanReply) error {
+	sharded.ringLock.RLock()
+	defer sharded.ringLock.RUnlock()
+	shards := sharded.ring.Shards()
+	if len(shards) == 0 {
+		return noShardsError()
+	}
+
+	var entries []kvstore.KeyValue
+	nextKey := ""
+	for _, shard := range shards {
+		shardReply := api.ScanReply{}
+		if err := sharded.chain(shard).Scan(args, &shardReply); err != nil {
+			return err
+		}
+		entries = append(entries, shardReply.Entries...)
+		if shardReply.NextKey != "" && (nextKey == "" || shardReply.NextKey < nextKey) {
+			nextKey = shardReply.NextKey
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	// Resume from the first key not returned, which may be in any shard
+	if args.Limit > 0 && len(entries) > args.Limit {
+		if nextKey == "" || entries[args.Limit].Key < nextKey {
+			nextKey = entries[args.Limit].Key
+		}
+		entries = entries[:args.Limit]
+	}
+	reply.Entries, reply.NextKey = entries, nextKey
+	return nil
+}
+
+// Waits for changes to key-values in the shard which owns the watched key
+// Watching a prefix is only supported while there is a single shard.
+func (sharded *ShardedChain) Watch(args *api.WatchArgs, reply *api.WatchReply) error {
+	sharded.ringLock.RLock()
+	chain, err := sharded.owner(args.Key)
+	if err == nil && args.IsPrefix && len(sharded.ring.Shards()) > 1 {
+		err = errors.New("Watch: watching a prefix is not supported across several shards")
+	}
+	sharded.ringLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	// Watches wait for a long time, so do not hold up migrations
+	return chain.Watch(args, reply)
+}
+
+// Executes a multi-key transaction in the shard which owns all of its keys
+// Transactions on keys owned by different shards are rejected.
+func (sharded *ShardedChain) Txn(args *api.TxnArgs, reply *api.TxnReply) error {
+	sharded.ringLock.RLock()
+	defer sharded.ringLock.RUnlock()
+	keys := []string{}
+	for _, cmp := range args.Compares {
+		keys = append(keys, cmp.Key)
+	}
+	for _, op := range append(append([]kvstore.Op{}, args.Success...), args.Failure...) {
+		keys = append(keys, op.Key)
+	}
+	if len(keys) == 0 {
+		keys = append(keys, "")
+	}
+	shard := sharded.ring.Owner(keys[0])
+	for _, key := range keys {
+		if sharded.ring.Owner(key) != shard {
+			return errors.New("Txn: keys are owned by several shards")
+		}
+	}
+	chain, err := sharded.owner(keys[0])
+	if err != nil {
+		return err
+	}
+	return chain.Txn(args, reply)
+}
+
+// Adds a new back-end node to the end of its shard's chain, creating the
+// chain if the shard is new.  A node which rejoins under a different shard
+// first leaves its previous shard's chain.
+func (sharded *ShardedChain) Join(args *api.JoinArgs, reply *api.Membership) error {
+	if args.IpPort == "" {
+		return errors.New("Join: expected an ip:port, received empty string")
+	}
+	sharded.lock.Lock()
+	previous, joined := sharded.shardOf[args.IpPort]
+	sharded.shardOf[args.IpPort] = args.Shard
+	chain, found := sharded.chains[args.Shard]
+	if !found {
+		chain = nodechain.NewFrontEnd(sharded.SelfIpPort, nil)
+		sharded.chains[args.Shard] = chain
+		if sharded.detectorOpts != nil {
+			sharded.stopDetector = append(sharded.stopDetector, chain.StartFailureDetector(*sharded.detectorOpts))
+		}
+		fmt.Printf("Shard %s created\n", args.Shard)
+	}
+	previousChain := sharded.chains[previous]
+	sharded.lock.Unlock()
+
+	if joined && previous != args.Shard {
+		previousChain.Leave(&api.LeaveArgs{IpPort: args.IpPort}, &api.ValReply{})
+	}
+	return chain.Join(args, reply)
+}
+
+// Removes a leaving or failed back-end node from its shard's chain
+func (sharded *ShardedChain) Leave(args *api.LeaveArgs, reply *api.ValReply) error {
+	chain := sharded.chainOf(args.IpPort)
+	if chain == nil {
+		reply.Val = "success"
+		return nil
+	}
+	return chain.Leave(args, reply)
+}
+
+// Records that a node which has joined the end of its shard's chain can
+// serve reads.  The first shard with a node serving reads is placed on the
+// ring; later shards must be added with AddShard.
+func (sharded *ShardedChain) Activate(args *api.JoinArgs, reply *api.ValReply) error {
+	chain := sharded.chainOf(args.IpPort)
+	if chain == nil {
+		return errors.New(fmt.Sprintf("Activate: %s has not joined any shard", args.IpPort))
+	}
+	if err := chain.Activate(args, reply); err != nil {
+		return err
+	}
+
+	sharded.ringLock.Lock()
+	defer sharded.ringLock.Unlock()
+	if len(sharded.ring.Shards()) == 0 {
+		shard := sharded.shardOfNode(args.IpPort)
+		sharded.ring = sharded.ring.With(shard)
+		fmt.Printf("Shard %s added to the ring\n", shard)
+	}
+	return nil
+}
+
+// Returns the membership of the chain that the node at callerIpPort has
+// joined, or an empty membership if it has not joined any
+func (sharded *ShardedChain) GetMembership(callerIpPort string, reply *api.Membership) error {
+	chain := sharded.chainOf(callerIpPort)
+	if chain == nil {
+		*reply = api.Membership{}
+		return nil
+	}
+	return chain.GetMembership(reply)
+}
+
+// Places a shard on the ring, moving the keys it now owns from the other
+// shards to its chain.  Requests wait while the keys move.
+func (sharded *ShardedChain) AddShard(args *api.ShardArgs, reply *api.ValReply) error {
+	sharded.ringLock.Lock()
+	defer sharded.ringLock.Unlock()
+	if sharded.ring.Contains(args.Name) {
+		return errors.New(fmt.Sprintf("AddShard: shard %s is already on the ring", args.Name))
+	}
+	if !sharded.isServing(args.Name) {
+		return errors.New(fmt.Sprintf("AddShard: shard %s has no nodes serving reads", args.Name))
+	}
+
+	// Discard anything left on the chain from when it was last on the ring,
+	// so that keys deleted since then are not revived
+	chain := sharded.chain(args.Name)
+	stale := api.SnapshotReply{}
+	if err := chain.GetSnapshot(&stale); err != nil {
+		return err
+	}
+	for _, entry := range stale.Entries {
+		if err := chain.Delete(&api.DeleteArgs{Key: entry.Key}, &api.ValReply{}); err != nil {
+			return err
+		}
+	}
+
+	moved, err := sharded.migrate(sharded.ring.With(args.Name))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Shard %s added to the ring, moving %d keys\n", args.Name, moved)
+	reply.Val = "success"
+	return nil
+}
+
+// Takes a shard off the ring, moving its keys to the shards which now own
+// them.  Its chain keeps running, and can be added to the ring again later.
+// Requests wait while the keys move.
+func (sharded *ShardedChain) RemoveShard(args *api.ShardArgs, reply *api.ValReply) error {
+	sharded.ringLock.Lock()
+	defer sharded.ringLock.Unlock()
+	if !sharded.ring.Contains(args.Name) {
+		return errors.New(fmt.Sprintf("RemoveShard: shard %s is not on the ring", args.Name))
+	}
+	if len(sharded.ring.Shards()) == 1 {
+		return errors.New(fmt.Sprintf("RemoveShard: shard %s is the only shard on the ring", args.Name))
+	}
+
+	moved, err := sharded.migrate(sharded.ring.Without(args.Name))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Shard %s removed from the ring, moving %d keys\n", args.Name, moved)
+	reply.Val = "success"
+	return nil
+}
+
+// Starts a failure detector for each shard's chain, including chains
+// created later.  Returns a function which stops them.
+func (sharded *ShardedChain) StartFailureDetector(opts nodechain.DetectorOptions) func() {
+	sharded.lock.Lock()
+	defer sharded.lock.Unlock()
+	sharded.detectorOpts = &opts
+	for _, chain := range sharded.chains {
+		sharded.stopDetector = append(sharded.stopDetector, chain.StartFailureDetector(opts))
+	}
+	return func() {
+		sharded.lock.Lock()
+		defer sharded.lock.Unlock()
+		for _, stop := range sharded.stopDetector {
+			stop()
+		}
+		sharded.stopDetector = nil
+		sharded.detectorOpts = nil
+	}
+}
+
+// Copy every key whose owner differs on newRing to its new owner, then
+// switch to newRing and delete the copied keys from their previous owners
+// If a copy fails the current ring is kept, and the keys already copied are
+// deleted from their new owners, so every key stays only where it was.
+// Otherwise a later migration would find the copies on shards which do not
+// own them, and copy their outdated values over the owners' values.
+// Returns the number of keys moved.
+// Caller must hold ringLock for writing
+func (sharded *ShardedChain) migrate(newRing *Ring) (int, error) {
+	moved := map[string][]string{}  // keys copied out of each shard
+	copied := map[string][]string{} // keys copied into each shard
+	count := 0
+	for _, shard := range sharded.ring.Shards() {
+		snapshot := api.SnapshotReply{}
+		if err := sharded.chain(shard).GetSnapshot(&snapshot); err != nil {
+			sharded.deleteKeys(copied, "after a failed move")
+			return 0, err
+		}
+		for _, entry := range snapshot.Entries {
+			owner := newRing.Owner(entry.Key)
+			if owner == shard {
+				continue
+			}
+			if err := copyEntry(sharded.chain(owner), entry); err != nil {
+				sharded.deleteKeys(copied, "after a failed move")
+				return 0, err
+			}
+			moved[shard] = append(moved[shard], entry.Key)
+			copied[owner] = append(copied[owner], entry.Key)
+			count++
+		}
+	}
+
+	sharded.ring = newRing
+	for shard := range moved {
+		if !newRing.Contains(shard) {
+			delete(moved, shard) // Keys on a shard off the ring are discarded when it is added again
+		}
+	}
+	sharded.deleteKeys(moved, "after moving it")
+	return count, nil
+}
+
+// Delete the given keys from each shard, reporting any which cannot be
+// deleted, as the key-values are then held by more than one shard
+// Caller must hold ringLock
+func (sharded *ShardedChain) deleteKeys(keysByShard map[string][]string, reason string) {
+	for shard, keys := range keysByShard {
+		for _, key := range keys {
+			if err := sharded.chain(shard).Delete(&api.DeleteArgs{Key: key}, &api.ValReply{}); err != nil {
+				fmt.Printf("Error deleting %s from shard %s %s: %s\n", key, shard, reason, err.Error())
+			}
+		}
+	}
+}
+
+// Write a key-value copied from another shard to chain, keeping its expiry time
+// Versions are local to each chain, so the copy gets a new version.
+func copyEntry(chain *nodechain.NodeChain, entry kvstore.Mutation) error {
+	if entry.ExpiresAt.IsZero() {
+		return chain.Set(&api.SetArgs{Key: entry.Key, Val: entry.Value}, &api.ValReply{})
+	}
+	ttl := time.Until(entry.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return chain.SetTTL(&api.SetTTLArgs{Key: entry.Key, Val: entry.Value, TTL: ttl}, &api.ValReply{})
+}
+
+// Call fn once for each shard owning any of keys, with the indices of its keys
+// Stops at the first error.
+// Caller must hold ringLock
+func (sharded *ShardedChain) forEachShard(keys []string, fn func(chain *nodechain.NodeChain, indices []int) error) error {
+	if len(sharded.ring.Shards()) == 0 {
+		return noShardsError()
+	}
+	indices := map[string][]int{}
+	shards := []string{}
+	for i, key := range keys {
+		shard := sharded.ring.Owner(key)
+		if _, found := indices[shard]; !found {
+			shards = append(shards, shard)
+		}
+		indices[shard] = append(indices[shard], i)
+	}
+	for _, shard := range shards {
+		if err := fn(sharded.chain(shard), indices[shard]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the chain of the shard which owns key
+// Caller must hold ringLock
+func (sharded *ShardedChain) owner(key string) (*nodechain.NodeChain, error) {
+	shard := sharded.ring.Owner(key)
+	if shard == "" {
+		return nil, noShardsError()
+	}
+	return sharded.chain(shard), nil
+}
+
+// Returns the chain of shard, which nodes have joined
+func (sharded *ShardedChain) chain(shard string) *nodechain.NodeChain {
+	sharded.lock.Lock()
+	defer sharded.lock.Unlock()
+	return sharded.chains[shard]
+}
+
+// Returns the chain that the node at ipPort has joined, or nil if none
+func (sharded *ShardedChain) chainOf(ipPort string) *nodechain.NodeChain {
+	sharded.lock.Lock()
+	defer sharded.lock.Unlock()
+	shard, joined := sharded.shardOf[ipPort]
+	if !joined {
+		return nil
+	}
+	return sharded.chains[shard]
+}
+
+// Returns the shard that the node at ipPort has joined
+func (sharded *ShardedChain) shardOfNode(ipPort string) string {
+	sharded.lock.Lock()
+	defer sharded.lock.Unlock()
+	return sharded.shardOf[ipPort]
+}
+
+// Returns whether shard's chain has a node serving reads
+func (sharded *ShardedChain) isServing(shard string) bool {
+	chain := sharded.chain(shard)
+	if chain == nil {
+		return false
+	}
+	membership := api.Membership{}
+	chain.GetMembership(&membership)
+	return len(membership.Members) > len(membership.Joining)
+}
+
+func noShardsError() error {
+	return errors.New("Key-value store is unavailable: no shards have nodes serving reads")
+}
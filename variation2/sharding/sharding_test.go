@@ -0,0 +1,316 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// Back-end node which is the only member of its shard's chain, serving
+// requests from its own store
+type fakeNode struct {
+	store    *kvstore.KVStore
+	setsLeft int // if refusing, number of further Set calls to serve before refusing the rest
+	refusing bool
+	lock     *sync.Mutex
+}
+
+func (node *fakeNode) Get(args *api.GetArgs, reply *api.ValReply) error {
+	reply.Val, reply.Version, reply.Found = node.store.LookupVersion(args.Key)
+	return nil
+}
+
+func (node *fakeNode) Set(args *api.SetArgs, reply *api.ValReply) error {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if node.refusing && node.setsLeft == 0 {
+		return errors.New("fake node refused Set")
+	} else if node.refusing {
+		node.setsLeft--
+	}
+	reply.Val = node.store.Set(args.Key, args.Val)
+	return nil
+}
+
+func (node *fakeNode) SetTTL(args *api.SetTTLArgs, reply *api.ValReply) error {
+	reply.Val = node.store.SetWithTTL(args.Key, args.Val, args.TTL)
+	return nil
+}
+
+func (node *fakeNode) TestSet(args *api.TestSetArgs, reply *api.ValReply) error {
+	reply.Val = node.store.TestSet(args.Key, args.TestVal, args.NewVal)
+	return nil
+}
+
+func (node *fakeNode) Delete(args *api.DeleteArgs, reply *api.ValReply) error {
+	reply.Found = node.store.Delete(args.Key)
+	return nil
+}
+
+func (node *fakeNode) MultiGet(args *api.MultiGetArgs, reply *api.MultiReply) error {
+	reply.Entries = node.store.MultiGet(args.Keys)
+	return nil
+}
+
+func (node *fakeNode) MultiSet(args *api.MultiSetArgs, reply *api.MultiReply) error {
+	reply.Entries = node.store.MultiSet(args.Entries)
+	return nil
+}
+
+func (node *fakeNode) Scan(args *api.ScanArgs, reply *api.ScanReply) error {
+	reply.Entries, reply.NextKey = node.store.Scan(args.StartKey, args.EndKey, args.Limit)
+	return nil
+}
+
+func (node *fakeNode) Txn(args *api.TxnArgs, reply *api.TxnReply) error {
+	result, err := node.store.Txn(kvstore.Txn(*args))
+	*reply = api.TxnReply(result)
+	return err
+}
+
+func (node *fakeNode) GetSnapshot(_ int, reply *api.SnapshotReply) error {
+	reply.Entries, reply.Seq = node.store.Snapshot()
+	return nil
+}
+
+func (node *fakeNode) GetMembership(_ string, reply *api.Membership) error {
+	return nil
+}
+
+func (node *fakeNode) UpdateMembership(args *api.Membership, reply *api.ValReply) error {
+	return nil
+}
+
+// Start a fake node listening on a free port, and join it to shard as its
+// only node serving reads.  Returns the node's store.
+func startShard(t *testing.T, sharded *ShardedChain, shard string) *kvstore.KVStore {
+	return startFakeShard(t, sharded, shard).store
+}
+
+// Start a fake node as startShard does, returning the node
+func startFakeShard(t *testing.T, sharded *ShardedChain, shard string) *fakeNode {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake node: %s", err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	node := &fakeNode{store: kvstore.New(), lock: &sync.Mutex{}}
+	server := rpc.NewServer()
+	server.RegisterName("KeyValService", node)
+	go server.Accept(listener)
+
+	ipPort := listener.Addr().String()
+	if err := sharded.Join(&api.JoinArgs{IpPort: ipPort, Shard: shard}, &api.Membership{}); err != nil {
+		t.Fatalf("Error joining shard %s: %s", shard, err.Error())
+	}
+	if err := sharded.Activate(&api.JoinArgs{IpPort: ipPort}, &api.ValReply{}); err != nil {
+		t.Fatalf("Error activating node in shard %s: %s", shard, err.Error())
+	}
+	return node
+}
+
+// Serve n more Set calls, then refuse the rest until refuseSetsAfter is
+// called with a negative n
+func (node *fakeNode) refuseSetsAfter(n int) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	node.refusing, node.setsLeft = n >= 0, n
+}
+
+// Set keys "key_0" to "key_<n-1>", each to its own name
+func setKeys(t *testing.T, sharded *ShardedChain, n int) {
+	for _, key := range testKeys(n) {
+		if err := sharded.Set(&api.SetArgs{Key: key, Val: key}, &api.ValReply{}); err != nil {
+			t.Fatalf("Error setting %s: %s", key, err.Error())
+		}
+	}
+}
+
+// Check that every key is readable, and that each shard's store holds
+// exactly the keys the ring assigns to it
+func checkKeys(t *testing.T, sharded *ShardedChain, stores map[string]*kvstore.KVStore, n int) {
+	for _, key := range testKeys(n) {
+		reply := api.ValReply{}
+		if err := sharded.Get(&api.GetArgs{Key: key}, &reply); err != nil || reply.Val != key {
+			t.Errorf("Get(%s) returned %s, %v, expected %s", key, reply.Val, err, key)
+		}
+	}
+	total := 0
+	for shard, store := range stores {
+		entries, _ := store.Snapshot()
+		for _, entry := range entries {
+			if owner := sharded.ring.Owner(entry.Key); owner != shard {
+				t.Errorf("Shard %s held %s, which is owned by shard %s", shard, entry.Key, owner)
+			}
+		}
+		total += len(entries)
+	}
+	if total != n {
+		t.Errorf("Shards held %d keys in total, expected %d", total, n)
+	}
+}
+
+func TestAddShard_MovesKeysToNewShard(t *testing.T) {
+	sharded := New("127.0.0.1:0")
+	stores := map[string]*kvstore.KVStore{"a": startShard(t, sharded, "a")}
+	setKeys(t, sharded, 100)
+	stores["b"] = startShard(t, sharded, "b")
+	if entries, _ := stores["b"].Snapshot(); len(entries) != 0 {
+		t.Errorf("Shard b held %d keys before being added to the ring, expected 0", len(entries))
+	}
+
+	if err := sharded.AddShard(&api.ShardArgs{Name: "b"}, &api.ValReply{}); err != nil {
+		t.Fatalf("Error adding shard b: %s", err.Error())
+	}
+	checkKeys(t, sharded, stores, 100)
+	if entries, _ := stores["b"].Snapshot(); len(entries) == 0 {
+		t.Errorf("Shard b held no keys after being added to the ring")
+	}
+}
+
+func TestRemoveShard_MovesKeysToRemainingShards(t *testing.T) {
+	sharded := New("127.0.0.1:0")
+	stores := map[string]*kvstore.KVStore{"a": startShard(t, sharded, "a")}
+	removed := startShard(t, sharded, "b")
+	stores["c"] = startShard(t, sharded, "c")
+	for _, shard := range []string{"b", "c"} {
+		if err := sharded.AddShard(&api.ShardArgs{Name: shard}, &api.ValReply{}); err != nil {
+			t.Fatalf("Error adding shard %s: %s", shard, err.Error())
+		}
+	}
+	setKeys(t, sharded, 100)
+
+	if err := sharded.RemoveShard(&api.ShardArgs{Name: "b"}, &api.ValReply{}); err != nil {
+		t.Fatalf("Error removing shard b: %s", err.Error())
+	}
+	checkKeys(t, sharded, stores, 100)
+
+	// The removed shard's stale keys are discarded when it is added again
+	removed.Set("key_0", "stale")
+	stores["b"] = removed
+	if err := sharded.AddShard(&api.ShardArgs{Name: "b"}, &api.ValReply{}); err != nil {
+		t.Fatalf("Error adding shard b again: %s", err.Error())
+	}
+	checkKeys(t, sharded, stores, 100)
+}
+
+func TestRemoveShard_FailedMoveLeavesNoCopies(t *testing.T) {
+	sharded := New("127.0.0.1:0")
+	a := startFakeShard(t, sharded, "a")
+	stores := map[string]*kvstore.KVStore{"a": a.store, "b": startShard(t, sharded, "b"), "c": startShard(t, sharded, "c")}
+	for _, shard := range []string{"b", "c"} {
+		if err := sharded.AddShard(&api.ShardArgs{Name: shard}, &api.ValReply{}); err != nil {
+			t.Fatalf("Error adding shard %s: %s", shard, err.Error())
+		}
+	}
+	setKeys(t, sharded, 100)
+
+	a.refuseSetsAfter(3)
+	if err := sharded.RemoveShard(&api.ShardArgs{Name: "b"}, &api.ValReply{}); err == nil {
+		t.Fatalf("RemoveShard(b) succeeded although shard a refused its keys")
+	}
+	a.refuseSetsAfter(-1)
+	checkKeys(t, sharded, stores, 100)
+
+	// Copies left behind would be moved over the owners' later values
+	for _, key := range testKeys(100) {
+		sharded.Set(&api.SetArgs{Key: key, Val: "new"}, &api.ValReply{})
+	}
+	stores["d"] = startShard(t, sharded, "d")
+	if err := sharded.AddShard(&api.ShardArgs{Name: "d"}, &api.ValReply{}); err != nil {
+		t.Fatalf("Error adding shard d: %s", err.Error())
+	}
+	for _, key := range testKeys(100) {
+		reply := api.ValReply{}
+		if err := sharded.Get(&api.GetArgs{Key: key}, &reply); err != nil || reply.Val != "new" {
+			t.Errorf("Get(%s) after a failed move returned %s, %v, expected new", key, reply.Val, err)
+		}
+	}
+}
+
+func TestRemoveShard_RejectsOnlyShard(t *testing.T) {
+	sharded := New("127.0.0.1:0")
+	startShard(t, sharded, "a")
+	if err := sharded.RemoveShard(&api.ShardArgs{Name: "a"}, &api.ValReply{}); err == nil {
+		t.Errorf("Removing the only shard succeeded, expected an error")
+	}
+}
+
+func TestAddShard_RequiresServingNode(t *testing.T) {
+	sharded := New("127.0.0.1:0")
+	startShard(t, sharded, "a")
+	if err := sharded.AddShard(&api.ShardArgs{Name: "b"}, &api.ValReply{}); err == nil {
+		t.Errorf("Adding a shard without nodes succeeded, expected an error")
+	}
+}
+
+func TestGet_NoShards(t *testing.T) {
+	sharded := New("127.0.0.1:0")
+	if err := sharded.Get(&api.GetArgs{Key: "a"}, &api.ValReply{}); err == nil {
+		t.Errorf("Get with no shards succeeded, expected an error")
+	}
+}
+
+func TestTxn_RejectsKeysOnSeveralShards(t *testing.T) {
+	sharded := New("127.0.0.1:0")
+	startShard(t, sharded, "a")
+	startShard(t, sharded, "b")
+	sharded.AddShard(&api.ShardArgs{Name: "b"}, &api.ValReply{})
+
+	// Find keys owned by each shard
+	owned := map[string]string{}
+	for _, key := range testKeys(100) {
+		owned[sharded.ring.Owner(key)] = key
+	}
+	txn := api.TxnArgs{Success: []kvstore.Op{
+		{Kind: kvstore.OpSet, Key: owned["a"], Value: "1"},
+		{Kind: kvstore.OpSet, Key: owned["b"], Value: "2"},
+	}}
+	if err := sharded.Txn(&txn, &api.TxnReply{}); err == nil {
+		t.Errorf("Txn on keys owned by several shards succeeded, expected an error")
+	}
+
+	txn = api.TxnArgs{Success: []kvstore.Op{{Kind: kvstore.OpSet, Key: owned["b"], Value: "2"}}}
+	result := api.TxnReply{}
+	if err := sharded.Txn(&txn, &result); err != nil || !result.Succeeded {
+		t.Errorf("Txn on keys owned by one shard returned %v, %v, expected success", result, err)
+	}
+}
+
+func TestScan_MergesShardsInKeyOrder(t *testing.T) {
+	sharded := New("127.0.0.1:0")
+	startShard(t, sharded, "a")
+	startShard(t, sharded, "b")
+	sharded.AddShard(&api.ShardArgs{Name: "b"}, &api.ValReply{})
+	setKeys(t, sharded, 20)
+
+	keys := []string{}
+	args := api.ScanArgs{StartKey: "key_", EndKey: kvstore.PrefixEnd("key_"), Limit: 6}
+	for {
+		reply := api.ScanReply{}
+		if err := sharded.Scan(&args, &reply); err != nil {
+			t.Fatalf("Error scanning: %s", err.Error())
+		}
+		if len(reply.Entries) > args.Limit {
+			t.Fatalf("Scan returned %d entries, expected at most %d", len(reply.Entries), args.Limit)
+		}
+		for _, entry := range reply.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if reply.NextKey == "" {
+			break
+		}
+		args.StartKey = reply.NextKey
+	}
+	sortedKeys := testKeys(20)
+	sort.Strings(sortedKeys)
+	if fmt.Sprint(keys) != fmt.Sprint(sortedKeys) {
+		t.Errorf("Scan returned keys %v, expected %v", keys, sortedKeys)
+	}
+}
@@ -0,0 +1,414 @@
+// A key-value service replicated across a group of nodes using Raft, that
+// clients can interact with using RPC calls on any node
+//
+// Supported operations:
+// - get(key)
+// - set(key,val)
+// - setttl(key,val,seconds)
+// - mget(key1,key2,...)
+// - mset(key1,val1,key2,val2,...)
+// - testset(key,testval,newval)
+// - cas(key,version,newval)
+// - delete(key)
+// - move(key,newkey)
+// - scan(prefix)
+// - watch(key)
+//
+// Usage: go run kvservice.go [ip:port] [peer ip:port,...] [--data-dir dir]
+//          [--snapshot-threshold 1000] [--election-timeout 300ms] [--heartbeat-interval 50ms]
+//
+// - [ip:port] : the IP address and TCP port to use to listen for client and peer connections
+// - [peer ip:port,...] : ip:port of every node in the group, including this one
+// - [--data-dir dir] : if given, persist the node's log and snapshots in dir
+//   and recover them on startup
+// - [--snapshot-threshold] : number of log entries after which the node snapshots its key-values
+// - [--election-timeout] : minimum time without a leader before a node starts an election
+// - [--heartbeat-interval] : time between heartbeats from the leader to each other node
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"github.com/msayson/kvservice/util/raft"
+	"github.com/msayson/kvservice/util/rpc_util"
+	"log"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+)
+
+type KeyValService int
+
+// A client request, as stored in the replicated log.  Exactly one request is set.
+// Reads are also stored so that they observe every write committed before them.
+// Every node decides which keys have expired by the time the leader gives each
+// command, rather than its own clock, so that a command sees the same keys
+// expired on every node however long after the leader it is applied.
+type command struct {
+	Now            time.Time // chosen by the leader when appending the command
+	Get            *api.GetArgs
+	Set            *api.SetArgs
+	MultiGet       *api.MultiGetArgs
+	MultiSet       *api.MultiSetArgs
+	SetTTL         *api.SetTTLArgs
+	ExpiresAt      time.Time // SetTTL only: chosen by the leader, so that every node expires the key together
+	TestSet        *api.TestSetArgs
+	CompareAndSwap *api.CompareAndSwapArgs
+	Scan           *api.ScanArgs
+	Txn            *api.TxnArgs
+	Delete         *api.DeleteArgs
+	Reap           bool // evict keys which have expired, see reapExpired
+}
+
+// Result of applying a command.  Only the field for the command's request is set.
+type commandReply struct {
+	Val            api.ValReply
+	Multi          api.MultiReply
+	CompareAndSwap api.CompareAndSwapReply
+	Scan           api.ScanReply
+	Txn            api.TxnReply
+}
+
+// Format of a snapshot of the key-value store
+type snapshot struct {
+	Seq     uint64    // sequence number of the last mutation included
+	Now     time.Time // time of the last command included, see logClock
+	Entries []kvstore.Mutation
+}
+
+// Time to wait for a submitted command to be applied before giving up
+const proposalTimeout = 5 * time.Second
+
+// Number of recent changes kept for clients watching for changes
+const watchHistorySize = 10000
+
+// Time between checks by the leader for keys which have expired
+const reapInterval = time.Second
+
+var store *kvstore.KVStore
+
+// Latest time given to a command applied to store, which store uses as the
+// current time.  Only the goroutine applying commands accesses it.
+var logClock time.Time
+
+// Recent changes to store, for Watch RPC calls
+var watcher *kvstore.Watcher
+
+// This node's member of the Raft group
+var raftNode *raft.Raft
+
+// Commands submitted by this node, waiting to be applied
+var proposals = raft.NewProposals()
+
+// Number of log entries after which the key-value store is snapshotted
+var snapshotThreshold int
+
+// Get RPC call: retrieves a key-value once every earlier write is applied
+func (kvs *KeyValService) Get(args *api.GetArgs, reply *api.ValReply) error {
+	if leader, isLeader := leaderIpPort(); !isLeader {
+		return forward(leader, "KeyValService.Get", args, reply)
+	}
+	result, err := submit(command{Get: args})
+	*reply = result.Val
+	return err
+}
+
+// Set RPC call: sets a key-value on a majority of nodes
+func (kvs *KeyValService) Set(args *api.SetArgs, reply *api.ValReply) error {
+	if leader, isLeader := leaderIpPort(); !isLeader {
+		return forward(leader, "KeyValService.Set", args, reply)
+	}
+	result, err := submit(command{Set: args})
+	*reply = result.Val
+	return err
+}
+
+// MultiGet RPC call: retrieves a batch of key-values once every earlier write is applied
+func (kvs *KeyValService) MultiGet(args *api.MultiGetArgs, reply *api.MultiReply) error {
+	if leader, isLeader := leaderIpPort(); !isLeader {
+		return forward(leader, "KeyValService.MultiGet", args, reply)
+	}
+	result, err := submit(command{MultiGet: args})
+	*reply = result.Multi
+	return err
+}
+
+// MultiSet RPC call: sets a batch of key-values on a majority of nodes
+func (kvs *KeyValService) MultiSet(args *api.MultiSetArgs, reply *api.MultiReply) error {
+	if leader, isLeader := leaderIpPort(); !isLeader {
+		return forward(leader, "KeyValService.MultiSet", args, reply)
+	}
+	result, err := submit(command{MultiSet: args})
+	*reply = result.Multi
+	return err
+}
+
+// SetTTL RPC call: sets a key-value on a majority of nodes that expires after a time-to-live
+func (kvs *KeyValService) SetTTL(args *api.SetTTLArgs, reply *api.ValReply) error {
+	if leader, isLeader := leaderIpPort(); !isLeader {
+		return forward(leader, "KeyValService.SetTTL", args, reply)
+	}
+	result, err := submit(command{SetTTL: args, ExpiresAt: time.Now().Add(args.TTL)})
+	*reply = result.Val
+	return err
+}
+
+// TestSet RPC call: test-sets a key-value on a majority of nodes
+func (kvs *KeyValService) TestSet(args *api.TestSetArgs, reply *api.ValReply) error {
+	if leader, isLeader := leaderIpPort(); !isLeader {
+		return forward(leader, "KeyValService.TestSet", args, reply)
+	}
+	result, err := submit(command{TestSet: args})
+	*reply = result.Val
+	return err
+}
+
+// CompareAndSwap RPC call: sets a key-value on a majority of nodes if its version matches
+func (kvs *KeyValService) CompareAndSwap(args *api.CompareAndSwapArgs, reply *api.CompareAndSwapReply) error {
+	if leader, isLeader := leaderIpPort(); !isLeader {
+		return forward(leader, "KeyValService.CompareAndSwap", args, reply)
+	}
+	result, err := submit(command{CompareAndSwap: args})
+	*reply = result.CompareAndSwap
+	return err
+}
+
+// Scan RPC call: lists key-values in a key range once every earlier write is applied
+func (kvs *KeyValService) Scan(args *api.ScanArgs, reply *api.ScanReply) error {
+	if leader, isLeader := leaderIpPort(); !isLeader {
+		return forward(leader, "KeyValService.Scan", args, reply)
+	}
+	result, err := submit(command{Scan: args})
+	*reply = result.Scan
+	return err
+}
+
+// Watch RPC call: waits for changes to key-values applied on this node
+// Every node applies the same changes with the same versions, so a client
+// can watch any node.
+func (kvs *KeyValService) Watch(args *api.WatchArgs, reply *api.WatchReply) error {
+	var err error
+	reply.Events, reply.NextVersion, err = watcher.Wait(args.Key, args.IsPrefix, args.SinceVersion, args.Timeout)
+	reply.Compacted = err == kvstore.ErrHistoryCompacted
+	return nil
+}
+
+// Txn RPC call: executes a multi-key transaction on a majority of nodes
+func (kvs *KeyValService) Txn(args *api.TxnArgs, reply *api.TxnReply) error {
+	if leader, isLeader := leaderIpPort(); !isLeader {
+		return forward(leader, "KeyValService.Txn", args, reply)
+	}
+	if err := kvstore.Txn(*args).Validate(); err != nil {
+		return err
+	}
+	result, err := submit(command{Txn: args})
+	*reply = result.Txn
+	return err
+}
+
+// Delete RPC call: removes a key-value from a majority of nodes
+func (kvs *KeyValService) Delete(args *api.DeleteArgs, reply *api.ValReply) error {
+	if leader, isLeader := leaderIpPort(); !isLeader {
+		return forward(leader, "KeyValService.Delete", args, reply)
+	}
+	result, err := submit(command{Delete: args})
+	*reply = result.Val
+	return err
+}
+
+// Returns the ip:port of the leader, or "" if unknown, and whether this node is the leader
+func leaderIpPort() (string, bool) {
+	_, isLeader, leader := raftNode.State()
+	return leader, isLeader
+}
+
+// Pass an RPC call on to the leader, so that clients can connect to any node
+func forward(leader string, method string, args interface{}, reply interface{}) error {
+	if leader == "" {
+		return errors.New("no leader has been elected, try again later")
+	}
+	rpcClient, err := rpc_util.DialTimeout(leader, time.Second)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error connecting to leader %s: %s", leader, err.Error()))
+	}
+	defer rpcClient.Close()
+	return rpcClient.Call(method, args, reply)
+}
+
+// Append cmd to the replicated log and wait for it to be applied
+// Returns an error if this node stops leading before cmd is committed.
+func submit(cmd command) (commandReply, error) {
+	cmd.Now = time.Now()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return commandReply{}, err
+	}
+
+	result, isLeader, err := proposals.Submit(raftNode, data, proposalTimeout)
+	if !isLeader {
+		return commandReply{}, errors.New("this node is no longer the leader, try again")
+	} else if err != nil {
+		return commandReply{}, err
+	}
+	return result.(commandReply), nil
+}
+
+// Apply committed commands and snapshots to store in log order, replying
+// to the RPC calls that submitted them
+func applyCommitted(applyCh <-chan raft.ApplyMsg) {
+	for msg := range applyCh {
+		if msg.Snapshot != nil {
+			var snap snapshot
+			if err := json.Unmarshal(msg.Snapshot, &snap); err != nil {
+				log.Fatal("Error decoding snapshot:", err)
+			}
+			store.Restore(snap.Entries, snap.Seq)
+			watcher.Restored(snap.Seq)
+			logClock = snap.Now
+			proposals.Finish(msg.Index, msg.Term, nil)
+			continue
+		}
+
+		result := commandReply{}
+		if msg.Command != nil {
+			var cmd command
+			if err := json.Unmarshal(msg.Command, &cmd); err != nil {
+				log.Fatal("Error decoding log entry:", err)
+			}
+			execute(&cmd, &result)
+		}
+		proposals.Finish(msg.Index, msg.Term, result)
+
+		if snapshotThreshold > 0 && raftNode.LogLength() >= snapshotThreshold {
+			entries, seq := store.Snapshot()
+			data, err := json.Marshal(snapshot{seq, logClock, entries})
+			if err != nil {
+				log.Fatal("Error encoding snapshot:", err)
+			}
+			raftNode.Snapshot(msg.Index, data)
+		}
+	}
+}
+
+// Apply a command to store, filling in its result
+func execute(cmd *command, result *commandReply) {
+	// Never move the clock back, such as after a new leader with a slower
+	// clock is elected, so that expired keys stay expired
+	if cmd.Now.After(logClock) {
+		logClock = cmd.Now
+	}
+	switch {
+	case cmd.Get != nil:
+		result.Val.Val, result.Val.Version, result.Val.Found = store.LookupVersion(cmd.Get.Key)
+	case cmd.Set != nil:
+		result.Val.Val = store.Set(cmd.Set.Key, cmd.Set.Val)
+	case cmd.MultiGet != nil:
+		result.Multi.Entries = store.MultiGet(cmd.MultiGet.Keys)
+	case cmd.MultiSet != nil:
+		result.Multi.Entries = store.MultiSet(cmd.MultiSet.Entries)
+	case cmd.SetTTL != nil:
+		result.Val.Val = store.SetUntil(cmd.SetTTL.Key, cmd.SetTTL.Val, cmd.ExpiresAt)
+	case cmd.TestSet != nil:
+		result.Val.Val = store.TestSet(cmd.TestSet.Key, cmd.TestSet.TestVal, cmd.TestSet.NewVal)
+	case cmd.CompareAndSwap != nil:
+		var err error
+		args := cmd.CompareAndSwap
+		result.CompareAndSwap.Version, err = store.CompareAndSwap(args.Key, args.ExpectedVersion, args.NewVal)
+		result.CompareAndSwap.Swapped = err == nil
+	case cmd.Scan != nil:
+		result.Scan.Entries, result.Scan.NextKey = store.Scan(cmd.Scan.StartKey, cmd.Scan.EndKey, cmd.Scan.Limit)
+	case cmd.Txn != nil:
+		// Transactions are validated before they are submitted, so cannot fail
+		txnResult, _ := store.Txn(kvstore.Txn(*cmd.Txn))
+		result.Txn = api.TxnReply(txnResult)
+	case cmd.Delete != nil:
+		result.Val.Found = store.Delete(cmd.Delete.Key)
+	case cmd.Reap:
+		store.Reap()
+	}
+}
+
+// While this node is the leader, append a command evicting expired keys to
+// the log whenever a key has expired, so that every node evicts it at the
+// same point in the log and records its removal with the same version
+func reapExpired() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, isLeader := leaderIpPort(); !isLeader {
+			continue
+		}
+		if next, expiring := store.NextExpiry(); expiring && !time.Now().Before(next) {
+			if _, err := submit(command{Reap: true}); err != nil {
+				fmt.Printf("Error evicting expired keys: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+func main() {
+	ip_port, peers, raftOpts := parseRuntimeParams()
+
+	// Setup key-value store and register service
+	store = kvstore.NewWithClock(func() time.Time { return logClock })
+	watcher = kvstore.NewWatcher(store, watchHistorySize)
+	kvservice := new(KeyValService)
+	rpc.Register(kvservice)
+
+	// Join the Raft group, recovering the log from disk if enabled, and
+	// apply its committed commands in a concurrent goroutine
+	applyCh := make(chan raft.ApplyMsg)
+	var err error
+	raftNode, err = raft.New(ip_port, peers, raftOpts, applyCh)
+	if err != nil {
+		log.Fatal("Error recovering raft state:", err)
+	}
+	rpc.RegisterName("Raft", raftNode)
+	go applyCommitted(applyCh)
+	go reapExpired()
+
+	// Serve RPC connections to clients and peers
+	rpc_util.ServeRpc(ip_port)
+}
+
+// Returns ip:port to listen on, the ip:port of every node in the group,
+// and the Raft configuration
+func parseRuntimeParams() (string, []string, raft.Options) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	opts := raft.DefaultOptions()
+	flags.StringVar(&opts.DataDir, "data-dir", "", "persist the node's log and snapshots in this directory")
+	flags.IntVar(&snapshotThreshold, "snapshot-threshold", 1000, "number of log entries after which key-values are snapshotted, or 0 to disable")
+	flags.DurationVar(&opts.ElectionTimeout, "election-timeout", opts.ElectionTimeout, "minimum time without a leader before starting an election")
+	flags.DurationVar(&opts.HeartbeatInterval, "heartbeat-interval", opts.HeartbeatInterval, "time between heartbeats from the leader to each other node")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [ip:port] [peer ip:port,...] [options]\n\nOPTIONS\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if len(os.Args) < 3 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	flags.Parse(os.Args[3:])
+	peers := strings.Split(os.Args[2], ",")
+	if flags.NArg() != 0 || !contains(peers, os.Args[1]) {
+		flags.Usage()
+		os.Exit(1)
+	}
+	return os.Args[1], peers, opts
+}
+
+// Returns whether ipPorts includes ipPort
+func contains(ipPorts []string, ipPort string) bool {
+	for _, candidate := range ipPorts {
+		if candidate == ipPort {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/msayson/kvservice/api"
+	"github.com/msayson/kvservice/kvstore"
+	"github.com/msayson/kvservice/util/linearizability"
+	"github.com/msayson/kvservice/util/testutil"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a Raft group of n nodes, each built from this package and running in
+// its own process, and wait for it to elect a leader
+// Returns each node's ip:port.
+func startGroup(t *testing.T, n int) []string {
+	peers := []string{}
+	for i := 0; i < n; i++ {
+		peers = append(peers, testutil.FreeIpPort(t))
+	}
+	binary := testutil.Build(t, ".")
+	for _, ipPort := range peers {
+		testutil.Start(t, binary, ipPort, strings.Join(peers, ","))
+	}
+	testutil.WaitFor(t, 10*time.Second, "a leader to be elected", func() bool {
+		kvserver, err := rpc.Dial("tcp", peers[0])
+		if err != nil {
+			return false
+		}
+		defer kvserver.Close()
+		_, err = api.Set(kvserver, "elected", "true")
+		return err == nil
+	})
+	return peers
+}
+
+func TestRaftGroup_IsLinearizable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Runs nodes in their own processes")
+	}
+	peers := startGroup(t, 3)
+	history, err := linearizability.DefaultWorkload().Run(func(client int) (*rpc.Client, error) {
+		return rpc.Dial("tcp", peers[client%len(peers)])
+	})
+	if err != nil {
+		t.Fatalf("Error running workload: %s", err.Error())
+	}
+	if err := linearizability.Check(history.Operations()); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestExecute_ExpiresByLeaderTime(t *testing.T) {
+	store = kvstore.NewWithClock(func() time.Time { return logClock })
+	logClock = time.Time{}
+	t.Cleanup(func() { store, logClock = nil, time.Time{} })
+	leaderTime := time.Unix(1000, 0)
+
+	// Every command is applied long after the leader's times, as on a lagging
+	// node, so expiry by the local clock would differ from the leader's
+	commands := []command{
+		{Now: leaderTime, SetTTL: &api.SetTTLArgs{Key: "a", Val: "1"}, ExpiresAt: leaderTime.Add(time.Minute)},
+		{Now: leaderTime.Add(time.Second), TestSet: &api.TestSetArgs{Key: "a", TestVal: "1", NewVal: "2"}},
+		{Now: leaderTime.Add(2 * time.Second), SetTTL: &api.SetTTLArgs{Key: "b", Val: "1"}, ExpiresAt: leaderTime.Add(time.Minute)},
+		{Now: leaderTime.Add(2 * time.Minute), Reap: true},
+		{Now: leaderTime, Get: &api.GetArgs{Key: "b"}},
+	}
+	results := make([]commandReply, len(commands))
+	for i := range commands {
+		execute(&commands[i], &results[i])
+	}
+	if results[1].Val.Val != "2" {
+		t.Errorf("TestSet(a,1,2) before a expired by the leader's time returned %s, expected 2", results[1].Val.Val)
+	}
+	if results[4].Val.Found {
+		t.Errorf("Get(b) with an earlier time than its eviction found %s, expected it to stay expired", results[4].Val.Val)
+	}
+	if val, _, found := store.LookupVersion("b"); found || store.Seq() != 4 {
+		t.Errorf("b after eviction was (%s, %t) at seq %d, expected its removal recorded as change 4", val, found, store.Seq())
+	}
+}